@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// catchmentSummary is the catchment seen in a set of results files
+type catchmentSummary struct {
+	Replies    int                `json:"replies"`
+	Responders int                `json:"responders"`
+	Collectors []collectorSummary `json:"collectors"`
+}
+
+// collectorSummary is the share of replies that arrived at a single collector
+type collectorSummary struct {
+	ID         uint16         `json:"id"`
+	Name       string         `json:"name"`
+	Replies    int            `json:"replies"`
+	Share      float64        `json:"share"`
+	Responders int            `json:"responders"`
+	MedianRTT  float64        `json:"median_rtt,omitempty"`
+	P90RTT     float64        `json:"p90_rtt,omitempty"`
+	P99RTT     float64        `json:"p99_rtt,omitempty"`
+	ByNode     map[string]int `json:"by_node"` // Replies by the node that sent the probe
+}
+
+// runAnalyze summarizes the catchment in recorded results files
+func runAnalyze(args []string) error {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	configFile := fs.String("c", "config.yml", "Config file to name nodes from, if it exists")
+	targetsFile := fs.String("t", "", "Comma-separated targets files the probes were sent to, to map pcap replies to targets")
+	jsonOutput := fs.Bool("json", false, "Print the summary as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: verfploeter analyze [flags] results-or-pcap-file...\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("no results files given")
+	}
+
+	config := &Config{}
+	if _, err := os.Stat(*configFile); err == nil {
+		config, err = loadConfig(*configFile)
+		if err != nil {
+			return err
+		}
+	}
+	if *targetsFile != "" {
+		t, err := loadTargets(strings.Split(*targetsFile, ","))
+		if err != nil {
+			return err
+		}
+		targets.set(t)
+	}
+
+	var records []replyRecord
+	for _, filename := range fs.Args() {
+		r, err := readResults(filename, config)
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %s", filename, err)
+		}
+		records = append(records, r...)
+	}
+	summary := summarizeCatchment(records, config.Nodes)
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(summary)
+	}
+
+	fmt.Printf("%d replies from %d responders\n\n", summary.Replies, summary.Responders)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COLLECTOR\tREPLIES\tSHARE\tRESPONDERS\tMEDIAN RTT")
+	for _, c := range summary.Collectors {
+		rtt := "-"
+		if c.MedianRTT > 0 {
+			rtt = time.Duration(c.MedianRTT * float64(time.Second)).Round(time.Microsecond).String()
+		}
+		fmt.Fprintf(w, "%s\t%d\t%.1f%%\t%d\t%s\n", c.Name, c.Replies, c.Share*100, c.Responders, rtt)
+	}
+	return w.Flush()
+}
+
+// summarizeCatchment counts replies by the collector they arrived at, leaving out ICMP errors and traceroute hops
+func summarizeCatchment(records []replyRecord, nodes map[uint16]string) catchmentSummary {
+	var echoes []replyRecord
+	for _, record := range records {
+		if record.Error == "" && record.Hop == 0 {
+			echoes = append(echoes, record)
+		}
+	}
+	records = echoes
+
+	responders := map[string]bool{}
+	byCollector := map[uint16]*collectorSummary{}
+	collectorResponders := map[uint16]map[string]bool{}
+	rtts := map[uint16][]float64{}
+	for _, record := range records {
+		responders[record.Responder] = true
+		c, ok := byCollector[record.Collector]
+		if !ok {
+			c = &collectorSummary{ID: record.Collector, Name: findNode(record.Collector, nodes), ByNode: map[string]int{}}
+			byCollector[record.Collector] = c
+			collectorResponders[record.Collector] = map[string]bool{}
+		}
+		c.Replies++
+		c.ByNode[findNode(record.Node, nodes)]++
+		collectorResponders[record.Collector][record.Responder] = true
+		if record.RTT > 0 {
+			rtts[record.Collector] = append(rtts[record.Collector], record.RTT)
+		}
+	}
+
+	summary := catchmentSummary{Replies: len(records), Responders: len(responders)}
+	for id, c := range byCollector {
+		c.Share = float64(c.Replies) / float64(len(records))
+		c.Responders = len(collectorResponders[id])
+		if r := rtts[id]; len(r) > 0 {
+			sort.Float64s(r)
+			c.MedianRTT = r[len(r)/2]
+			c.P90RTT = r[len(r)*9/10]
+			c.P99RTT = r[len(r)*99/100]
+		}
+		summary.Collectors = append(summary.Collectors, *c)
+	}
+	sort.Slice(summary.Collectors, func(i, j int) bool {
+		return summary.Collectors[i].Replies > summary.Collectors[j].Replies
+	})
+	return summary
+}
+
+// readResults reads reply records from a JSONL or CSV results file, or reconstructs them from a pcap
+// captured at the node in config
+func readResults(filename string, config *Config) ([]replyRecord, error) {
+	if filepath.Ext(filename) == ".pcap" {
+		var key []byte
+		if config.Probe.Secret != "" {
+			key = []byte(config.Probe.Secret)
+		}
+		return readPcap(filename, config.ID, config.Nodes, key, config.Probe.Timeout)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if filepath.Ext(filename) == "."+formatCSV {
+		return readResultsCSV(f)
+	}
+
+	var records []replyRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record replyRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// readResultsCSV reads reply records from a CSV results file, matching columns by the header so files
+// written by older versions with fewer columns can still be read
+func readResultsCSV(r io.Reader) ([]replyRecord, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []replyRecord
+	for {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		var record replyRecord
+		for i, value := range row {
+			if i >= len(header) || value == "" {
+				continue
+			}
+			switch header[i] {
+			case "time":
+				record.Time, _ = time.Parse(time.RFC3339Nano, value)
+			case "collector":
+				n, _ := strconv.ParseUint(value, 10, 16)
+				record.Collector = uint16(n)
+			case "node":
+				n, _ := strconv.ParseUint(value, 10, 16)
+				record.Node = uint16(n)
+			case "responder":
+				record.Responder = value
+			case "target":
+				record.Target = value
+			case "sweep":
+				n, _ := strconv.ParseUint(value, 10, 32)
+				record.Sweep = uint32(n)
+			case "seq":
+				record.Seq, _ = strconv.Atoi(value)
+			case "rtt":
+				record.RTT, _ = strconv.ParseFloat(value, 64)
+			case "response":
+				record.Response = value
+			case "site":
+				record.Site = value
+			case "country":
+				record.Country = value
+			case "asn":
+				n, _ := strconv.ParseUint(value, 10, 32)
+				record.ASN = uint32(n)
+			case "ttl":
+				record.TTL, _ = strconv.Atoi(value)
+			case "source":
+				record.Source = value
+			case "announced":
+				record.Announced = strings.Fields(value)
+			case "error":
+				record.Error = value
+			case "code":
+				record.Code, _ = strconv.Atoi(value)
+			case "mtu":
+				record.MTU, _ = strconv.Atoi(value)
+			case "size":
+				record.Size, _ = strconv.Atoi(value)
+			case "protocol":
+				record.Protocol = value
+			case "hop":
+				record.Hop, _ = strconv.Atoi(value)
+			case "destination":
+				record.Destination = value
+			case "anycast_site":
+				record.AnycastSite = value
+			case "profile":
+				record.Profile = value
+			}
+		}
+		records = append(records, record)
+	}
+}
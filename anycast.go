@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// anycastSite tags replies that were sent to one of the anycast prefixes with the site that received them,
+// which is what the catchment of the prefix is made of. Replies to a node's unicast addresses arrived there
+// because of who sent the probe, not the catchment, so they're left alone.
+type anycastSite struct {
+	prefixes []*net.IPNet
+	site     string // Empty to use the collector's node name
+	replies  *prometheus.CounterVec
+}
+
+// anycast is nil unless anycast.prefixes is set
+var anycast *anycastSite
+
+func newAnycastSite(config *Config, reg prometheus.Registerer, constLabels prometheus.Labels) *anycastSite {
+	factory := promauto.With(reg)
+	a := &anycastSite{
+		site: config.Anycast.Site,
+		replies: factory.NewCounterVec(prometheus.CounterOpts{
+			Name:        "verfploeter_anycast_replies_total",
+			ConstLabels: constLabels,
+		}, []string{"site", "node"}),
+	}
+	for _, prefix := range config.Anycast.Prefixes {
+		ipNet, _ := parsePrefix(prefix)
+		a.prefixes = append(a.prefixes, ipNet)
+	}
+	return a
+}
+
+// tag sets the site of a reply if it was sent to an anycast address, counting it by the node that sent the probe
+func (a *anycastSite) tag(record *replyRecord, dst net.IP) {
+	if dst == nil || !a.contains(dst) {
+		return
+	}
+	record.AnycastSite = a.site
+	if record.AnycastSite == "" {
+		record.AnycastSite = findNode(record.Collector, currentNodes())
+	}
+	a.replies.With(map[string]string{"site": record.AnycastSite, "node": findNode(record.Node, currentNodes())}).Inc()
+}
+
+// contains checks if an address is in one of the anycast prefixes
+func (a *anycastSite) contains(ip net.IP) bool {
+	for _, prefix := range a.prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAnycast validates the anycast prefixes
+func checkAnycast(config *Config) error {
+	for _, prefix := range config.Anycast.Prefixes {
+		if _, err := parsePrefix(prefix); err != nil {
+			return fmt.Errorf("invalid prefix in anycast.prefixes: %s", err)
+		}
+	}
+	if config.Anycast.Site != "" && len(config.Anycast.Prefixes) == 0 {
+		return errors.New("anycast.site needs anycast.prefixes")
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// probeHandler sends a single probe to the target given in the query string
+func probeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "missing target", http.StatusBadRequest)
+			return
+		}
+
+		log.WithField("target", target).Info("Sending on-demand probe")
+		if err := sendProbe(probeTarget{target: target, profile: targetProfile(target)}); err != nil {
+			var dnsErr *net.DNSError
+			var addrErr *net.AddrError
+			if errors.As(err, &dnsErr) || errors.As(err, &addrErr) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/natesales/go-verfploeter/pkg/verfploeter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// packetWriter records the addresses packets are written to
+type packetWriter struct {
+	addrs []string
+}
+
+func (w *packetWriter) WriteTo(b []byte, addr net.Addr) (int, error) {
+	w.addrs = append(w.addrs, addr.String())
+	return len(b), nil
+}
+
+// testProfile returns a profile probing targets over ICMP through a prober that writes to w
+func testProfile(t *testing.T, reg prometheus.Registerer, name string, num uint32, w *packetWriter, targets ...string) *probeProfile {
+	t.Helper()
+	p := &probeProfile{
+		name:    name,
+		num:     num,
+		config:  &Config{ID: 10},
+		targets: &targetList{},
+		metrics: newProbeMetrics(&Config{ID: 10}, reg, name),
+	}
+	p.targets.set(targets)
+	p.sources.Add(&verfploeter.Source{
+		Addr:   net.IPv4zero,
+		Proto:  1,
+		Prober: &verfploeter.Prober{ID: 10, Conn4: w, Tracker: verfploeter.NewTracker()},
+	})
+	return p
+}
+
+func TestProbeHandler(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	w := &packetWriter{}
+	v4 := testProfile(t, reg, "v4", 0, w, "192.0.2.1")
+	test := testProfile(t, reg, "test", 1, w, "198.51.100.1")
+	profiles = []*probeProfile{v4, test}
+	defer func() { profiles = nil }()
+
+	for _, tc := range []struct {
+		method, target string
+		code           int
+		profile        *probeProfile
+	}{
+		{http.MethodPost, "198.51.100.1", http.StatusAccepted, test},
+		{http.MethodPost, "203.0.113.1", http.StatusAccepted, v4},
+		{http.MethodPost, "", http.StatusBadRequest, nil},
+		{http.MethodGet, "192.0.2.1", http.StatusMethodNotAllowed, nil},
+	} {
+		before := map[*probeProfile]float64{}
+		for _, p := range profiles {
+			before[p] = testutil.ToFloat64(p.metrics.requests)
+		}
+		rec := httptest.NewRecorder()
+		probeHandler().ServeHTTP(rec, httptest.NewRequest(tc.method, "/probe?target="+tc.target, nil))
+		if rec.Code != tc.code {
+			t.Errorf("%s %q: got status %d, want %d", tc.method, tc.target, rec.Code, tc.code)
+		}
+		for _, p := range profiles {
+			want := before[p]
+			if p == tc.profile {
+				want++
+			}
+			if got := testutil.ToFloat64(p.metrics.requests); got != want {
+				t.Errorf("%s %q: got %v requests for profile %s, want %v", tc.method, tc.target, got, p.name, want)
+			}
+		}
+	}
+	if len(w.addrs) != 2 || w.addrs[0] != "198.51.100.1" || w.addrs[1] != "203.0.113.1" {
+		t.Errorf("got probes sent to %v", w.addrs)
+	}
+}
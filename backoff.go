@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// backoffMaxSkips bounds how many backed off targets are passed over in a row, so probing continues at the
+// configured rate if nearly every target is unresponsive
+const backoffMaxSkips = 1000
+
+// targetBackoff probes targets that haven't answered several probes in a row less often, freeing the probe
+// budget for responsive targets. Backed off targets are still probed now and then in case they come back.
+type targetBackoff struct {
+	id      uint16
+	after   int // Lost probes in a row before a target is backed off
+	recheck int // Probe a backed off target once every this many times it's picked
+
+	lock    sync.Mutex
+	history map[string]*targetHistory // Targets that lost their last probe
+
+	backedOff prometheus.Gauge
+	skipped   prometheus.Counter
+}
+
+// targetHistory is how a target with lost probes has been probed
+type targetHistory struct {
+	lost   int // Probes lost in a row
+	picked int // Times picked since it was backed off
+}
+
+// backoff is nil unless probe.backoff.after is set
+var backoff *targetBackoff
+
+func newTargetBackoff(id uint16, after, recheck int, reg prometheus.Registerer, constLabels prometheus.Labels) *targetBackoff {
+	factory := promauto.With(reg)
+	return &targetBackoff{
+		id:      id,
+		after:   after,
+		recheck: recheck,
+		history: map[string]*targetHistory{},
+		backedOff: factory.NewGauge(prometheus.GaugeOpts{
+			Name:        "verfploeter_backoff_targets",
+			ConstLabels: constLabels,
+		}),
+		skipped: factory.NewCounter(prometheus.CounterOpts{
+			Name:        "verfploeter_backoff_skipped_total",
+			ConstLabels: constLabels,
+		}),
+	}
+}
+
+// answered forgets the lost probes of a target that answered one of this node's probes
+func (b *targetBackoff) answered(record replyRecord) {
+	if record.Node != b.id || record.Target == "" || record.Error != "" {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if h, ok := b.history[record.Target]; ok {
+		if h.lost >= b.after {
+			b.backedOff.Dec()
+		}
+		delete(b.history, record.Target)
+	}
+}
+
+// lost counts a probe to a target that went unanswered after every retry
+func (b *targetBackoff) lost(target string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	h, ok := b.history[target]
+	if !ok {
+		h = &targetHistory{}
+		b.history[target] = h
+	}
+	h.lost++
+	if h.lost == b.after {
+		b.backedOff.Inc()
+	}
+}
+
+// skip checks if a picked target should be passed over this time
+func (b *targetBackoff) skip(target string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	h, ok := b.history[target]
+	if !ok || h.lost < b.after {
+		return false
+	}
+	h.picked++
+	if h.picked%b.recheck == 0 {
+		return false
+	}
+	b.skipped.Inc()
+	return true
+}
+
+// wrap returns a target picker that passes over backed off targets
+func (b *targetBackoff) wrap(next func() probeTarget) func() probeTarget {
+	return func() probeTarget {
+		p := next()
+		for i := 0; i < backoffMaxSkips && b.skip(p.target); i++ {
+			p = next()
+		}
+		return p
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	apipb "github.com/osrg/gobgp/v3/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// bgpTimeout bounds a single query of the routing daemon
+const bgpTimeout = 10 * time.Second
+
+// bgpMonitor polls the routing daemon for the prefixes this node announces, so replies can be tagged with
+// the announcements they were collected under
+type bgpMonitor struct {
+	query  func() ([]string, error)
+	filter map[string]bool // Prefixes to track, or nil for every announced prefix
+
+	lock    sync.RWMutex
+	current []string // Sorted
+
+	announced *prometheus.GaugeVec
+	changes   prometheus.Counter
+	errors    prometheus.Counter
+}
+
+// bgp is nil unless a routing daemon is configured
+var bgp *bgpMonitor
+
+// newBGPMonitor creates a monitor for BIRD or GoBGP and reads the current announcements
+func newBGPMonitor(config *Config, reg prometheus.Registerer, constLabels prometheus.Labels) (*bgpMonitor, error) {
+	factory := promauto.With(reg)
+	m := &bgpMonitor{
+		announced: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "verfploeter_bgp_announced",
+			ConstLabels: constLabels,
+		}, []string{"prefix"}),
+		changes: factory.NewCounter(prometheus.CounterOpts{
+			Name:        "verfploeter_bgp_changes_total",
+			ConstLabels: constLabels,
+		}),
+		errors: factory.NewCounter(prometheus.CounterOpts{
+			Name:        "verfploeter_bgp_errors_total",
+			ConstLabels: constLabels,
+		}),
+	}
+	if config.BGP.BIRD != "" {
+		m.query = func() ([]string, error) {
+			return birdAnnounced(config.BGP.BIRD)
+		}
+	} else {
+		conn, err := grpc.Dial(config.BGP.GoBGP, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to GoBGP: %s", err)
+		}
+		client := apipb.NewGobgpApiClient(conn)
+		m.query = func() ([]string, error) {
+			return gobgpAnnounced(client)
+		}
+	}
+	if len(config.BGP.Prefixes) > 0 {
+		m.filter = map[string]bool{}
+		for _, prefix := range config.BGP.Prefixes {
+			_, n, _ := net.ParseCIDR(prefix)
+			m.filter[n.String()] = true
+			m.announced.With(map[string]string{"prefix": n.String()}).Set(0)
+		}
+	}
+
+	if _, err := m.poll(); err != nil {
+		log.Warnf("Unable to read BGP announcements: %s", err)
+	}
+	return m, nil
+}
+
+// prefixes returns the tracked prefixes currently announced
+func (m *bgpMonitor) prefixes() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.current
+}
+
+// run polls the announcements every interval, starting a sweep when they change if sweep is set
+func (m *bgpMonitor) run(interval time.Duration, sweep bool) {
+	for range time.Tick(interval) {
+		changed, err := m.poll()
+		if err != nil {
+			log.Warnf("Unable to read BGP announcements: %s", err)
+			continue
+		}
+		if changed && sweep {
+			if err := control.requestSweep(); err != nil {
+				log.Debugf("Not sweeping after announcement change: %s", err)
+			} else {
+				log.Info("Starting sweep after announcement change")
+			}
+		}
+	}
+}
+
+// poll reads the announcements, reporting whether they changed. The last announcements are kept on failure.
+func (m *bgpMonitor) poll() (bool, error) {
+	all, err := m.query()
+	if err != nil {
+		m.errors.Inc()
+		return false, err
+	}
+	var announced []string
+	seen := map[string]bool{}
+	for _, prefix := range all {
+		if (m.filter == nil || m.filter[prefix]) && !seen[prefix] {
+			seen[prefix] = true
+			announced = append(announced, prefix)
+		}
+	}
+	sort.Strings(announced)
+
+	m.lock.Lock()
+	previous := m.current
+	m.current = announced
+	m.lock.Unlock()
+
+	was := map[string]bool{}
+	for _, prefix := range previous {
+		was[prefix] = true
+	}
+	var added, withdrawn []string
+	for _, prefix := range announced {
+		if !was[prefix] {
+			added = append(added, prefix)
+		}
+		m.announced.With(map[string]string{"prefix": prefix}).Set(1)
+	}
+	for _, prefix := range previous {
+		if !seen[prefix] {
+			withdrawn = append(withdrawn, prefix)
+			m.announced.With(map[string]string{"prefix": prefix}).Set(0)
+		}
+	}
+	if len(added) == 0 && len(withdrawn) == 0 {
+		return false, nil
+	}
+	m.changes.Inc()
+	log.WithFields(log.Fields{
+		"announced": strings.Join(added, ","),
+		"withdrawn": strings.Join(withdrawn, ","),
+	}).Infof("Announcing %d prefixes", len(announced))
+	return true, nil
+}
+
+// birdAnnounced returns the prefixes exported to BIRD's BGP sessions, read from its control socket
+func birdAnnounced(socket string) ([]string, error) {
+	conn, err := net.DialTimeout("unix", socket, bgpTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(bgpTimeout))
+	r := bufio.NewReader(conn)
+	if _, err := birdRead(r); err != nil {
+		return nil, err
+	}
+
+	// Rows of show protocols are name, protocol, table, state, since, and info
+	if _, err := fmt.Fprintln(conn, "show protocols"); err != nil {
+		return nil, err
+	}
+	lines, err := birdRead(r)
+	if err != nil {
+		return nil, err
+	}
+	var protocols []string
+	for _, line := range lines {
+		if fields := strings.Fields(line.text); line.code == "1002" && len(fields) >= 4 && fields[1] == "BGP" && fields[3] == "up" {
+			protocols = append(protocols, fields[0])
+		}
+	}
+
+	// Routes start with the prefix, followed by lines for other paths and attributes
+	var prefixes []string
+	for _, protocol := range protocols {
+		if _, err := fmt.Fprintf(conn, "show route export %s\n", protocol); err != nil {
+			return nil, err
+		}
+		lines, err := birdRead(r)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			if fields := strings.Fields(line.text); line.code == "1007" && len(fields) > 0 {
+				if _, prefix, err := net.ParseCIDR(fields[0]); err == nil {
+					prefixes = append(prefixes, prefix.String())
+				}
+			}
+		}
+	}
+	return prefixes, nil
+}
+
+// birdLine is a line of a BIRD control socket reply
+type birdLine struct {
+	code string
+	text string
+}
+
+// birdRead reads a reply from BIRD's control socket. Lines start with a four digit code followed by a dash,
+// or a space on the last line. Continuation lines start with a space and take the code of the line before.
+func birdRead(r *bufio.Reader) ([]birdLine, error) {
+	var lines []birdLine
+	code := ""
+	for {
+		line, err := r.ReadString('\n')
+		if errors.Is(err, io.EOF) && line == "" {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\n")
+		if strings.HasPrefix(line, " ") {
+			lines = append(lines, birdLine{code, line[1:]})
+			continue
+		}
+		if len(line) < 5 {
+			return nil, fmt.Errorf("invalid reply from BIRD: %q", line)
+		}
+		code = line[:4]
+		lines = append(lines, birdLine{code, line[5:]})
+		if line[4] == ' ' {
+			if code[0] == '8' || code[0] == '9' {
+				return nil, fmt.Errorf("BIRD: %s", line[5:])
+			}
+			return lines, nil
+		}
+	}
+}
+
+// gobgpAnnounced returns the prefixes in the IPv4 and IPv6 unicast Adj-RIB-Out of GoBGP's established peers
+func gobgpAnnounced(client apipb.GobgpApiClient) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bgpTimeout)
+	defer cancel()
+
+	peers, err := client.ListPeer(ctx, &apipb.ListPeerRequest{})
+	if err != nil {
+		return nil, err
+	}
+	var neighbors []string
+	for {
+		resp, err := peers.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if state := resp.Peer.GetState(); state.GetSessionState() == apipb.PeerState_ESTABLISHED {
+			neighbors = append(neighbors, state.GetNeighborAddress())
+		}
+	}
+
+	var prefixes []string
+	for _, neighbor := range neighbors {
+		for _, afi := range []apipb.Family_Afi{apipb.Family_AFI_IP, apipb.Family_AFI_IP6} {
+			paths, err := client.ListPath(ctx, &apipb.ListPathRequest{
+				TableType: apipb.TableType_ADJ_OUT,
+				Name:      neighbor,
+				Family:    &apipb.Family{Afi: afi, Safi: apipb.Family_SAFI_UNICAST},
+			})
+			if err != nil {
+				return nil, err
+			}
+			for {
+				resp, err := paths.Recv()
+				if errors.Is(err, io.EOF) {
+					break
+				} else if err != nil {
+					return nil, err
+				}
+				if _, prefix, err := net.ParseCIDR(resp.Destination.GetPrefix()); err == nil {
+					prefixes = append(prefixes, prefix.String())
+				}
+			}
+		}
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+// catchmentKey identifies a target, or the prefix it's aggregated into, as probed by a node
+type catchmentKey struct {
+	node   uint16
+	target string
+}
+
+// catchmentPeriod is the targets seen and shifted during one sweep of a probing node, or one window
+// outside of sweep mode
+type catchmentPeriod struct {
+	sweep   uint32
+	seen    map[string]bool
+	shifted map[string]bool
+}
+
+func newCatchmentPeriod(sweep uint32) *catchmentPeriod {
+	return &catchmentPeriod{sweep: sweep, seen: map[string]bool{}, shifted: map[string]bool{}}
+}
+
+// catchmentAlert is posted to the webhook when too many targets shift between sites in a period
+type catchmentAlert struct {
+	Time      time.Time `json:"time"`
+	Node      string    `json:"node"` // Node whose probes shifted
+	Sweep     uint32    `json:"sweep,omitempty"`
+	Targets   int       `json:"targets"`
+	Shifted   int       `json:"shifted"`
+	Fraction  float64   `json:"fraction"`
+	Threshold float64   `json:"threshold"`
+}
+
+// catchmentTracker follows which collector answers each target and detects when targets shift between sites
+type catchmentTracker struct {
+	lock      sync.Mutex
+	prefixLen int
+	threshold float64
+	webhook   string
+	current   map[catchmentKey]uint16 // Collector that last answered
+	periods   map[uint16]*catchmentPeriod
+
+	changes  *prometheus.CounterVec
+	fraction *prometheus.GaugeVec
+	alerts   prometheus.Counter
+}
+
+// newCatchmentTracker creates a tracker that aggregates IPv4 targets into prefixes of prefixLen bits if
+// nonzero, and alerts when more than threshold of the targets in a period shift
+func newCatchmentTracker(prefixLen int, threshold float64, webhook string,
+	reg prometheus.Registerer, constLabels prometheus.Labels) *catchmentTracker {
+	factory := promauto.With(reg)
+	return &catchmentTracker{
+		prefixLen: prefixLen,
+		threshold: threshold,
+		webhook:   webhook,
+		current:   map[catchmentKey]uint16{},
+		periods:   map[uint16]*catchmentPeriod{},
+		changes: factory.NewCounterVec(prometheus.CounterOpts{
+			Name:        "verfploeter_catchment_changes_total",
+			ConstLabels: constLabels,
+		}, []string{"dst", "from", "to"}),
+		fraction: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "verfploeter_catchment_shift_ratio",
+			ConstLabels: constLabels,
+		}, []string{"dst"}),
+		alerts: factory.NewCounter(prometheus.CounterOpts{
+			Name:        "verfploeter_catchment_alerts_total",
+			ConstLabels: constLabels,
+		}),
+	}
+}
+
+// key returns the target a reply is tracked under
+func (t *catchmentTracker) key(record replyRecord) string {
+	target := record.Target
+	if target == "" {
+		target = record.Responder
+	}
+	if ip := net.ParseIP(target).To4(); ip != nil && t.prefixLen > 0 {
+		return (&net.IPNet{IP: ip.Mask(net.CIDRMask(t.prefixLen, 32)), Mask: net.CIDRMask(t.prefixLen, 32)}).String()
+	}
+	return target
+}
+
+// observe records the collector that answered a reply, starting a new period when a node's sweep advances
+func (t *catchmentTracker) observe(record replyRecord) {
+	target := t.key(record)
+	nodes := currentNodes()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	period, ok := t.periods[record.Node]
+	if !ok {
+		period = newCatchmentPeriod(record.Sweep)
+		t.periods[record.Node] = period
+	} else if record.Sweep > period.sweep {
+		t.end(record.Node, period)
+		period = newCatchmentPeriod(record.Sweep)
+		t.periods[record.Node] = period
+	}
+
+	key := catchmentKey{record.Node, target}
+	if prev, ok := t.current[key]; ok && prev != record.Collector {
+		period.shifted[target] = true
+		t.changes.With(map[string]string{
+			"dst":  findNode(record.Node, nodes),
+			"from": findNode(prev, nodes),
+			"to":   findNode(record.Collector, nodes),
+		}).Inc()
+		log.WithFields(log.Fields{
+			"target": target,
+			"node":   findNode(record.Node, nodes),
+			"from":   findNode(prev, nodes),
+			"to":     findNode(record.Collector, nodes),
+		}).Debug("Catchment changed")
+		if dash != nil {
+			dash.shift(dashboardShift{
+				Time:   record.Time,
+				Target: target,
+				Node:   findNode(record.Node, nodes),
+				From:   findNode(prev, nodes),
+				To:     findNode(record.Collector, nodes),
+			})
+		}
+	}
+	t.current[key] = record.Collector
+	period.seen[target] = true
+}
+
+// run ends the periods of nodes that aren't sweeping every window
+func (t *catchmentTracker) run(window time.Duration) {
+	for range time.Tick(window) {
+		t.lock.Lock()
+		for node, period := range t.periods {
+			if period.sweep == 0 {
+				t.end(node, period)
+				t.periods[node] = newCatchmentPeriod(0)
+			}
+		}
+		t.lock.Unlock()
+	}
+}
+
+// end updates the shift ratio for a node's finished period and alerts if it's over the threshold
+func (t *catchmentTracker) end(node uint16, period *catchmentPeriod) {
+	if len(period.seen) == 0 {
+		return
+	}
+	fraction := float64(len(period.shifted)) / float64(len(period.seen))
+	name := findNode(node, currentNodes())
+	t.fraction.With(map[string]string{"dst": name}).Set(fraction)
+	if t.threshold <= 0 || fraction <= t.threshold {
+		return
+	}
+
+	t.alerts.Inc()
+	alert := catchmentAlert{
+		Time:      time.Now(),
+		Node:      name,
+		Sweep:     period.sweep,
+		Targets:   len(period.seen),
+		Shifted:   len(period.shifted),
+		Fraction:  fraction,
+		Threshold: t.threshold,
+	}
+	log.WithFields(log.Fields{
+		"node":    alert.Node,
+		"sweep":   alert.Sweep,
+		"targets": alert.Targets,
+		"shifted": alert.Shifted,
+	}).Warnf("%.1f%% of targets shifted catchment", fraction*100)
+	if t.webhook != "" {
+		go t.notify(alert)
+	}
+}
+
+// notify posts an alert to the webhook
+func (t *catchmentTracker) notify(alert catchmentAlert) {
+	b, err := json.Marshal(alert)
+	if err != nil {
+		log.Warnf("Unable to encode catchment alert: %s", err)
+		return
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(t.webhook, "application/json", bytes.NewReader(b))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("unexpected status %s", resp.Status)
+		}
+	}
+	if err != nil {
+		log.Warnf("Unable to send catchment alert to %s: %s", t.webhook, err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// CHAOS probes are UDP probes carrying a CHAOS TXT query such as hostname.bind or id.server. Anycast DNS
+// servers answer with the identity of the site that received the query, which cross-checks the catchment
+// seen by ICMP.
+
+// chaosQuery builds a CHAOS TXT query for a name
+func chaosQuery(name string) ([]byte, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 0x7666})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{
+		Name:  qname,
+		Type:  dnsmessage.TypeTXT,
+		Class: dnsmessage.ClassCHAOS,
+	}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// parseChaosSite returns the site identity from the first TXT answer of a CHAOS response
+func parseChaosSite(b []byte) (string, bool) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(b); err != nil {
+		return "", false
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return "", false
+	}
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			return "", false
+		}
+		if h.Type != dnsmessage.TypeTXT {
+			if err := p.SkipAnswer(); err != nil {
+				return "", false
+			}
+			continue
+		}
+		txt, err := p.TXTResource()
+		if err != nil {
+			return "", false
+		}
+		site := strings.Join(txt.TXT, "")
+		chaosSites.With(map[string]string{"site": site}).Inc()
+		return site, true
+	}
+}
@@ -0,0 +1,814 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/natesales/go-verfploeter/pkg/verfploeter"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// mtu bounds probe payloads so that neither probes nor replies are fragmented
+	mtu            = 1500
+	maxPayloadSize = mtu - ipv6.HeaderLen - 8 // ICMP header
+
+	// Node roles
+	roleBoth       = "both"       // Send probes and collect replies
+	rolePinger     = "pinger"     // Send probes, typically spoofed from the anycast address
+	roleCollector  = "collector"  // Only collect replies to other nodes' probes
+	roleController = "controller" // Aggregate replies streamed from agents over gRPC
+
+	// Probe modes
+	modeRandom = "random" // Probe a random target each time
+	modeSweep  = "sweep"  // Probe every target in order, numbering each pass
+
+	// Probe protocols
+	protocolICMP  = "icmp"  // Echo requests
+	protocolTCP   = "tcp"   // SYNs, answered with SYN-ACK or RST
+	protocolUDP   = "udp"   // Datagrams, answered by the application or with a port unreachable
+	protocolChaos = "chaos" // UDP DNS CHAOS TXT queries, answered with the responding site's identity
+
+	// defaultProbeTimeout is how long to wait for a reply before counting a probe as lost
+	defaultProbeTimeout = 5 * time.Second
+)
+
+type Config struct {
+	ID     uint16 `yaml:"id"`
+	Role   string `yaml:"role"`
+	Listen string `yaml:"listen"`
+	Log    struct {
+		Format string `yaml:"format"`
+
+		// Replies logs every reply as JSON to a rotated file or syslog
+		Replies struct {
+			Path       string `yaml:"path"`
+			Syslog     string `yaml:"syslog"`
+			MaxSize    int    `yaml:"max_size"` // Megabytes
+			MaxBackups int    `yaml:"max_backups"`
+			MaxAge     int    `yaml:"max_age"` // Days
+		} `yaml:"replies"`
+	} `yaml:"log"`
+	API struct {
+		Enabled bool   `yaml:"enabled"`
+		Control bool   `yaml:"control"` // Enable the /control endpoints to pause, resume, and steer probing
+		Token   string `yaml:"token"`   // Bearer token required by the API if set, and always by /control
+		Listen  string `yaml:"listen"`  // Serve the API on a separate address instead of listen
+	} `yaml:"api"`
+	HTTP struct {
+		TLS struct {
+			Cert     string `yaml:"cert"`      // Serve over HTTPS with this certificate
+			Key      string `yaml:"key"`       // Certificate key
+			ClientCA string `yaml:"client_ca"` // Require client certificates signed by this CA
+		} `yaml:"tls"`
+		Token    string `yaml:"token"`    // Bearer token required by /metrics and the dashboard
+		Username string `yaml:"username"` // Or basic auth credentials
+		Password string `yaml:"password"`
+	} `yaml:"http"`
+	Targets struct {
+		Files   []string      `yaml:"files"`   // Load targets from these files unless -t is given
+		URL     string        `yaml:"url"`     // Fetch targets from this HTTP(S) URL unless -t is given
+		Refresh time.Duration `yaml:"refresh"` // Re-fetch remote targets this often
+	} `yaml:"targets"`
+	Probe struct {
+		Mode     string `yaml:"mode"`
+		Strategy struct {
+			Type          string  `yaml:"type"`           // Target selection in random mode
+			Weights       string  `yaml:"weights"`        // File of "prefix weight" lines for weighted selection
+			DefaultWeight float64 `yaml:"default_weight"` // Weight of targets outside every weighted prefix, 1 if unset
+			By            string  `yaml:"by"`             // asn or country for stratified selection
+		} `yaml:"strategy"`
+		Protocol  string        `yaml:"protocol"`
+		TCPPort   int           `yaml:"tcp_port"`
+		UDPPort   int           `yaml:"udp_port"`
+		ChaosName string        `yaml:"chaos_name"`
+		Interval  time.Duration `yaml:"interval"`
+		Rate      float64       `yaml:"rate_pps"`
+		Burst     int           `yaml:"burst"`
+		Source4   string        `yaml:"source4"`
+		Source6   string        `yaml:"source6"`
+
+		// Sources replaces source4 and source6 with any number of addresses of either family for ICMP probes
+		Sources    []string `yaml:"sources"`
+		SourceMode string   `yaml:"source_mode"`
+
+		Spoof4    string        `yaml:"spoof4"`
+		Interface string        `yaml:"interface"`
+		VRF       string        `yaml:"vrf"`
+		Timeout   time.Duration `yaml:"timeout"`
+		Retries   int           `yaml:"retries"`    // Retransmits of a probe that times out before it counts as lost
+		AnySource bool          `yaml:"any_source"` // Count replies from addresses that aren't targets
+		Fallback  struct {
+			Protocols []string            `yaml:"protocols"` // Protocols to try in order until a target answers
+			Targets   map[string][]string `yaml:"targets"`   // Protocols for targets in a prefix, the most specific wins
+		} `yaml:"fallback"`
+		PMTU     []int `yaml:"pmtu"` // IP packet sizes to probe every target with, with don't fragment set
+		Schedule struct {
+			Cron     string   `yaml:"cron"`     // Start each sweep at the times of this cron expression
+			Windows  []string `yaml:"windows"`  // Only probe inside these daily HH:MM-HH:MM windows
+			Timezone string   `yaml:"timezone"` // Time zone of the cron times and windows, the system's if unset
+		} `yaml:"schedule"`
+		Backoff struct {
+			After   int `yaml:"after"`   // Probe targets less often once this many probes in a row are lost, 0 to disable
+			Recheck int `yaml:"recheck"` // Probe backed off targets once every this many times they're picked
+		} `yaml:"backoff"`
+		Workers  int           `yaml:"workers"`
+		DedupTTL time.Duration `yaml:"dedup_ttl"`
+		Drain    time.Duration `yaml:"drain"`
+
+		// ResolveTTL is how long resolved hostname targets are cached before they're re-resolved in the
+		// background, they're only resolved once if zero
+		ResolveTTL time.Duration `yaml:"resolve_ttl"`
+
+		// RateCompat is the deprecated name for Rate
+		RateCompat float64 `yaml:"rate"`
+
+		// Unprivileged uses ICMP datagram sockets instead of raw sockets, which are also used if raw sockets aren't permitted
+		Unprivileged bool `yaml:"unprivileged"`
+
+		// Secret signs echo payloads so replies that weren't sent in response to our nodes' probes are rejected.
+		// It must be the same on every node.
+		Secret string `yaml:"secret"`
+
+		// UDPPayload is the hex encoded payload of UDP probes, such as a DNS query
+		UDPPayload string `yaml:"udp_payload"`
+
+		PayloadSize int `yaml:"payload_size"`
+		DSCP        int `yaml:"dscp"`
+		TOS         int `yaml:"tos"` // Full TOS / traffic class byte, instead of DSCP
+		TTL         int `yaml:"ttl"` // TTL / hop limit of probes
+	} `yaml:"probe"`
+	Security struct {
+		User  string `yaml:"user"`  // Switch to this user once the sockets are open
+		Group string `yaml:"group"` // Switch to this group, the user's primary group if unset
+	} `yaml:"security"`
+	Results struct {
+		Path   string `yaml:"path"`   // Directory to write per-sweep results files to
+		Format string `yaml:"format"` // jsonl or csv
+		Pcap   string `yaml:"pcap"`   // Directory to write per-sweep pcaps of all received ICMP to
+	} `yaml:"results"`
+	ClickHouse struct {
+		DSN           string        `yaml:"dsn"`
+		Table         string        `yaml:"table"`
+		BatchSize     int           `yaml:"batch_size"`
+		FlushInterval time.Duration `yaml:"flush_interval"`
+	} `yaml:"clickhouse"`
+	Publish struct {
+		Kafka struct {
+			Brokers []string `yaml:"brokers"`
+			Topic   string   `yaml:"topic"`
+		} `yaml:"kafka"`
+		NATS struct {
+			URL     string `yaml:"url"`
+			Subject string `yaml:"subject"`
+		} `yaml:"nats"`
+	} `yaml:"publish"`
+	GeoIP struct {
+		CountryDB string `yaml:"country_db"` // GeoLite2 Country (or City) database
+		ASNDB     string `yaml:"asn_db"`     // GeoLite2 ASN database
+	} `yaml:"geoip"`
+	Traceroute struct {
+		Interval time.Duration `yaml:"interval"` // Trace the paths to a sample of targets this often, 0 to disable
+		Sample   int           `yaml:"sample"`   // Targets traced each time
+		MaxHops  int           `yaml:"max_hops"`
+		Protocol string        `yaml:"protocol"` // icmp or udp
+		Rate     float64       `yaml:"rate_pps"` // Traceroute probes per second, on top of probe.rate_pps
+		Timeout  time.Duration `yaml:"timeout"`  // Wait this long for the last hops to answer, probe.timeout if unset
+	} `yaml:"traceroute"`
+	Catchment struct {
+		Prefix    int           `yaml:"prefix"`    // Track IPv4 targets by prefix of this length instead of individually
+		Threshold float64       `yaml:"threshold"` // Alert when more than this fraction of targets shift in a sweep
+		Webhook   string        `yaml:"webhook"`   // URL to POST alerts to
+		Window    time.Duration `yaml:"window"`    // Period to compare over outside of sweep mode
+	} `yaml:"catchment"`
+	UI struct {
+		Enabled bool          `yaml:"enabled"` // Serve the web dashboard at /ui/ on listen
+		Window  time.Duration `yaml:"window"`  // Recent replies summarized by the dashboard
+	} `yaml:"ui"`
+	OTLP struct {
+		Endpoint string            `yaml:"endpoint"` // OTLP/HTTP collector to push metrics to, such as http://otel-collector:4318
+		Interval time.Duration     `yaml:"interval"` // Push metrics this often
+		Headers  map[string]string `yaml:"headers"`  // Extra request headers, such as for authentication
+		Traces   bool              `yaml:"traces"`   // Also export a span per sweep
+	} `yaml:"otlp"`
+	Push struct {
+		RemoteWrite string        `yaml:"remote_write"` // Prometheus remote_write URL, such as https://prometheus.example.com/api/v1/write
+		Pushgateway string        `yaml:"pushgateway"`  // Pushgateway URL, such as http://pushgateway:9091
+		Job         string        `yaml:"job"`          // Job label of the pushed metrics
+		Interval    time.Duration `yaml:"interval"`     // Push metrics this often
+		BearerToken string        `yaml:"bearer_token"` // Sent in the Authorization header
+		TLS         struct {
+			CA                 string `yaml:"ca"`                   // CA certificate to verify the server with, instead of the system roots
+			Cert               string `yaml:"cert"`                 // Client certificate
+			Key                string `yaml:"key"`                  // Client certificate key
+			InsecureSkipVerify bool   `yaml:"insecure_skip_verify"` // Don't verify the server certificate
+		} `yaml:"tls"`
+	} `yaml:"push"`
+	Anycast struct {
+		Prefixes []string `yaml:"prefixes"` // Tag replies sent to addresses in these prefixes with the site that received them
+		Site     string   `yaml:"site"`     // Site name, this node's name if unset
+	} `yaml:"anycast"`
+	BGP struct {
+		BIRD          string        `yaml:"bird"`            // BIRD control socket to read announcements from, such as /run/bird/bird.ctl
+		GoBGP         string        `yaml:"gobgp"`           // GoBGP API address to read announcements from, such as 127.0.0.1:50051
+		Prefixes      []string      `yaml:"prefixes"`        // Only track these prefixes instead of every announced prefix
+		Interval      time.Duration `yaml:"interval"`        // Poll the announcements this often
+		SweepOnChange bool          `yaml:"sweep_on_change"` // Start a sweep when the announcements change
+	} `yaml:"bgp"`
+	Controller struct {
+		Listen  string `yaml:"listen"`  // gRPC listen address when running as the controller
+		Address string `yaml:"address"` // Controller address that agents stream replies to
+		Token   string `yaml:"token"`   // Bearer token agents send and the controller requires
+	} `yaml:"controller"`
+	Metrics struct {
+		RTTBuckets []float64 `yaml:"rtt_buckets"`
+	} `yaml:"metrics"`
+	Discovery struct {
+		DNS    string `yaml:"dns"` // Name with a TXT record per node, such as "10 ams1"
+		Consul struct {
+			Address string `yaml:"address"` // Consul HTTP API, such as http://127.0.0.1:8500
+			Prefix  string `yaml:"prefix"`  // KV prefix with a key per node ID holding its name
+			Token   string `yaml:"token"`   // ACL token
+		} `yaml:"consul"`
+		URL     string        `yaml:"url"`     // URL of a YAML or JSON map of node IDs to names
+		Refresh time.Duration `yaml:"refresh"` // Look up the nodes again this often
+	} `yaml:"discovery"`
+	Nodes map[uint16]string `yaml:"nodes"` // Node IDs to names, overridden by any discovered nodes
+
+	// Profiles are named overlays of the targets and probe options of the rest of the config, probed
+	// concurrently
+	Profiles map[string]yaml.Node `yaml:"profiles"`
+}
+
+// loadConfig reads and parses a YAML config file, with the -profile profile applied if set
+func loadConfig(filename string) (*Config, error) {
+	return loadProfile(filename, *profileName)
+}
+
+// loadProfile reads and parses a YAML config file with a profile applied on top of it, or none if it's empty
+func loadProfile(filename, profile string) (*Config, error) {
+	configBytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %s", err)
+	}
+	// Unknown keys are rejected so typos don't silently fall back to defaults
+	var config Config
+	dec := yaml.NewDecoder(bytes.NewReader(configBytes))
+	dec.KnownFields(true)
+	if err = dec.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("unable to parse config file: %s", yamlError(err))
+	}
+	if profile != "" {
+		if err := applyProfile(&config, profile); err != nil {
+			return nil, err
+		}
+	}
+	if config.Probe.Timeout <= 0 {
+		config.Probe.Timeout = defaultProbeTimeout
+	}
+	if config.API.Control && config.API.Token == "" {
+		return nil, errors.New("api.control requires api.token")
+	}
+	if (config.Controller.Listen != "" || config.Controller.Address != "") && config.Controller.Token == "" {
+		return nil, errors.New("controller.listen and controller.address require controller.token")
+	}
+	if config.Targets.URL != "" && !isURL(config.Targets.URL) {
+		return nil, fmt.Errorf("targets.url %q must be an http:// or https:// URL", config.Targets.URL)
+	}
+	if config.Targets.Refresh < 0 {
+		return nil, errors.New("targets.refresh can't be negative")
+	} else if config.Targets.Refresh == 0 {
+		config.Targets.Refresh = 5 * time.Minute
+	}
+	if config.OTLP.Endpoint != "" && !isURL(config.OTLP.Endpoint) {
+		return nil, fmt.Errorf("otlp.endpoint %q must be an http:// or https:// URL", config.OTLP.Endpoint)
+	}
+	if config.OTLP.Interval < 0 {
+		return nil, errors.New("otlp.interval can't be negative")
+	} else if config.OTLP.Interval == 0 {
+		config.OTLP.Interval = 30 * time.Second
+	}
+	if config.Push.RemoteWrite != "" && config.Push.Pushgateway != "" {
+		return nil, errors.New("only one of push.remote_write and push.pushgateway can be set")
+	}
+	if config.Push.RemoteWrite != "" && !isURL(config.Push.RemoteWrite) {
+		return nil, fmt.Errorf("push.remote_write %q must be an http:// or https:// URL", config.Push.RemoteWrite)
+	}
+	if config.Push.Pushgateway != "" && !isURL(config.Push.Pushgateway) {
+		return nil, fmt.Errorf("push.pushgateway %q must be an http:// or https:// URL", config.Push.Pushgateway)
+	}
+	if err := checkHTTP(&config); err != nil {
+		return nil, err
+	}
+	if (config.Push.TLS.Cert == "") != (config.Push.TLS.Key == "") {
+		return nil, errors.New("push.tls.cert and push.tls.key must be set together")
+	}
+	if config.Push.Interval < 0 {
+		return nil, errors.New("push.interval can't be negative")
+	} else if config.Push.Interval == 0 {
+		config.Push.Interval = 30 * time.Second
+	}
+	if config.Push.Job == "" {
+		config.Push.Job = "verfploeter"
+	}
+	if config.BGP.BIRD != "" && config.BGP.GoBGP != "" {
+		return nil, errors.New("only one of bgp.bird and bgp.gobgp can be set")
+	}
+	if err := checkAnycast(&config); err != nil {
+		return nil, err
+	}
+	for _, prefix := range config.BGP.Prefixes {
+		if _, _, err := net.ParseCIDR(prefix); err != nil {
+			return nil, fmt.Errorf("invalid prefix in bgp.prefixes: %s", err)
+		}
+	}
+	if config.BGP.Interval < 0 {
+		return nil, errors.New("bgp.interval can't be negative")
+	} else if config.BGP.Interval == 0 {
+		config.BGP.Interval = 10 * time.Second
+	}
+	if config.Discovery.Consul.Address != "" && !isURL(config.Discovery.Consul.Address) {
+		return nil, fmt.Errorf("discovery.consul.address %q must be an http:// or https:// URL", config.Discovery.Consul.Address)
+	}
+	if config.Discovery.Consul.Address != "" && strings.Trim(config.Discovery.Consul.Prefix, "/") == "" {
+		return nil, errors.New("discovery.consul.address requires discovery.consul.prefix")
+	}
+	if config.Discovery.URL != "" && !isURL(config.Discovery.URL) {
+		return nil, fmt.Errorf("discovery.url %q must be an http:// or https:// URL", config.Discovery.URL)
+	}
+	if config.Discovery.Refresh < 0 {
+		return nil, errors.New("discovery.refresh can't be negative")
+	} else if config.Discovery.Refresh == 0 {
+		config.Discovery.Refresh = 5 * time.Minute
+	}
+	if config.Probe.Retries < 0 {
+		return nil, fmt.Errorf("probe.retries %d can't be negative", config.Probe.Retries)
+	}
+	if config.Probe.Backoff.After < 0 {
+		return nil, fmt.Errorf("probe.backoff.after %d can't be negative", config.Probe.Backoff.After)
+	}
+	if config.Probe.Backoff.Recheck < 0 {
+		return nil, fmt.Errorf("probe.backoff.recheck %d can't be negative", config.Probe.Backoff.Recheck)
+	} else if config.Probe.Backoff.Recheck == 0 {
+		config.Probe.Backoff.Recheck = 10
+	}
+	if config.Probe.Interval < 0 {
+		return nil, fmt.Errorf("probe.interval %s can't be negative", config.Probe.Interval)
+	}
+	if config.Probe.Rate < 0 {
+		return nil, fmt.Errorf("probe.rate_pps %g can't be negative", config.Probe.Rate)
+	}
+	if err := checkSource("probe.source4", config.Probe.Source4, 4); err != nil {
+		return nil, err
+	}
+	if err := checkSource("probe.source6", config.Probe.Source6, 6); err != nil {
+		return nil, err
+	}
+	if config.Probe.PayloadSize < 0 || config.Probe.PayloadSize > maxPayloadSize {
+		return nil, fmt.Errorf("probe.payload_size %d out of range 0-%d", config.Probe.PayloadSize, maxPayloadSize)
+	}
+	if len(config.Probe.PMTU) > 0 {
+		if err := checkPMTUSizes(config.Probe.PMTU); err != nil {
+			return nil, err
+		}
+		if config.Probe.Mode != modeSweep || (config.Probe.Protocol != "" && config.Probe.Protocol != protocolICMP) {
+			return nil, errors.New("probe.pmtu needs ICMP probes in sweep mode")
+		}
+	}
+	if err := checkSchedule(&config); err != nil {
+		return nil, err
+	}
+	if err := checkRTTBuckets(config.Metrics.RTTBuckets); err != nil {
+		return nil, err
+	}
+	if config.Security.Group != "" && config.Security.User == "" {
+		return nil, errors.New("security.group needs security.user")
+	}
+	if config.Probe.DSCP < 0 || config.Probe.DSCP > 63 {
+		return nil, fmt.Errorf("probe.dscp %d out of range 0-63", config.Probe.DSCP)
+	}
+	if config.Probe.TOS < 0 || config.Probe.TOS > 255 {
+		return nil, fmt.Errorf("probe.tos %d out of range 0-255", config.Probe.TOS)
+	}
+	if config.Probe.DSCP != 0 && config.Probe.TOS != 0 {
+		return nil, errors.New("only one of probe.dscp and probe.tos can be set")
+	}
+	if config.Probe.TTL < 0 || config.Probe.TTL > 255 {
+		return nil, fmt.Errorf("probe.ttl %d out of range 0-255", config.Probe.TTL)
+	}
+	switch config.Log.Format {
+	case "", "text", "json":
+	default:
+		return nil, fmt.Errorf("unknown log.format %q (expected text or json)", config.Log.Format)
+	}
+	if config.Probe.Workers <= 0 {
+		config.Probe.Workers = 1
+	}
+	if config.Probe.Rate <= 0 && config.Probe.RateCompat > 0 {
+		log.Warn("probe.rate is deprecated, use probe.rate_pps instead")
+		config.Probe.Rate = config.Probe.RateCompat
+	}
+	if config.Probe.Interface != "" && config.Probe.VRF != "" {
+		return nil, errors.New("only one of probe.interface and probe.vrf can be set")
+	}
+	if config.Probe.Burst < 0 {
+		return nil, fmt.Errorf("probe.burst %d must not be negative", config.Probe.Burst)
+	}
+	if config.Probe.DedupTTL <= 0 {
+		config.Probe.DedupTTL = 2 * config.Probe.Timeout
+	}
+	if config.Probe.Drain <= 0 {
+		config.Probe.Drain = config.Probe.Timeout
+	}
+	if config.Log.Replies.MaxSize <= 0 {
+		config.Log.Replies.MaxSize = 100
+	}
+	if config.ClickHouse.Table == "" {
+		config.ClickHouse.Table = "replies"
+	}
+	if config.ClickHouse.BatchSize <= 0 {
+		config.ClickHouse.BatchSize = 1000
+	}
+	if config.ClickHouse.FlushInterval <= 0 {
+		config.ClickHouse.FlushInterval = 5 * time.Second
+	}
+	if config.Publish.Kafka.Topic == "" {
+		config.Publish.Kafka.Topic = "verfploeter.replies"
+	}
+	if config.Publish.NATS.Subject == "" {
+		config.Publish.NATS.Subject = "verfploeter.replies"
+	}
+	switch config.Role {
+	case "":
+		config.Role = roleBoth
+	case roleBoth, rolePinger, roleCollector, roleController:
+	default:
+		return nil, fmt.Errorf("unknown role %q (expected %s, %s, %s, or %s)",
+			config.Role, roleBoth, rolePinger, roleCollector, roleController)
+	}
+	if config.Probe.Spoof4 != "" && net.ParseIP(config.Probe.Spoof4).To4() == nil {
+		return nil, fmt.Errorf("probe.spoof4 %q is not an IPv4 address", config.Probe.Spoof4)
+	}
+	for _, source := range config.Probe.Sources {
+		if net.ParseIP(source) == nil {
+			return nil, fmt.Errorf("probe.sources %q is not an IP address", source)
+		}
+	}
+	if len(config.Probe.Sources) > 0 && config.Probe.Spoof4 != "" {
+		return nil, errors.New("probe.sources can't be combined with probe.spoof4")
+	}
+	if len(config.Probe.Sources) > 0 && config.Probe.Protocol != "" && config.Probe.Protocol != protocolICMP {
+		return nil, fmt.Errorf("probe.sources is only supported with the %s protocol", protocolICMP)
+	}
+	switch config.Probe.SourceMode {
+	case "":
+		config.Probe.SourceMode = sourceModeRoundRobin
+	case sourceModeRoundRobin, sourceModeAll:
+	default:
+		return nil, fmt.Errorf("unknown probe.source_mode %q (expected %s or %s)",
+			config.Probe.SourceMode, sourceModeRoundRobin, sourceModeAll)
+	}
+	switch config.Probe.Mode {
+	case "":
+		config.Probe.Mode = modeRandom
+	case modeRandom, modeSweep:
+	default:
+		return nil, fmt.Errorf("unknown probe.mode %q (expected %s or %s)", config.Probe.Mode, modeRandom, modeSweep)
+	}
+	switch config.Probe.Strategy.Type {
+	case "":
+		config.Probe.Strategy.Type = strategyRandom
+	case strategyRandom, strategyShuffle:
+	case strategyWeighted:
+		if config.Probe.Strategy.Weights == "" {
+			return nil, fmt.Errorf("probe.strategy %s requires probe.strategy.weights", strategyWeighted)
+		}
+	case strategyStratified:
+		switch config.Probe.Strategy.By {
+		case stratifyASN:
+			if config.GeoIP.ASNDB == "" {
+				return nil, errors.New("stratifying targets by asn requires geoip.asn_db")
+			}
+		case stratifyCountry:
+			if config.GeoIP.CountryDB == "" {
+				return nil, errors.New("stratifying targets by country requires geoip.country_db")
+			}
+		default:
+			return nil, fmt.Errorf("unknown probe.strategy.by %q (expected %s or %s)", config.Probe.Strategy.By, stratifyASN, stratifyCountry)
+		}
+	default:
+		return nil, fmt.Errorf("unknown probe.strategy %q (expected %s, %s, %s, or %s)",
+			config.Probe.Strategy.Type, strategyRandom, strategyShuffle, strategyWeighted, strategyStratified)
+	}
+	if config.Probe.Mode == modeSweep && config.Probe.Strategy.Type != strategyRandom {
+		return nil, fmt.Errorf("probe.strategy only applies to %s mode", modeRandom)
+	}
+	if config.Probe.Strategy.DefaultWeight < 0 {
+		return nil, errors.New("probe.strategy.default_weight can't be negative")
+	} else if config.Probe.Strategy.DefaultWeight == 0 {
+		config.Probe.Strategy.DefaultWeight = 1
+	}
+	if config.Catchment.Prefix < 0 || config.Catchment.Prefix > 32 {
+		return nil, fmt.Errorf("catchment.prefix %d is out of range", config.Catchment.Prefix)
+	}
+	if config.Catchment.Threshold < 0 || config.Catchment.Threshold > 1 {
+		return nil, fmt.Errorf("catchment.threshold %g must be between 0 and 1", config.Catchment.Threshold)
+	}
+	if config.Catchment.Window <= 0 {
+		config.Catchment.Window = 5 * time.Minute
+	}
+	if config.UI.Window <= 0 {
+		config.UI.Window = 5 * time.Minute
+	}
+	if len(config.Probe.Fallback.Protocols) > 0 && config.Probe.Protocol != "" {
+		return nil, errors.New("probe.fallback.protocols replaces probe.protocol")
+	}
+	switch config.Probe.Protocol {
+	case "":
+		config.Probe.Protocol = protocolICMP
+	case protocolICMP, protocolTCP, protocolUDP, protocolChaos:
+	default:
+		return nil, fmt.Errorf("unknown probe.protocol %q (expected %s, %s, %s, or %s)",
+			config.Probe.Protocol, protocolICMP, protocolTCP, protocolUDP, protocolChaos)
+	}
+	protocols := []string{config.Probe.Protocol}
+	if len(config.Probe.Fallback.Protocols) > 0 || len(config.Probe.Fallback.Targets) > 0 {
+		if err := checkFallback(&config); err != nil {
+			return nil, err
+		}
+		protocols = fallbackProtocols(&config)
+	}
+	for _, p := range protocols {
+		if p != protocolICMP && !sockets.rawTransport() {
+			return nil, fmt.Errorf("%s probes are not supported on %s, which doesn't deliver replies to raw sockets", p, runtime.GOOS)
+		}
+		if p != protocolICMP && config.ID > verfploeter.MaxPortNode {
+			return nil, fmt.Errorf("id %d is too large for %s probes, which carry it in the source port (max %d)", config.ID, p, verfploeter.MaxPortNode)
+		}
+	}
+	if err := checkTraceroute(&config); err != nil {
+		return nil, err
+	}
+	if config.Probe.ChaosName == "" {
+		config.Probe.ChaosName = "hostname.bind"
+	}
+	if config.Probe.TCPPort == 0 {
+		config.Probe.TCPPort = 80
+	} else if config.Probe.TCPPort < 0 || config.Probe.TCPPort > 65535 {
+		return nil, fmt.Errorf("probe.tcp_port %d is out of range", config.Probe.TCPPort)
+	}
+	if config.Probe.UDPPort == 0 {
+		config.Probe.UDPPort = 53
+	} else if config.Probe.UDPPort < 0 || config.Probe.UDPPort > 65535 {
+		return nil, fmt.Errorf("probe.udp_port %d is out of range", config.Probe.UDPPort)
+	}
+	if _, err := hex.DecodeString(config.Probe.UDPPayload); err != nil {
+		return nil, fmt.Errorf("probe.udp_payload is not valid hex: %s", err)
+	}
+	if profile == "" && len(config.Profiles) > 0 {
+		if err := checkProfiles(filename, &config); err != nil {
+			return nil, err
+		}
+	}
+	return &config, nil
+}
+
+// yamlError shortens errors about unknown keys, which would otherwise spell out the config's anonymous structs
+func yamlError(err error) error {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return err
+	}
+	msgs := make([]string, len(typeErr.Errors))
+	for i, msg := range typeErr.Errors {
+		if j := strings.Index(msg, " not found in type "); j >= 0 {
+			msg = msg[:j] + " is not a known option"
+		}
+		msgs[i] = msg
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// checkSource validates a source address of an IP version, which may be unset
+func checkSource(name, source string, ipVersion int) error {
+	if source == "" {
+		return nil
+	}
+	if _, _, err := net.ParseCIDR(source); err == nil {
+		return fmt.Errorf("%s %q must be an address, not a prefix", name, source)
+	}
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return fmt.Errorf("%s %q is not an IP address", name, source)
+	}
+	if (ipVersion == 4) != (ip.To4() != nil) {
+		return fmt.Errorf("%s %q is not an IPv%d address", name, source, ipVersion)
+	}
+	return nil
+}
+
+// checkRole validates the parts of the config that only matter in some roles, once the role is final
+func checkRole(config *Config) error {
+	if config.Role == roleController {
+		return nil
+	}
+	if config.Probe.Source4 == "" && config.Probe.Source6 == "" && len(config.Probe.Sources) == 0 {
+		return errors.New("no probe sources, set probe.source4, probe.source6, or probe.sources")
+	}
+	if config.Role != roleCollector && config.Probe.Rate <= 0 && config.Probe.Interval <= 0 {
+		return errors.New("either probe.rate_pps or probe.interval must be set")
+	}
+	return nil
+}
+
+// loadExcludeFiles loads the exclusions given with -x, before any targets so excluded addresses are never
+// added
+func loadExcludeFiles() error {
+	if *excludeFile == "" {
+		return nil
+	}
+	var err error
+	exclusions, err = loadExclusions(strings.Split(*excludeFile, ","))
+	return err
+}
+
+// loadInitialTargets loads the targets from the configured files or URL unless targets files are given,
+// returning the targets files to reload from. A profile's own targets files or URL are loaded even if targets
+// files are given, which only replace the targets it shares with base.
+func loadInitialTargets(config, base *Config) ([]string, []string, error) {
+	targetsFiles := strings.Split(*targetsFile, ",")
+	own := configTargets(config)
+	if len(own) > 0 && (!flagSet("t") || !reflect.DeepEqual(own, configTargets(base))) {
+		targetsFiles = own
+	}
+	initialTargets, err := loadTargets(targetsFiles)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(initialTargets) == 0 {
+		return nil, nil, fmt.Errorf("no targets in %s", strings.Join(targetsFiles, ", "))
+	}
+	return targetsFiles, initialTargets, nil
+}
+
+// configTargets returns the targets files and URL set in the config
+func configTargets(config *Config) []string {
+	files := append([]string{}, config.Targets.Files...)
+	if config.Targets.URL != "" {
+		files = append(files, config.Targets.URL)
+	}
+	return files
+}
+
+// runCheckConfig loads the targets and other files named in the config without opening any sockets
+func runCheckConfig(config *Config) error {
+	if config.Role != roleController {
+		if err := loadExcludeFiles(); err != nil {
+			return err
+		}
+		list, err := loadProfiles(config)
+		if err != nil {
+			return err
+		}
+		for _, p := range list {
+			if err := p.loadTargets(config); err != nil {
+				return err
+			}
+		}
+	}
+	if config.Probe.Strategy.Type == strategyWeighted {
+		if _, err := loadWeights(config.Probe.Strategy.Weights); err != nil {
+			return err
+		}
+	}
+	if config.Security.User != "" {
+		if _, _, err := lookupCredentials(config.Security.User, config.Security.Group); err != nil {
+			return fmt.Errorf("security.user: %s", err)
+		}
+	}
+	if _, err := httpTLSConfig(config); err != nil {
+		return err
+	}
+	if config.GeoIP.CountryDB != "" || config.GeoIP.ASNDB != "" {
+		g, err := openGeo(config.GeoIP.CountryDB, config.GeoIP.ASNDB)
+		if err != nil {
+			return fmt.Errorf("unable to open GeoIP database: %s", err)
+		}
+		g.close()
+	}
+	fmt.Printf("%s is valid (role %s)\n", *configFile, config.Role)
+	return nil
+}
+
+// reloadConfig applies the live-reloadable fields of newConfig to config and logs the ones that require a
+// restart. The probe rate is reloaded by each profile.
+func reloadConfig(config, newConfig *Config) {
+	if !reflect.DeepEqual(newConfig.Nodes, config.Nodes) {
+		log.Infof("Node map changed (%d nodes)", len(newConfig.Nodes))
+		config.Nodes = newConfig.Nodes
+		if discovery != nil {
+			discovery.setStatic(newConfig.Nodes)
+		} else {
+			setNodes(newConfig.Nodes)
+			filterEchoReplies(config.ID, newConfig.Nodes)
+		}
+	}
+
+	for field, changed := range map[string]bool{
+		"id":                  newConfig.ID != config.ID,
+		"role":                newConfig.Role != config.Role,
+		"probe.spoof4":        newConfig.Probe.Spoof4 != config.Probe.Spoof4,
+		"results.path":        newConfig.Results.Path != config.Results.Path,
+		"security":            newConfig.Security != config.Security,
+		"results.format":      newConfig.Results.Format != config.Results.Format,
+		"results.pcap":        newConfig.Results.Pcap != config.Results.Pcap,
+		"targets":             !reflect.DeepEqual(newConfig.Targets, config.Targets),
+		"clickhouse":          !reflect.DeepEqual(newConfig.ClickHouse, config.ClickHouse),
+		"publish":             !reflect.DeepEqual(newConfig.Publish, config.Publish),
+		"geoip":               !reflect.DeepEqual(newConfig.GeoIP, config.GeoIP),
+		"catchment":           !reflect.DeepEqual(newConfig.Catchment, config.Catchment),
+		"controller.listen":   newConfig.Controller.Listen != config.Controller.Listen,
+		"controller.address":  newConfig.Controller.Address != config.Controller.Address,
+		"controller.token":    newConfig.Controller.Token != config.Controller.Token,
+		"listen":              newConfig.Listen != config.Listen,
+		"http":                newConfig.HTTP != config.HTTP,
+		"api":                 newConfig.API != config.API,
+		"ui":                  newConfig.UI != config.UI,
+		"otlp":                !reflect.DeepEqual(newConfig.OTLP, config.OTLP),
+		"push":                newConfig.Push != config.Push,
+		"bgp":                 !reflect.DeepEqual(newConfig.BGP, config.BGP),
+		"anycast":             !reflect.DeepEqual(newConfig.Anycast, config.Anycast),
+		"discovery":           newConfig.Discovery != config.Discovery,
+		"log.format":          newConfig.Log.Format != config.Log.Format,
+		"log.replies":         newConfig.Log.Replies != config.Log.Replies,
+		"probe.source4":       newConfig.Probe.Source4 != config.Probe.Source4,
+		"probe.source6":       newConfig.Probe.Source6 != config.Probe.Source6,
+		"probe.sources":       !reflect.DeepEqual(newConfig.Probe.Sources, config.Probe.Sources),
+		"probe.source_mode":   newConfig.Probe.SourceMode != config.Probe.SourceMode,
+		"probe.secret":        newConfig.Probe.Secret != config.Probe.Secret,
+		"probe.payload_size":  newConfig.Probe.PayloadSize != config.Probe.PayloadSize,
+		"probe.dscp":          newConfig.Probe.DSCP != config.Probe.DSCP,
+		"probe.tos":           newConfig.Probe.TOS != config.Probe.TOS,
+		"probe.ttl":           newConfig.Probe.TTL != config.Probe.TTL,
+		"probe.interface":     newConfig.Probe.Interface != config.Probe.Interface,
+		"probe.vrf":           newConfig.Probe.VRF != config.Probe.VRF,
+		"probe.unprivileged":  newConfig.Probe.Unprivileged != config.Probe.Unprivileged,
+		"probe.timeout":       newConfig.Probe.Timeout != config.Probe.Timeout,
+		"probe.retries":       newConfig.Probe.Retries != config.Probe.Retries,
+		"probe.any_source":    newConfig.Probe.AnySource != config.Probe.AnySource,
+		"probe.backoff":       newConfig.Probe.Backoff != config.Probe.Backoff,
+		"probe.pmtu":          !reflect.DeepEqual(newConfig.Probe.PMTU, config.Probe.PMTU),
+		"probe.fallback":      !reflect.DeepEqual(newConfig.Probe.Fallback, config.Probe.Fallback),
+		"probe.schedule":      !reflect.DeepEqual(newConfig.Probe.Schedule, config.Probe.Schedule),
+		"traceroute":          newConfig.Traceroute != config.Traceroute,
+		"probe.dedup_ttl":     newConfig.Probe.DedupTTL != config.Probe.DedupTTL,
+		"probe.drain":         newConfig.Probe.Drain != config.Probe.Drain,
+		"probe.workers":       newConfig.Probe.Workers != config.Probe.Workers,
+		"probe.resolve_ttl":   newConfig.Probe.ResolveTTL != config.Probe.ResolveTTL,
+		"probe.mode":          newConfig.Probe.Mode != config.Probe.Mode,
+		"probe.strategy":      newConfig.Probe.Strategy != config.Probe.Strategy,
+		"probe.protocol":      newConfig.Probe.Protocol != config.Probe.Protocol,
+		"probe.tcp_port":      newConfig.Probe.TCPPort != config.Probe.TCPPort,
+		"probe.udp_port":      newConfig.Probe.UDPPort != config.Probe.UDPPort,
+		"probe.udp_payload":   newConfig.Probe.UDPPayload != config.Probe.UDPPayload,
+		"probe.chaos_name":    newConfig.Probe.ChaosName != config.Probe.ChaosName,
+		"metrics.rtt_buckets": !reflect.DeepEqual(newConfig.Metrics.RTTBuckets, config.Metrics.RTTBuckets),
+		"profiles":            !reflect.DeepEqual(profileNames(newConfig), profileNames(config)),
+	} {
+		if changed {
+			log.Warnf("Ignoring change to %s on reload (requires restart)", field)
+		}
+	}
+}
+
+// probeRate returns the probe rate in packets per second, falling back to one probe per interval
+func probeRate(config *Config) rate.Limit {
+	if config.Probe.Rate > 0 {
+		return rate.Limit(config.Probe.Rate)
+	}
+	return rate.Every(config.Probe.Interval)
+}
+
+// probeBurst returns how many probes may be sent back to back to catch up, defaulting to 10ms worth so
+// high rates aren't limited by timer resolution
+func probeBurst(config *Config) int {
+	if config.Probe.Burst > 0 {
+		return config.Probe.Burst
+	}
+	if burst := int(probeRate(config) / 100); burst > 1 {
+		return burst
+	}
+	return 1
+}
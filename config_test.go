@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigRTTBuckets(t *testing.T) {
+	for _, tc := range []struct {
+		buckets string
+		err     string
+	}{
+		{"[]", ""},
+		{"[0.001, 0.01, 0.1, 1]", ""},
+		{"[0.01, 0.001]", "metrics.rtt_buckets must be strictly increasing, but 0.001 follows 0.01"},
+		{"[0.001, 0.01, 0.01]", "metrics.rtt_buckets must be strictly increasing, but 0.01 follows 0.01"},
+	} {
+		filename := filepath.Join(t.TempDir(), "config.yml")
+		if err := os.WriteFile(filename, []byte("id: 10\nmetrics:\n  rtt_buckets: "+tc.buckets+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadConfig(filename)
+		if tc.err == "" && err != nil {
+			t.Errorf("%s: unexpected error %s", tc.buckets, err)
+		} else if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s: got error %v, want %s", tc.buckets, err, tc.err)
+		}
+	}
+}
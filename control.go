@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// controlState is the probing state changed at runtime through the control API
+type controlState struct {
+	lock    sync.Mutex
+	resumed chan struct{} // Closed on resume, nil unless paused
+
+	// Serializes changes to the targets, which may resolve hostnames
+	targetsLock sync.Mutex
+
+	// Set once probing starts
+	config  *Config
+	limiter *rate.Limiter
+	sweeper *sweeper // Restarted for an on-demand sweep in sweep mode
+
+	// On-demand sweeps in random mode, which replace random targets until every target has been probed
+	sweepRequested bool
+	manual         *sweeper
+	remaining      int
+}
+
+var control = &controlState{}
+
+// start attaches the rate limiter and, in sweep mode, the sweeper once probing of list begins
+func (c *controlState) start(config *Config, list *targetList, limiter *rate.Limiter, s *sweeper) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.config = config
+	c.limiter = limiter
+	c.sweeper = s
+	c.manual = newSweeper(list)
+}
+
+// setRate changes the probe interval and rate
+func (c *controlState) setRate(interval time.Duration, pps float64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.config == nil {
+		return errors.New("not probing")
+	}
+	c.config.Probe.Interval = interval
+	c.config.Probe.Rate = pps
+	c.applyRate()
+	log.Infof("Probe rate changed to %.2f pps", float64(probeRate(c.config)))
+	return nil
+}
+
+// reloadRate applies the probe interval, rate and burst of a reloaded config, logging those that changed
+func (c *controlState) reloadRate(interval time.Duration, pps float64, burst int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.config == nil {
+		return
+	}
+	probe := &c.config.Probe
+	if interval != probe.Interval || pps != probe.Rate {
+		log.Infof("Probe rate changed from %s/%.2f pps to %s/%.2f pps", probe.Interval, probe.Rate, interval, pps)
+		probe.Interval, probe.Rate = interval, pps
+	}
+	if burst != probe.Burst {
+		log.Infof("Probe burst changed from %d to %d", probe.Burst, burst)
+		probe.Burst = burst
+	}
+	c.applyRate()
+}
+
+// applyRate updates the limiter the probe loop waits on to the configured rate and burst, with the lock held
+func (c *controlState) applyRate() {
+	c.limiter.SetLimit(probeRate(c.config))
+	c.limiter.SetBurst(probeBurst(c.config))
+}
+
+// paused checks if probing is paused
+func (c *controlState) paused() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.resumed != nil
+}
+
+// wait blocks while probing is paused, returning false if ctx is done first
+func (c *controlState) wait(ctx context.Context) bool {
+	c.lock.Lock()
+	resumed := c.resumed
+	c.lock.Unlock()
+	if resumed == nil {
+		return true
+	}
+	select {
+	case <-resumed:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// next returns the next target to probe, taking it from an on-demand sweep if one was requested
+func (c *controlState) next(next func() probeTarget) probeTarget {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.sweepRequested {
+		c.sweepRequested = false
+		if c.sweeper != nil {
+			c.sweeper.restart()
+		} else {
+			c.manual.restart()
+			p := c.manual.next()
+			c.remaining = len(c.manual.targets) - 1
+			return p
+		}
+	}
+	if c.remaining > 0 {
+		c.remaining--
+		return c.manual.next()
+	}
+	return next()
+}
+
+// requestSweep probes every target next, as a new sweep in sweep mode
+func (c *controlState) requestSweep() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.config == nil {
+		return errors.New("not probing")
+	}
+	c.sweepRequested = true
+	if schedule != nil {
+		schedule.wakeUp()
+	}
+	return nil
+}
+
+// sweepDone checks if the sweep in sweep mode has probed every target and no new one was requested
+func (c *controlState) sweepDone() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.sweeper != nil && c.sweeper.pos >= len(c.sweeper.targets) && !c.sweepRequested
+}
+
+// currentSweep returns the number of the sweep in progress, zero outside of sweep mode
+func (c *controlState) currentSweep() uint32 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.sweeper == nil {
+		return 0
+	}
+	return c.sweeper.sweep
+}
+
+// progress returns how far the sweep in progress has got, or nil if targets aren't being swept
+func (c *controlState) progress() *dashboardProgress {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch {
+	case c.remaining > 0:
+		return &dashboardProgress{Probed: len(c.manual.targets) - c.remaining, Targets: len(c.manual.targets)}
+	case c.sweeper != nil && c.sweeper.sweep > 0:
+		return &dashboardProgress{Sweep: c.sweeper.sweep, Probed: c.sweeper.pos, Targets: len(c.sweeper.targets)}
+	}
+	return nil
+}
+
+// controlStatus is the body of every control API response
+type controlStatus struct {
+	Paused   bool    `json:"paused"`
+	Mode     string  `json:"mode"`
+	Interval string  `json:"interval,omitempty"`
+	Rate     float64 `json:"rate_pps"`
+	Targets  int     `json:"targets"`
+	Sweeping bool    `json:"sweeping"`
+}
+
+func (c *controlState) writeStatus(w http.ResponseWriter) {
+	c.lock.Lock()
+	status := controlStatus{
+		Paused:   c.resumed != nil,
+		Targets:  len(targets.all()),
+		Sweeping: c.sweepRequested || c.remaining > 0,
+	}
+	if c.config != nil {
+		status.Mode = c.config.Probe.Mode
+		status.Rate = float64(probeRate(c.config))
+		if c.config.Probe.Rate <= 0 {
+			status.Interval = c.config.Probe.Interval.String()
+		}
+	}
+	c.lock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// requireToken rejects requests without the bearer token
+func requireToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// controlHandler serves the control API:
+//
+//	GET    /control                       Current state
+//	POST   /control/pause                 Stop sending probes, replies are still collected
+//	POST   /control/resume                Resume sending probes
+//	POST   /control/sweep                 Probe every target now, as a new sweep in sweep mode
+//	POST   /control/rate?interval=2s      Change the probe interval, or rate_pps for a rate
+//	POST   /control/targets?target=a&...  Add targets until the targets are next reloaded
+//	DELETE /control/targets?target=a&...  Remove targets until the targets are next reloaded
+func controlHandler(c *controlState) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/control", func(w http.ResponseWriter, r *http.Request) {
+		c.writeStatus(w)
+	})
+	mux.HandleFunc("/control/pause", post(func(w http.ResponseWriter, r *http.Request) {
+		c.lock.Lock()
+		if c.resumed == nil {
+			c.resumed = make(chan struct{})
+			log.Info("Probing paused")
+		}
+		c.lock.Unlock()
+		c.writeStatus(w)
+	}))
+	mux.HandleFunc("/control/resume", post(func(w http.ResponseWriter, r *http.Request) {
+		c.lock.Lock()
+		if c.resumed != nil {
+			close(c.resumed)
+			c.resumed = nil
+			log.Info("Probing resumed")
+		}
+		c.lock.Unlock()
+		c.writeStatus(w)
+	}))
+	mux.HandleFunc("/control/sweep", post(func(w http.ResponseWriter, r *http.Request) {
+		if err := c.requestSweep(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		log.Info("Starting on-demand sweep")
+		c.writeStatus(w)
+	}))
+	mux.HandleFunc("/control/rate", post(func(w http.ResponseWriter, r *http.Request) {
+		var interval time.Duration
+		var pps float64
+		var err error
+		if s := r.URL.Query().Get("interval"); s != "" {
+			interval, err = time.ParseDuration(s)
+		} else if s := r.URL.Query().Get("rate_pps"); s != "" {
+			pps, err = strconv.ParseFloat(s, 64)
+		} else {
+			http.Error(w, "missing interval or rate_pps", http.StatusBadRequest)
+			return
+		}
+		if err != nil || interval < 0 || pps < 0 || (interval == 0 && pps == 0) {
+			http.Error(w, "invalid interval or rate_pps", http.StatusBadRequest)
+			return
+		}
+
+		if err := c.setRate(interval, pps); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		c.writeStatus(w)
+	}))
+	mux.HandleFunc("/control/targets", func(w http.ResponseWriter, r *http.Request) {
+		changed := r.URL.Query()["target"]
+		if len(changed) == 0 {
+			http.Error(w, "missing target", http.StatusBadRequest)
+			return
+		}
+		c.targetsLock.Lock()
+		defer c.targetsLock.Unlock()
+		switch r.Method {
+		case http.MethodPost:
+			log.Infof("Added %d targets", addTargets(changed))
+		case http.MethodDelete:
+			removed, err := removeTargets(changed)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			log.Infof("Removed %d targets", removed)
+		default:
+			w.Header().Set("Allow", "POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		c.writeStatus(w)
+	})
+	return mux
+}
+
+// post only allows POST requests to a handler
+func post(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// addTargets adds targets that aren't already probed or excluded, returning how many were added
+func addTargets(add []string) int {
+	current := targets.all()
+	seen := make(map[string]bool, len(current))
+	for _, target := range current {
+		seen[target] = true
+	}
+	newTargets := append([]string{}, current...)
+	for _, target := range add {
+		if ip := net.ParseIP(target); seen[target] || (ip != nil && isExcluded(ip)) {
+			continue
+		}
+		seen[target] = true
+		newTargets = append(newTargets, target)
+	}
+	if added := len(newTargets) - len(current); added > 0 {
+		resolver.resolve(newTargets[len(current):])
+		targets.set(newTargets)
+		return added
+	}
+	return 0
+}
+
+// removeTargets removes targets and returns how many were removed, failing if none would be left
+func removeTargets(remove []string) (int, error) {
+	drop := make(map[string]bool, len(remove))
+	for _, target := range remove {
+		drop[target] = true
+	}
+	current := targets.all()
+	var newTargets []string
+	for _, target := range current {
+		if !drop[target] {
+			newTargets = append(newTargets, target)
+		}
+	}
+	if len(newTargets) == 0 {
+		return 0, errors.New("can't remove every target")
+	}
+	if len(newTargets) < len(current) {
+		targets.set(newTargets)
+	}
+	return len(current) - len(newTargets), nil
+}
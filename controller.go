@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The controller service is a single client stream of replyRecords from agents. Messages are JSON encoded
+// so the service can be described by hand without generated protobuf code.
+const streamRepliesMethod = "/verfploeter.Controller/StreamReplies"
+
+// jsonCodec is a gRPC codec that encodes messages as JSON
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return "json" }
+
+// streamSummary is sent back to an agent when it closes its stream
+type streamSummary struct {
+	Received uint64 `json:"received"`
+}
+
+var controllerServiceDesc = grpc.ServiceDesc{
+	ServiceName: "verfploeter.Controller",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "StreamReplies",
+		ClientStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			return srv.(*controller).streamReplies(stream)
+		},
+	}},
+}
+
+// controller aggregates replies from every agent into a global catchment view
+type controller struct {
+	catchment *prometheus.CounterVec
+	shifts    *catchmentTracker
+}
+
+// listenController listens on the controller's gRPC address
+func listenController(config *Config) (net.Listener, error) {
+	if config.Controller.Listen == "" {
+		return nil, errors.New("controller.listen must be set when running as the controller")
+	}
+	return net.Listen("tcp", config.Controller.Listen)
+}
+
+// newController creates a controller that aggregates the replies streamed from agents
+func newController(config *Config, reg prometheus.Registerer, constLabels prometheus.Labels) *controller {
+	factory := promauto.With(reg)
+	return &controller{
+		catchment: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name:        "verfploeter_catchment_replies",
+				ConstLabels: constLabels,
+			}, []string{"collector", "dst"},
+		),
+		shifts: newCatchmentTracker(config.Catchment.Prefix, config.Catchment.Threshold, config.Catchment.Webhook,
+			reg, constLabels),
+	}
+}
+
+// runController serves the controller gRPC service on l until it fails
+func runController(config *Config, c *controller, l net.Listener) error {
+	go c.shifts.run(config.Catchment.Window)
+
+	server := newControllerServer(c, config.Controller.Token)
+	log.Infof("Starting controller on %s", config.Controller.Listen)
+	sdNotify("READY=1")
+	return server.Serve(l)
+}
+
+// newControllerServer creates the controller's gRPC server, which rejects streams without the bearer token
+func newControllerServer(c *controller, token string) *grpc.Server {
+	server := grpc.NewServer(
+		grpc.ForceServerCodec(jsonCodec{}),
+		grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, _ *grpc.StreamServerInfo,
+			handler grpc.StreamHandler) error {
+			md, _ := metadata.FromIncomingContext(stream.Context())
+			var auth string
+			if values := md.Get("authorization"); len(values) > 0 {
+				auth = strings.TrimPrefix(values[0], "Bearer ")
+			}
+			if subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+				return status.Error(codes.Unauthenticated, "unauthorized")
+			}
+			return handler(srv, stream)
+		}),
+	)
+	server.RegisterService(&controllerServiceDesc, c)
+	return server
+}
+
+// streamReplies counts replies streamed from a single agent
+func (c *controller) streamReplies(stream grpc.ServerStream) error {
+	var received uint64
+	for {
+		var record replyRecord
+		if err := stream.RecvMsg(&record); errors.Is(err, io.EOF) {
+			return stream.SendMsg(&streamSummary{Received: received})
+		} else if err != nil {
+			return err
+		}
+		received++
+
+		nodes := currentNodes()
+		c.catchment.With(map[string]string{
+			"collector": findNode(record.Collector, nodes),
+			"dst":       findNode(record.Node, nodes),
+		}).Inc()
+		c.shifts.observe(record)
+		summary.write(record)
+		if dash != nil {
+			dash.write(record)
+		}
+		log.WithFields(log.Fields{
+			"collector": record.Collector,
+			"node":      record.Node,
+			"src":       record.Responder,
+			"target":    record.Target,
+		}).Debug("Reply from agent")
+	}
+}
+
+// agentClient streams replies to the controller, reconnecting as needed. Replies are dropped rather
+// than blocking the listeners when the controller can't keep up.
+type agentClient struct {
+	address string
+	token   string
+	queue   *recordQueue
+	done    chan struct{}
+}
+
+func newAgentClient(address, token string, reg prometheus.Registerer, constLabels prometheus.Labels) *agentClient {
+	factory := promauto.With(reg)
+	return &agentClient{
+		address: address,
+		token:   token,
+		queue: newRecordQueue(4096, factory.NewCounter(prometheus.CounterOpts{
+			Name:        "verfploeter_agent_dropped_total",
+			ConstLabels: constLabels,
+		})),
+		done: make(chan struct{}),
+	}
+}
+
+// write queues a reply to be streamed to the controller, which only counts catchment replies
+func (a *agentClient) write(record replyRecord) {
+	if record.Hop != 0 {
+		return
+	}
+	a.queue.write(record)
+}
+
+// close finishes streaming queued replies, giving up if the controller is unreachable
+func (a *agentClient) close() {
+	a.queue.close()
+	select {
+	case <-a.done:
+	case <-time.After(5 * time.Second):
+		log.Warnf("Timed out streaming replies to controller %s", a.address)
+	}
+}
+
+// run streams queued replies to the controller until the agent is closed
+func (a *agentClient) run() {
+	defer close(a.done)
+	conn, err := grpc.Dial(a.address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(jsonCodec{})),
+	)
+	if err != nil {
+		log.Fatalf("unable to connect to controller: %s", err)
+	}
+
+	defer conn.Close()
+
+	for {
+		err := a.stream(conn)
+		if err == nil {
+			return
+		}
+		log.Warnf("Controller stream to %s failed: %s", a.address, err)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// stream sends queued replies over a single stream until it fails
+func (a *agentClient) stream(conn *grpc.ClientConn) error {
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+a.token)
+	stream, err := conn.NewStream(ctx, &controllerServiceDesc.Streams[0], streamRepliesMethod)
+	if err != nil {
+		return err
+	}
+	log.Infof("Streaming replies to controller %s", a.address)
+	for record := range a.queue.records {
+		if err := stream.SendMsg(&record); err != nil {
+			return err
+		}
+	}
+
+	// Wait for the controller's summary so queued replies aren't lost when the connection closes
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	var summary streamSummary
+	return stream.RecvMsg(&summary)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestControllerToken(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newControllerServer(&controller{}, "secret")
+	go func() { _ = server.Serve(l) }()
+	defer server.Stop()
+
+	conn, err := grpc.Dial(l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(jsonCodec{})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, tc := range []struct {
+		token string
+		code  codes.Code
+	}{
+		{"secret", codes.OK},
+		{"wrong", codes.Unauthenticated},
+		{"", codes.Unauthenticated},
+	} {
+		// Stream an empty queue, so only the summary is exchanged
+		a := newAgentClient(l.Addr().String(), tc.token, prometheus.NewRegistry(), nil)
+		a.queue.close()
+		if code := status.Code(a.stream(conn)); code != tc.code {
+			t.Errorf("token %q: got %s, want %s", tc.token, code, tc.code)
+		}
+	}
+}
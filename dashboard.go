@@ -0,0 +1,129 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ui is the dashboard's static page, which polls the JSON API
+//
+//go:embed ui
+var ui embed.FS
+
+// Limits on what the dashboard keeps in memory
+const (
+	dashboardMaxRecords = 100000
+	dashboardMaxShifts  = 50
+)
+
+// dashboard keeps the replies from a recent window and the latest catchment shifts for the web UI
+type dashboard struct {
+	lock    sync.Mutex
+	window  time.Duration
+	records []replyRecord // Oldest first
+	shifts  []dashboardShift
+}
+
+// dashboardShift is a target that moved to another collector, only seen on the controller
+type dashboardShift struct {
+	Time   time.Time `json:"time"`
+	Target string    `json:"target"`
+	Node   string    `json:"node"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+}
+
+// dashboardProgress is how far the current sweep has got
+type dashboardProgress struct {
+	Sweep   uint32 `json:"sweep"`
+	Probed  int    `json:"probed"`
+	Targets int    `json:"targets"`
+}
+
+// dashboardStatus is the body of the dashboard's JSON API
+type dashboardStatus struct {
+	Node      string             `json:"node"`
+	Role      string             `json:"role"`
+	Window    string             `json:"window"`
+	Paused    bool               `json:"paused"`
+	Catchment catchmentSummary   `json:"catchment"`
+	Shifts    []dashboardShift   `json:"shifts"`
+	Progress  *dashboardProgress `json:"progress,omitempty"`
+}
+
+// dash is nil unless the web UI is enabled
+var dash *dashboard
+
+func newDashboard(window time.Duration) *dashboard {
+	return &dashboard{window: window}
+}
+
+// write keeps a reply until it falls out of the window
+func (d *dashboard) write(record replyRecord) {
+	if record.Hop != 0 {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.records = append(d.records, record)
+	if len(d.records) > dashboardMaxRecords {
+		d.records = append([]replyRecord{}, d.records[len(d.records)-dashboardMaxRecords/2:]...)
+	}
+}
+
+func (d *dashboard) close() {}
+
+// shift records a catchment shift, keeping only the most recent
+func (d *dashboard) shift(s dashboardShift) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.shifts = append(d.shifts, s)
+	if len(d.shifts) > dashboardMaxShifts {
+		d.shifts = d.shifts[len(d.shifts)-dashboardMaxShifts:]
+	}
+}
+
+// recent drops replies older than the window and returns the rest, newest shifts first
+func (d *dashboard) recent() ([]replyRecord, []dashboardShift) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	cutoff := time.Now().Add(-d.window)
+	i := 0
+	for i < len(d.records) && d.records[i].Time.Before(cutoff) {
+		i++
+	}
+	d.records = d.records[i:]
+
+	shifts := make([]dashboardShift, len(d.shifts))
+	for i, s := range d.shifts {
+		shifts[len(shifts)-1-i] = s
+	}
+	return append([]replyRecord{}, d.records...), shifts
+}
+
+// handler serves the dashboard page at /ui/ and its JSON API at /ui/api
+func (d *dashboard) handler(config *Config) http.Handler {
+	static, _ := fs.Sub(ui, "ui")
+	mux := http.NewServeMux()
+	mux.Handle("/ui/", http.StripPrefix("/ui/", http.FileServer(http.FS(static))))
+	mux.HandleFunc("/ui/api", func(w http.ResponseWriter, r *http.Request) {
+		records, shifts := d.recent()
+		nodes := currentNodes()
+		status := dashboardStatus{
+			Node:      findNode(config.ID, nodes),
+			Role:      config.Role,
+			Window:    d.window.String(),
+			Paused:    control.paused(),
+			Catchment: summarizeCatchment(records, nodes),
+			Shifts:    shifts,
+			Progress:  control.progress(),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(status)
+	})
+	return mux
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// catchmentDiff is how the catchment changed between two sweeps
+type catchmentDiff struct {
+	RespondersA   int              `json:"responders_a"`
+	RespondersB   int              `json:"responders_b"`
+	Moved         []targetMove     `json:"moved"`
+	Transitions   []catchmentShift `json:"transitions"` // Moved targets by collector pair
+	MovedPrefixes []targetMove     `json:"moved_prefixes"`
+	New           []string         `json:"new"`  // Responders only in sweep B
+	Lost          []string         `json:"lost"` // Responders only in sweep A
+	RTT           []rttDelta       `json:"rtt"`
+}
+
+// targetMove is a target or prefix that landed at a different collector
+type targetMove struct {
+	Target string  `json:"target"`
+	From   string  `json:"from"`
+	To     string  `json:"to"`
+	RTTA   float64 `json:"rtt_a,omitempty"`
+	RTTB   float64 `json:"rtt_b,omitempty"`
+}
+
+// catchmentShift is the number of targets that moved from one collector to another
+type catchmentShift struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Targets int    `json:"targets"`
+}
+
+// rttDelta compares the median RTT at a collector, over targets that stayed in its catchment
+type rttDelta struct {
+	Collector string  `json:"collector"`
+	Targets   int     `json:"targets"`
+	MedianA   float64 `json:"median_a"`
+	MedianB   float64 `json:"median_b"`
+	Delta     float64 `json:"delta"`
+}
+
+// targetCatchment is the collector a target's replies arrived at in a sweep
+type targetCatchment struct {
+	collector uint16
+	rtt       float64 // Median RTT, zero if unknown
+}
+
+// runDiff compares the catchment in two recorded sweeps
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	configFile := fs.String("c", "config.yml", "Config file to name nodes from, if it exists")
+	targetsFile := fs.String("t", "", "Comma-separated targets files the probes were sent to, to map pcap replies to targets")
+	prefix4 := fs.Int("prefix4", 24, "Prefix length to group IPv4 targets by")
+	prefix6 := fs.Int("prefix6", 48, "Prefix length to group IPv6 targets by")
+	top := fs.Int("top", 20, "Moved targets to list in text output, 0 for all")
+	jsonOutput := fs.Bool("json", false, "Print the diff as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: verfploeter diff [flags] sweep-a sweep-b\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("expected two results files")
+	}
+	if *prefix4 < 0 || *prefix4 > 32 || *prefix6 < 0 || *prefix6 > 128 {
+		return errors.New("invalid prefix length")
+	}
+
+	config := &Config{}
+	if _, err := os.Stat(*configFile); err == nil {
+		config, err = loadConfig(*configFile)
+		if err != nil {
+			return err
+		}
+	}
+	if *targetsFile != "" {
+		t, err := loadTargets(strings.Split(*targetsFile, ","))
+		if err != nil {
+			return err
+		}
+		targets.set(t)
+	}
+
+	var sweeps [2]map[string]targetCatchment
+	for i, filename := range fs.Args() {
+		records, err := readResults(filename, config)
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %s", filename, err)
+		}
+		sweeps[i] = catchmentByTarget(records)
+	}
+	diff := diffCatchments(sweeps[0], sweeps[1], config.Nodes, *prefix4, *prefix6)
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diff)
+	}
+	return printDiff(diff, *top)
+}
+
+// catchmentByTarget finds the collector that received most of each target's echo replies, the lowest ID
+// on a tie
+func catchmentByTarget(records []replyRecord) map[string]targetCatchment {
+	counts := map[string]map[uint16]int{}
+	rtts := map[string][]float64{}
+	for _, record := range records {
+		if record.Error != "" || record.Hop != 0 {
+			continue
+		}
+		target := record.Target
+		if target == "" {
+			target = record.Responder
+		}
+		if counts[target] == nil {
+			counts[target] = map[uint16]int{}
+		}
+		counts[target][record.Collector]++
+		if record.RTT > 0 {
+			rtts[target] = append(rtts[target], record.RTT)
+		}
+	}
+
+	catchments := make(map[string]targetCatchment, len(counts))
+	for target, byCollector := range counts {
+		catchments[target] = targetCatchment{collector: majority(byCollector), rtt: median(rtts[target])}
+	}
+	return catchments
+}
+
+// diffCatchments compares the catchments of two sweeps, grouping targets into prefixes of prefix4 and
+// prefix6 bits to find moved prefixes
+func diffCatchments(a, b map[string]targetCatchment, nodes map[uint16]string, prefix4, prefix6 int) catchmentDiff {
+	diff := catchmentDiff{RespondersA: len(a), RespondersB: len(b)}
+	shifts := map[[2]uint16]int{}
+	stayed := map[uint16][2][]float64{}
+	prefixesA, prefixesB := map[string]map[uint16]int{}, map[string]map[uint16]int{}
+	for target, ca := range a {
+		cb, ok := b[target]
+		if !ok {
+			diff.Lost = append(diff.Lost, target)
+			continue
+		}
+		prefix := targetPrefix(target, prefix4, prefix6)
+		if prefixesA[prefix] == nil {
+			prefixesA[prefix], prefixesB[prefix] = map[uint16]int{}, map[uint16]int{}
+		}
+		prefixesA[prefix][ca.collector]++
+		prefixesB[prefix][cb.collector]++
+
+		if ca.collector != cb.collector {
+			diff.Moved = append(diff.Moved, targetMove{
+				Target: target,
+				From:   findNode(ca.collector, nodes),
+				To:     findNode(cb.collector, nodes),
+				RTTA:   ca.rtt,
+				RTTB:   cb.rtt,
+			})
+			shifts[[2]uint16{ca.collector, cb.collector}]++
+		} else if ca.rtt > 0 && cb.rtt > 0 {
+			r := stayed[ca.collector]
+			stayed[ca.collector] = [2][]float64{append(r[0], ca.rtt), append(r[1], cb.rtt)}
+		}
+	}
+	for target := range b {
+		if _, ok := a[target]; !ok {
+			diff.New = append(diff.New, target)
+		}
+	}
+	sort.Strings(diff.New)
+	sort.Strings(diff.Lost)
+	sort.Slice(diff.Moved, func(i, j int) bool {
+		return diff.Moved[i].Target < diff.Moved[j].Target
+	})
+
+	// Prefixes move when the collector most of their targets land at changes
+	for prefix := range prefixesA {
+		from, to := majority(prefixesA[prefix]), majority(prefixesB[prefix])
+		if from != to {
+			diff.MovedPrefixes = append(diff.MovedPrefixes, targetMove{
+				Target: prefix,
+				From:   findNode(from, nodes),
+				To:     findNode(to, nodes),
+			})
+		}
+	}
+	sort.Slice(diff.MovedPrefixes, func(i, j int) bool {
+		return diff.MovedPrefixes[i].Target < diff.MovedPrefixes[j].Target
+	})
+
+	for pair, n := range shifts {
+		diff.Transitions = append(diff.Transitions, catchmentShift{
+			From:    findNode(pair[0], nodes),
+			To:      findNode(pair[1], nodes),
+			Targets: n,
+		})
+	}
+	sort.Slice(diff.Transitions, func(i, j int) bool {
+		if diff.Transitions[i].Targets != diff.Transitions[j].Targets {
+			return diff.Transitions[i].Targets > diff.Transitions[j].Targets
+		}
+		return diff.Transitions[i].From+diff.Transitions[i].To < diff.Transitions[j].From+diff.Transitions[j].To
+	})
+
+	for collector, r := range stayed {
+		medianA, medianB := median(r[0]), median(r[1])
+		diff.RTT = append(diff.RTT, rttDelta{
+			Collector: findNode(collector, nodes),
+			Targets:   len(r[0]),
+			MedianA:   medianA,
+			MedianB:   medianB,
+			Delta:     medianB - medianA,
+		})
+	}
+	sort.Slice(diff.RTT, func(i, j int) bool {
+		return diff.RTT[i].Targets > diff.RTT[j].Targets
+	})
+	return diff
+}
+
+// targetPrefix returns the prefix a target address falls in, or the target itself if it isn't an address
+func targetPrefix(target string, prefix4, prefix6 int) string {
+	ip := net.ParseIP(target)
+	if ip == nil {
+		return target
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(prefix4, 32)), Mask: net.CIDRMask(prefix4, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(prefix6, 128)), Mask: net.CIDRMask(prefix6, 128)}).String()
+}
+
+// majority returns the collector with the highest count, the lowest ID on a tie
+func majority(counts map[uint16]int) uint16 {
+	var best uint16
+	bestCount := 0
+	for collector, n := range counts {
+		if n > bestCount || (n == bestCount && collector < best) {
+			best, bestCount = collector, n
+		}
+	}
+	return best
+}
+
+// median returns the median of values, or zero if there are none
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	return sorted[len(sorted)/2]
+}
+
+// printDiff prints a diff as tables, listing up to top moved targets
+func printDiff(diff catchmentDiff, top int) error {
+	fmt.Printf("%d responders in A, %d in B: %d moved, %d prefixes moved, %d new, %d lost\n",
+		diff.RespondersA, diff.RespondersB, len(diff.Moved), len(diff.MovedPrefixes), len(diff.New), len(diff.Lost))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if len(diff.Transitions) > 0 {
+		fmt.Fprintln(w, "\nFROM\tTO\tTARGETS")
+		for _, t := range diff.Transitions {
+			fmt.Fprintf(w, "%s\t%s\t%d\n", t.From, t.To, t.Targets)
+		}
+	}
+	if len(diff.RTT) > 0 {
+		fmt.Fprintln(w, "\nCOLLECTOR\tTARGETS\tMEDIAN RTT A\tMEDIAN RTT B\tDELTA")
+		for _, r := range diff.RTT {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", r.Collector, r.Targets, formatRTT(r.MedianA), formatRTT(r.MedianB), formatRTT(r.Delta))
+		}
+	}
+	if len(diff.Moved) > 0 {
+		moved := diff.Moved
+		if top > 0 && len(moved) > top {
+			moved = moved[:top]
+		}
+		fmt.Fprintln(w, "\nTARGET\tFROM\tTO\tRTT A\tRTT B")
+		for _, m := range moved {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", m.Target, m.From, m.To, formatRTT(m.RTTA), formatRTT(m.RTTB))
+		}
+		if len(moved) < len(diff.Moved) {
+			fmt.Fprintf(w, "... %d more\n", len(diff.Moved)-len(moved))
+		}
+	}
+	return w.Flush()
+}
+
+// formatRTT formats an RTT or RTT delta in seconds, or "-" if unknown
+func formatRTT(seconds float64) string {
+	if seconds == 0 {
+		return "-"
+	}
+	return time.Duration(seconds * float64(time.Second)).Round(time.Microsecond).String()
+}
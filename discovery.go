@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// nodeDiscovery finds node names in DNS TXT records, a Consul KV prefix, or a shared file served over HTTP,
+// so sites can be added without changing every node's config. Discovered names take precedence over the
+// nodes in the config.
+type nodeDiscovery struct {
+	id     uint16
+	dns    string
+	consul consulKV
+	url    string
+
+	lock       sync.Mutex
+	static     map[uint16]string
+	discovered map[uint16]string
+}
+
+// consulKV is a key prefix in Consul's KV store with a key per node ID holding its name
+type consulKV struct {
+	address string
+	prefix  string
+	token   string
+}
+
+// discovery is nil unless node discovery is configured
+var discovery *nodeDiscovery
+
+func newNodeDiscovery(config *Config) *nodeDiscovery {
+	return &nodeDiscovery{
+		id:  config.ID,
+		dns: config.Discovery.DNS,
+		consul: consulKV{
+			address: strings.TrimSuffix(config.Discovery.Consul.Address, "/"),
+			prefix:  strings.Trim(config.Discovery.Consul.Prefix, "/"),
+			token:   config.Discovery.Consul.Token,
+		},
+		url:    config.Discovery.URL,
+		static: config.Nodes,
+	}
+}
+
+// setStatic replaces the nodes from the config, such as on reload
+func (d *nodeDiscovery) setStatic(static map[uint16]string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.static = static
+	d.apply()
+}
+
+// refresh looks up the nodes, keeping the last ones found if any lookup fails
+func (d *nodeDiscovery) refresh() error {
+	discovered := map[uint16]string{}
+	if d.dns != "" {
+		if err := discoverDNS(d.dns, discovered); err != nil {
+			return fmt.Errorf("DNS: %s", err)
+		}
+	}
+	if d.consul.address != "" {
+		if err := d.consul.discover(discovered); err != nil {
+			return fmt.Errorf("Consul: %s", err)
+		}
+	}
+	if d.url != "" {
+		if err := discoverURL(d.url, discovered); err != nil {
+			return fmt.Errorf("%s: %s", d.url, err)
+		}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if reflect.DeepEqual(discovered, d.discovered) {
+		return nil
+	}
+	log.Infof("Discovered %d nodes", len(discovered))
+	d.discovered = discovered
+	d.apply()
+	return nil
+}
+
+// apply replaces the node map with the static and discovered nodes
+func (d *nodeDiscovery) apply() {
+	merged := make(map[uint16]string, len(d.static)+len(d.discovered))
+	for id, name := range d.static {
+		merged[id] = name
+	}
+	for id, name := range d.discovered {
+		merged[id] = name
+	}
+	if !reflect.DeepEqual(merged, currentNodes()) {
+		setNodes(merged)
+		filterEchoReplies(d.id, merged)
+	}
+}
+
+// run refreshes the nodes every interval
+func (d *nodeDiscovery) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := d.refresh(); err != nil {
+			log.Warnf("Unable to discover nodes: %s", err)
+		}
+	}
+}
+
+// addNode parses a node ID and adds it to nodes
+func addNode(nodes map[uint16]string, id, name string) error {
+	n, err := strconv.ParseUint(strings.TrimSpace(id), 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid node ID %q", id)
+	}
+	if name = strings.TrimSpace(name); name == "" {
+		return fmt.Errorf("node %d has no name", n)
+	}
+	nodes[uint16(n)] = name
+	return nil
+}
+
+// discoverDNS reads nodes from TXT records of the form "10 fmt2" or "10=fmt2"
+func discoverDNS(name string, nodes map[uint16]string) error {
+	records, err := net.LookupTXT(name)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		fields := strings.FieldsFunc(record, func(r rune) bool {
+			return r == ' ' || r == '='
+		})
+		if len(fields) != 2 {
+			return fmt.Errorf("invalid TXT record %q (expected node ID and name)", record)
+		}
+		if err := addNode(nodes, fields[0], fields[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discover reads nodes from the keys under the prefix, named by node ID
+func (c consulKV) discover(nodes map[uint16]string) error {
+	segments := strings.Split(c.prefix, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	u := fmt.Sprintf("%s/v1/kv/%s/?recurse=true", c.address, strings.Join(segments, "/"))
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := remoteHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil // No keys under the prefix
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	// Values are base64 encoded, which json decodes into a byte slice
+	var pairs []struct {
+		Key   string
+		Value []byte
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+		return err
+	}
+	for _, pair := range pairs {
+		if strings.HasSuffix(pair.Key, "/") {
+			continue
+		}
+		if err := addNode(nodes, path.Base(pair.Key), string(pair.Value)); err != nil {
+			return fmt.Errorf("%s: %s", pair.Key, err)
+		}
+	}
+	return nil
+}
+
+// discoverURL reads nodes from a YAML or JSON map of node IDs to names
+func discoverURL(u string, nodes map[uint16]string) error {
+	body, _, err := fetchURL(u)
+	if err != nil {
+		return err
+	}
+	var fetched map[uint16]string
+	if err := yaml.Unmarshal(body, &fetched); err != nil {
+		return err
+	}
+	for id, name := range fetched {
+		if err := addNode(nodes, strconv.Itoa(int(id)), name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// probeFallback probes targets with an ordered list of protocols, moving on to the next protocol once a
+// probe goes unanswered after every retry, so targets in networks that filter one protocol are still
+// reached. The list can be set per prefix.
+type probeFallback struct {
+	protocols []string
+	prefixes  []fallbackPrefix // Most specific first
+	used      map[string]bool  // Every protocol in the lists
+
+	fallbacks *prometheus.CounterVec
+}
+
+// fallbackPrefix is the protocol list for targets in a prefix
+type fallbackPrefix struct {
+	prefix    *net.IPNet
+	protocols []string
+}
+
+// fallback is nil unless probe.fallback is set
+var fallback *probeFallback
+
+func newProbeFallback(config *Config, reg prometheus.Registerer, constLabels prometheus.Labels) *probeFallback {
+	factory := promauto.With(reg)
+	f := &probeFallback{
+		protocols: config.Probe.Fallback.Protocols,
+		used:      map[string]bool{},
+		fallbacks: factory.NewCounterVec(prometheus.CounterOpts{
+			Name:        "verfploeter_fallback_probes_total",
+			ConstLabels: constLabels,
+		}, []string{"protocol"}),
+	}
+	for prefix, protocols := range config.Probe.Fallback.Targets {
+		ipNet, _ := parsePrefix(prefix)
+		f.prefixes = append(f.prefixes, fallbackPrefix{ipNet, protocols})
+	}
+	for _, p := range fallbackProtocols(config) {
+		f.used[p] = true
+	}
+	sort.Slice(f.prefixes, func(i, j int) bool {
+		a, _ := f.prefixes[i].prefix.Mask.Size()
+		b, _ := f.prefixes[j].prefix.Mask.Size()
+		return a > b
+	})
+	return f
+}
+
+// methods returns the protocols to probe a target with, in order
+func (f *probeFallback) methods(target string) []string {
+	if ip := net.ParseIP(target); ip != nil {
+		for _, p := range f.prefixes {
+			if p.prefix.Contains(ip) {
+				return p.protocols
+			}
+		}
+	}
+	return f.protocols
+}
+
+// first returns the protocol to probe a target with first
+func (f *probeFallback) first(target string) string {
+	return f.methods(target)[0]
+}
+
+// next returns the protocol to try after one that went unanswered, or false if it was the last
+func (f *probeFallback) next(target, protocol string) (string, bool) {
+	methods := f.methods(target)
+	for i, p := range methods {
+		if p == protocol && i+1 < len(methods) {
+			f.fallbacks.With(map[string]string{"protocol": methods[i+1]}).Inc()
+			return methods[i+1], true
+		}
+	}
+	return "", false
+}
+
+// usesProtocol checks if any target is probed with a protocol, so its sockets need to be opened
+func usesProtocol(p string) bool {
+	if fallback != nil {
+		return fallback.used[p]
+	}
+	for _, profile := range profiles {
+		if profile.config.Probe.Protocol == p {
+			return true
+		}
+	}
+	return false
+}
+
+// fallbackProtocols returns every protocol in probe.fallback
+func fallbackProtocols(config *Config) []string {
+	seen := map[string]bool{}
+	var protocols []string
+	add := func(list []string) {
+		for _, p := range list {
+			if !seen[p] {
+				seen[p] = true
+				protocols = append(protocols, p)
+			}
+		}
+	}
+	add(config.Probe.Fallback.Protocols)
+	for _, list := range config.Probe.Fallback.Targets {
+		add(list)
+	}
+	return protocols
+}
+
+// recordProtocol returns the protocol of the probe a reply answered
+func recordProtocol(record replyRecord) string {
+	switch record.Response {
+	case "syn-ack", "rst":
+		return protocolTCP
+	case "udp", "port-unreachable":
+		return udpProtocol()
+	}
+	return protocolICMP
+}
+
+// parsePrefix parses a prefix in CIDR notation or a single address
+func parsePrefix(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid prefix %q", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	return ipNet, err
+}
+
+// checkFallback validates the protocol lists in probe.fallback, defaulting the global list to probe.protocol
+func checkFallback(config *Config) error {
+	f := &config.Probe.Fallback
+	if len(f.Protocols) == 0 {
+		f.Protocols = []string{config.Probe.Protocol}
+	}
+	check := func(name string, protocols []string) error {
+		seen := map[string]bool{}
+		for _, p := range protocols {
+			switch p {
+			case protocolICMP, protocolTCP, protocolUDP, protocolChaos:
+			default:
+				return fmt.Errorf("unknown protocol %q in %s", p, name)
+			}
+			if seen[p] {
+				return fmt.Errorf("protocol %s is repeated in %s", p, name)
+			}
+			seen[p] = true
+		}
+		if len(protocols) == 0 {
+			return fmt.Errorf("%s has no protocols", name)
+		}
+		return nil
+	}
+	if err := check("probe.fallback.protocols", f.Protocols); err != nil {
+		return err
+	}
+	for prefix, protocols := range f.Targets {
+		if _, err := parsePrefix(prefix); err != nil {
+			return fmt.Errorf("probe.fallback.targets: %s", err)
+		}
+		if err := check("probe.fallback.targets "+prefix, protocols); err != nil {
+			return err
+		}
+	}
+
+	// UDP and CHAOS probes share the UDP sockets and payload
+	used := map[string]bool{}
+	for _, p := range fallbackProtocols(config) {
+		used[p] = true
+	}
+	if used[protocolUDP] && used[protocolChaos] {
+		return fmt.Errorf("probe.fallback can't use both %s and %s", protocolUDP, protocolChaos)
+	}
+	if (len(used) > 1 || !used[protocolICMP]) && (len(config.Probe.Sources) > 0 || len(config.Probe.PMTU) > 0) {
+		return fmt.Errorf("probe.sources and probe.pmtu only support %s probes", protocolICMP)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoEnricher tags replies with the responder's country and origin AS from MaxMind databases
+type geoEnricher struct {
+	country *maxminddb.Reader
+	asn     *maxminddb.Reader
+}
+
+// geo is nil unless a GeoIP database is configured
+var geo *geoEnricher
+
+// openGeo opens the GeoLite2 Country and ASN databases, either of which may be empty to skip it
+func openGeo(countryPath, asnPath string) (*geoEnricher, error) {
+	g := &geoEnricher{}
+	var err error
+	if countryPath != "" {
+		if g.country, err = maxminddb.Open(countryPath); err != nil {
+			return nil, err
+		}
+	}
+	if asnPath != "" {
+		if g.asn, err = maxminddb.Open(asnPath); err != nil {
+			g.close()
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// enrich sets a record's country and ASN, leaving them empty if the responder isn't found
+func (g *geoEnricher) enrich(record *replyRecord) {
+	if ip := net.ParseIP(record.Responder); ip != nil {
+		record.Country, record.ASN = g.lookup(ip)
+	}
+}
+
+// lookup returns the ISO country code and origin AS of an address, empty if they aren't found
+func (g *geoEnricher) lookup(ip net.IP) (string, uint32) {
+	var country string
+	var asn uint32
+	if g.country != nil {
+		var entry struct {
+			Country struct {
+				ISOCode string `maxminddb:"iso_code"`
+			} `maxminddb:"country"`
+		}
+		if err := g.country.Lookup(ip, &entry); err == nil {
+			country = entry.Country.ISOCode
+		}
+	}
+	if g.asn != nil {
+		var entry struct {
+			ASN uint32 `maxminddb:"autonomous_system_number"`
+		}
+		if err := g.asn.Lookup(ip, &entry); err == nil {
+			asn = entry.ASN
+		}
+	}
+	return country, asn
+}
+
+// close closes the databases
+func (g *geoEnricher) close() {
+	if g.country != nil {
+		g.country.Close()
+	}
+	if g.asn != nil {
+		g.asn.Close()
+	}
+}
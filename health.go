@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// listeners is the number of running echo reply listeners, of which at least minListeners are needed
+	listeners    int32
+	minListeners int32 = 2
+
+	// probing is set once the first probe has been sent
+	probing int32
+
+	// draining is set once probing has stopped for shutdown
+	draining int32
+
+	// lastProbe and lastReply are the Unix times in nanoseconds of the last probe sent and reply received
+	lastProbe int64
+	lastReply int64
+
+	// probeStale is how long in nanoseconds after the last probe, or startup before the first one, the prober
+	// is considered wedged, zero if this node doesn't probe or hasn't started probing
+	probeStale int64
+)
+
+// healthStatus is the body of the health and readiness endpoints
+type healthStatus struct {
+	Status    string     `json:"status"`
+	Reason    string     `json:"reason,omitempty"`
+	Paused    bool       `json:"paused,omitempty"`
+	Listeners int32      `json:"listeners"`
+	Targets   int        `json:"targets"`
+	LastProbe *time.Time `json:"last_probe,omitempty"`
+	LastReply *time.Time `json:"last_reply,omitempty"`
+}
+
+// writeHealth writes the current status, unhealthy with a reason if it isn't empty
+func writeHealth(w http.ResponseWriter, reason string) {
+	status := healthStatus{
+		Status:    "ok",
+		Reason:    reason,
+		Paused:    control.paused(),
+		Listeners: atomic.LoadInt32(&listeners),
+		Targets:   len(allTargets()),
+		LastProbe: unixTime(atomic.LoadInt64(&lastProbe)),
+		LastReply: unixTime(atomic.LoadInt64(&lastReply)),
+	}
+	code := http.StatusOK
+	if reason != "" {
+		status.Status = "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// unixTime converts Unix nanoseconds to a time, or nil if zero
+func unixTime(ns int64) *time.Time {
+	if ns == 0 {
+		return nil
+	}
+	t := time.Unix(0, ns)
+	return &t
+}
+
+// healthReason returns why the service is unhealthy, or an empty string once every ICMP listener is running
+// and while probes are still being sent unless probing is paused or waiting for the schedule. The first probe
+// has to be sent within probeStale of startup.
+func healthReason() string {
+	last, stale := atomic.LoadInt64(&lastProbe), time.Duration(atomic.LoadInt64(&probeStale))
+	if atomic.LoadInt32(&listeners) < minListeners {
+		return "listeners not running"
+	} else if stale == 0 || atomic.LoadInt32(&draining) != 0 || control.paused() || waitingForSchedule() {
+		return ""
+	} else if last == 0 && time.Since(startTime) > stale {
+		return fmt.Sprintf("no probes sent since startup %s ago", time.Since(startTime).Round(time.Second))
+	} else if last != 0 && time.Since(time.Unix(0, last)) > stale {
+		return fmt.Sprintf("no probes sent in %s", time.Since(time.Unix(0, last)).Round(time.Second))
+	}
+	return ""
+}
+
+// healthzHandler reports whether the service is healthy
+func healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	writeHealth(w, healthReason())
+}
+
+// readyzHandler reports ready once targets are loaded and the first probe has been sent, until shutdown
+func readyzHandler(w http.ResponseWriter, _ *http.Request) {
+	var reason string
+	if atomic.LoadInt32(&draining) != 0 {
+		reason = "draining"
+	} else if atomic.LoadInt64(&probeStale) > 0 && !targetsLoaded() {
+		reason = "no targets loaded"
+	} else if atomic.LoadInt32(&probing) == 0 {
+		reason = "not probing yet"
+	}
+	writeHealth(w, reason)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/natesales/go-verfploeter/pkg/verfploeter"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// Hitlists have one responsive address per block of these sizes
+const (
+	hitlistBits4 = 24
+	hitlistBits6 = 48
+)
+
+// hitlistBlock is a /24 or /48 to find a responsive address in, limited to the announced prefix if it's
+// more specific
+type hitlistBlock struct {
+	prefix    *net.IPNet
+	responder string
+}
+
+// runHitlist probes candidate addresses in a list of prefixes and writes one responsive address per block
+// as a targets file
+func runHitlist(args []string) error {
+	fs := flag.NewFlagSet("hitlist", flag.ExitOnError)
+	configFile := fs.String("c", "config.yml", "Config file to take the node ID and probe sources from, if it exists")
+	excludeFile := fs.String("x", "", "Comma-separated files of addresses and prefixes to never probe")
+	output := fs.String("o", "-", "Targets file to write (- for stdout)")
+	pps := fs.Float64("rate", 1000, "Probes per second")
+	timeout := fs.Duration("timeout", 2*time.Second, "Time to wait for replies after each round")
+	tries := fs.Int("tries", 3, "Candidate addresses to probe per block before giving up on it")
+	maxBlocks := fs.Int("max-blocks", 65536, "Most blocks to probe per prefix, larger prefixes are truncated")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: verfploeter hitlist [flags] prefix-file...\n\n")
+		fmt.Fprintf(fs.Output(), "Prefix files list one prefix per line, or are text BGP table dumps such as the output of bgpdump -m.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("no prefix files given")
+	}
+	if *tries < 1 {
+		return errors.New("-tries must be at least 1")
+	}
+
+	config := &Config{}
+	config.Probe.Source4 = "0.0.0.0"
+	config.Probe.Source6 = "::"
+	if _, err := os.Stat(*configFile); err == nil {
+		config, err = loadConfig(*configFile)
+		if err != nil {
+			return err
+		}
+	}
+	if *excludeFile != "" {
+		var err error
+		exclusions, err = loadExclusions(strings.Split(*excludeFile, ","))
+		if err != nil {
+			return err
+		}
+	}
+
+	prefixes, err := readPrefixes(fs.Args())
+	if err != nil {
+		return err
+	}
+	blocks := hitlistBlocks(prefixes, *maxBlocks)
+	log.Infof("Finding responsive addresses in %d blocks from %d prefixes", len(blocks), len(prefixes))
+
+	// Probe every unanswered block with a new candidate each round
+	sources := map[int]string{4: config.Probe.Source4, 6: config.Probe.Source6}
+	if len(config.Probe.Sources) > 0 {
+		sources = map[int]string{}
+		for _, addr := range config.Probe.Sources {
+			if net.ParseIP(addr).To4() != nil && sources[4] == "" {
+				sources[4] = addr
+			} else if net.ParseIP(addr).To4() == nil && sources[6] == "" {
+				sources[6] = addr
+			}
+		}
+	}
+	tracker := verfploeter.NewTracker()
+	prober := &verfploeter.Prober{ID: int(config.ID), Tracker: tracker, PayloadSize: config.Probe.PayloadSize}
+	listener := &verfploeter.Listener{ID: config.ID, Tracker: tracker}
+	var lock sync.Mutex
+	candidates := map[string]*hitlistBlock{}
+	for _, ipVersion := range []int{4, 6} {
+		if sources[ipVersion] == "" {
+			continue
+		}
+		pc, err := openICMP(fmt.Sprint(ipVersion), sources[ipVersion], config.Probe.Interface, config.ID, config.Probe.Unprivileged)
+		if err != nil {
+			return fmt.Errorf("unable to listen on IPv%d source %q: %s", ipVersion, sources[ipVersion], err)
+		}
+		defer pc.Close()
+		proto := 58
+		if ipVersion == 4 {
+			prober.Conn4 = pc
+			proto = 1
+		} else {
+			prober.Conn6 = pc
+		}
+		go func(pc net.PacketConn, proto int) {
+			for {
+				result, err := listener.Read(pc, proto)
+				if errors.Is(err, net.ErrClosed) {
+					return
+				} else if err != nil {
+					continue
+				}
+				responder := result.Src.String()
+				lock.Lock()
+				if block, ok := candidates[responder]; ok && block.responder == "" {
+					block.responder = responder
+				}
+				lock.Unlock()
+			}
+		}(pc, proto)
+	}
+
+	limiter := rate.NewLimiter(rate.Limit(*pps), 1)
+	for try := 0; try < *tries; try++ {
+		sent := 0
+		for _, block := range blocks {
+			lock.Lock()
+			found := block.responder != ""
+			lock.Unlock()
+			if found {
+				continue
+			}
+			addr := hitlistCandidate(block.prefix, try)
+			if addr == nil || isExcluded(addr) {
+				continue
+			}
+			if (addr.To4() != nil && prober.Conn4 == nil) || (addr.To4() == nil && prober.Conn6 == nil) {
+				continue
+			}
+			lock.Lock()
+			candidates[addr.String()] = block
+			lock.Unlock()
+
+			// Sequence numbers are shared by all candidates rather than tracked per address
+			_ = limiter.Wait(context.Background())
+			if _, err := prober.Probe(&net.IPAddr{IP: addr}, "hitlist", verfploeter.NoTarget, 0); err != nil {
+				log.Debugf("Unable to probe %s: %s", addr, err)
+				continue
+			}
+			sent++
+		}
+		time.Sleep(*timeout)
+		tracker.Expire(*timeout)
+		log.Infof("Round %d: sent %d probes, %d of %d blocks responsive", try+1, sent, countResponsive(blocks, &lock), len(blocks))
+		if sent == 0 {
+			break
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	return writeHitlist(*output, blocks)
+}
+
+// readPrefixes reads prefixes from files of one prefix per line or text BGP table dumps, taking the first
+// field of each line that is a prefix. Default routes and duplicates are skipped.
+func readPrefixes(filenames []string) ([]*net.IPNet, error) {
+	var prefixes []*net.IPNet
+	seen := map[string]bool{}
+	for _, filename := range filenames {
+		lines, _, err := readLines(filename)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read prefix file %s: %s", filename, err)
+		}
+		for _, line := range lines {
+			fields := strings.FieldsFunc(line, func(r rune) bool {
+				return r == ' ' || r == '\t' || r == '|'
+			})
+			for _, field := range fields {
+				_, prefix, err := net.ParseCIDR(field)
+				if err != nil {
+					continue
+				}
+				if ones, _ := prefix.Mask.Size(); ones > 0 && !seen[prefix.String()] {
+					seen[prefix.String()] = true
+					prefixes = append(prefixes, prefix)
+				}
+				break
+			}
+		}
+	}
+	if len(prefixes) == 0 {
+		return nil, errors.New("no prefixes found")
+	}
+	return prefixes, nil
+}
+
+// hitlistBlocks splits prefixes into /24s and /48s, covering each block once even if prefixes overlap
+func hitlistBlocks(prefixes []*net.IPNet, maxBlocks int) []*hitlistBlock {
+	var blocks []*hitlistBlock
+	seen := map[string]bool{}
+	truncated := 0
+	for _, prefix := range prefixes {
+		ones, bits := prefix.Mask.Size()
+		blockBits := hitlistBits6
+		if bits == 32 {
+			blockBits = hitlistBits4
+		}
+
+		// Prefixes more specific than a block are probed as they are, keyed by their block
+		if ones >= blockBits {
+			key := (&net.IPNet{IP: prefix.IP.Mask(net.CIDRMask(blockBits, bits)), Mask: net.CIDRMask(blockBits, bits)}).String()
+			if !seen[key] {
+				seen[key] = true
+				blocks = append(blocks, &hitlistBlock{prefix: prefix})
+			}
+			continue
+		}
+
+		ip := make(net.IP, len(prefix.IP))
+		copy(ip, prefix.IP)
+		for i := 0; prefix.Contains(ip); i++ {
+			if i == maxBlocks {
+				truncated++
+				break
+			}
+			block := &net.IPNet{IP: make(net.IP, len(ip)), Mask: net.CIDRMask(blockBits, bits)}
+			copy(block.IP, ip)
+			if !seen[block.String()] {
+				seen[block.String()] = true
+				blocks = append(blocks, &hitlistBlock{prefix: block})
+			}
+			if !addToIP(ip, blockBits) {
+				break
+			}
+		}
+	}
+	if truncated > 0 {
+		log.Warnf("Probing only the first %d blocks of %d prefixes", maxBlocks, truncated)
+	}
+	return blocks
+}
+
+// addToIP increments the bit at position bit (counting from the most significant) of an address in place,
+// returning false if it overflowed
+func addToIP(ip net.IP, bit int) bool {
+	i := (bit - 1) / 8
+	carry := 1 << (7 - (bit-1)%8)
+	for ; i >= 0; i-- {
+		sum := int(ip[i]) + carry
+		ip[i] = byte(sum)
+		carry = sum >> 8
+		if carry == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hitlistCandidate returns the address to probe in a prefix on a try, the first host address (commonly a
+// router) followed by random addresses. Network and broadcast addresses of IPv4 prefixes are skipped.
+func hitlistCandidate(prefix *net.IPNet, try int) net.IP {
+	ones, bits := prefix.Mask.Size()
+	ip := make(net.IP, len(prefix.IP))
+	copy(ip, prefix.IP)
+	if bits-ones == 0 {
+		if try > 0 {
+			return nil
+		}
+		return ip
+	}
+	if try == 0 {
+		incrementIP(ip)
+		return ip
+	}
+
+	hosts := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	if bits == 32 && bits-ones > 1 {
+		hosts.Sub(hosts, big.NewInt(2))
+	}
+	n, err := rand.Int(rand.Reader, hosts)
+	if err != nil {
+		return nil
+	}
+	if bits == 32 && bits-ones > 1 {
+		n.Add(n, big.NewInt(1))
+	}
+	n.Add(n, new(big.Int).SetBytes(ip))
+	b := n.Bytes()
+	copy(ip[len(ip)-len(b):], b)
+	return ip
+}
+
+// countResponsive returns how many blocks have a responsive address
+func countResponsive(blocks []*hitlistBlock, lock *sync.Mutex) int {
+	lock.Lock()
+	defer lock.Unlock()
+	n := 0
+	for _, block := range blocks {
+		if block.responder != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// writeHitlist writes the responsive address of each block as a targets file, sorted by block
+func writeHitlist(filename string, blocks []*hitlistBlock) error {
+	var responsive []*hitlistBlock
+	for _, block := range blocks {
+		if block.responder != "" {
+			responsive = append(responsive, block)
+		}
+	}
+	sort.Slice(responsive, func(i, j int) bool {
+		a, b := responsive[i].prefix.IP.To16(), responsive[j].prefix.IP.To16()
+		return string(a) < string(b)
+	})
+
+	var w io.Writer = os.Stdout
+	if filename != "-" {
+		f, err := os.Create(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	fmt.Fprintf(w, "# verfploeter hitlist, %d of %d blocks responsive at %s\n",
+		len(responsive), len(blocks), time.Now().UTC().Format(time.RFC3339))
+	for _, block := range responsive {
+		if _, err := fmt.Fprintln(w, block.responder); err != nil {
+			return err
+		}
+	}
+	if filename != "-" {
+		log.Infof("Wrote %d addresses to %s", len(responsive), filename)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// startHTTP serves metrics, health checks, and the optional APIs, either alongside them or on their own address.
+// Health checks are served without authentication, and the APIs with api.token instead of http's.
+func startHTTP(config *Config) {
+	tlsConfig, err := httpTLSConfig(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	http.Handle("/metrics", requireHTTPAuth(config, promhttp.Handler()))
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+
+	// Listen before returning so readiness isn't reported before the server is up
+	api := http.DefaultServeMux
+	if config.API.Listen != "" && (config.API.Enabled || config.API.Control) {
+		api = http.NewServeMux()
+		serveHTTP(config.API.Listen, api, tlsConfig)
+	}
+	if config.API.Enabled {
+		var h http.Handler = probeHandler()
+		if config.API.Token != "" {
+			h = requireToken(config.API.Token, h)
+		} else {
+			h = requireHTTPAuth(config, h)
+		}
+		api.Handle("/probe", h)
+	}
+	if config.API.Control {
+		h := requireToken(config.API.Token, controlHandler(control))
+		api.Handle("/control", h)
+		api.Handle("/control/", h)
+	}
+	if dash != nil {
+		http.Handle("/ui/", requireHTTPAuth(config, dash.handler(config)))
+	}
+	serveHTTP(config.Listen, nil, tlsConfig)
+}
+
+// serveHTTP listens on an address and serves a handler in the background, over HTTPS if tlsConfig is set
+func serveHTTP(address string, handler http.Handler, tlsConfig *tls.Config) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatalf("unable to listen on %s: %s", address, err)
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	go func() {
+		log.Fatal(http.Serve(l, handler))
+	}()
+}
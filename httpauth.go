@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// checkHTTP validates the TLS and authentication settings of the HTTP listeners
+func checkHTTP(config *Config) error {
+	c := config.HTTP
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return errors.New("http.tls.cert and http.tls.key must be set together")
+	}
+	if c.TLS.ClientCA != "" && c.TLS.Cert == "" {
+		return errors.New("http.tls.client_ca needs http.tls.cert")
+	}
+	if (c.Username == "") != (c.Password == "") {
+		return errors.New("http.username and http.password must be set together")
+	}
+	return nil
+}
+
+// httpTLSConfig loads the server certificate and client CA, returning nil to serve plain HTTP
+func httpTLSConfig(config *Config) (*tls.Config, error) {
+	c := config.HTTP.TLS
+	if c.Cert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load http.tls.cert: %s", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if c.ClientCA != "" {
+		pem, err := os.ReadFile(c.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read http.tls.client_ca: %s", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in http.tls.client_ca %s", c.ClientCA)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// requireHTTPAuth wraps a handler to require http.token as a bearer token or http.username and http.password
+// with basic auth, either of them if both are set. Handlers are returned as is without either.
+func requireHTTPAuth(config *Config, h http.Handler) http.Handler {
+	token, username, password := config.HTTP.Token, config.HTTP.Username, config.HTTP.Password
+	if token == "" && username == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if token != "" && strings.HasPrefix(auth, "Bearer ") &&
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if u, p, ok := r.BasicAuth(); ok && username != "" &&
+			subtle.ConstantTimeCompare([]byte(u), []byte(username))&subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if username != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="verfploeter"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
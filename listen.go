@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/natesales/go-verfploeter/pkg/verfploeter"
+	log "github.com/sirupsen/logrus"
+)
+
+// familyName returns the address family label for an ICMP protocol number
+func familyName(proto int) string {
+	if proto == 1 {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// listenReplies reads replies received at a source until its socket is closed
+func listenReplies(source *verfploeter.Source) {
+	atomic.AddInt32(&listeners, 1)
+	defer atomic.AddInt32(&listeners, -1)
+	pc, proto := source.Conn, source.Proto
+	dc, ok := pc.(*datagramConn)
+	if ok {
+		pc = dc.UDPConn
+	}
+	if ok && dc.ipHeader {
+		pc = verfploeter.NewHeaderTTLConn(dc.UDPConn)
+	} else if c, err := verfploeter.NewTTLConn(pc, proto); err != nil {
+		log.WithField("family", familyName(proto)).Warnf("Unable to read reply TTLs: %s", err)
+	} else {
+		pc = c
+	}
+
+	// Replies to spoofed probes arrive at the spoofed address
+	l := *listener
+	if capture != nil {
+		local := source.Addr
+		if proto == 1 && spoof4 != nil {
+			local = spoof4.src
+		}
+		l.Capture = capture.hook(local)
+	}
+	_ = l.Serve(pc, proto, verfploeter.Handler{
+		Reply: func(result *verfploeter.Result) {
+			if fromTarget(result.Src, "echo reply") {
+				handleEchoReply(source, result)
+			}
+		},
+		Error: func(e *verfploeter.ICMPError) {
+			if tracer != nil && tracer.answerError(e) {
+				return
+			}
+
+			// A port unreachable in response to a UDP probe shows the target was reached
+			if udpListener != nil && udpUnreachable(e) {
+				return
+			}
+			handleICMPError(e)
+		},
+		Reject: func(err error) {
+			switch {
+			case errors.Is(err, verfploeter.ErrBadSignature):
+				badSignatures.Inc()
+				log.Debug(err)
+			case errors.Is(err, verfploeter.ErrDuplicate):
+				duplicates.Inc()
+				log.Debug(err)
+			case errors.Is(err, verfploeter.ErrUnsolicited):
+				if tracer != nil && tracer.answerEcho(err) {
+					return
+				}
+				unsolicited.Inc()
+				log.Debug(err)
+			default:
+				log.WithField("family", familyName(proto)).Warn(err)
+			}
+		},
+	})
+}
+
+// handleEchoReply counts an echo reply received at a source against the profile that sent the probe and
+// records it
+func handleEchoReply(source *verfploeter.Source, result *verfploeter.Result) {
+	record := newReplyRecord(result)
+	record.Source = source.Label()
+	p := recordProfile(record)
+	family := familyName(result.Proto)
+	dst := p.answer(result.Node)
+	atomic.AddUint64(&repliesTotal, 1)
+	if d, ok := result.RTT(); ok {
+		p.metrics.rtt.With(map[string]string{"dst": dst, "family": family}).Observe(d.Seconds())
+	}
+	if result.TTL != 0 {
+		p.metrics.hops.With(map[string]string{"dst": dst, "family": family}).Observe(float64(verfploeter.HopCount(result.TTL)))
+	}
+	p.metrics.sourceReplies.With(map[string]string{"source": source.Label()}).Inc()
+	if anycast != nil {
+		anycast.tag(&record, result.Dst)
+	}
+	handleReply(record)
+}
+
+// handleICMPError counts an ICMP error message against the node and profile whose probe triggered it and
+// records it like a reply, correlated with the probe through the quoted echo request
+func handleICMPError(e *verfploeter.ICMPError) {
+	result, err := listener.Correlate(e)
+	if err != nil {
+		log.Debug(err)
+		return
+	}
+
+	// Errors answer our own probes, so they aren't retransmitted or counted as lost
+	probe := result.Probe
+	record := replyRecord{
+		Time:      result.Time,
+		Collector: result.Collector,
+		Node:      result.Node,
+		Responder: result.Src.String(),
+		Seq:       probe.Seq,
+		Error:     result.Type,
+		Code:      result.Code,
+		MTU:       result.MTU,
+	}
+	if pmtu != nil {
+		record.Size = probe.Size
+	}
+	p := addrProfile(probe.Dst)
+	if probe.HasPayload {
+		if target, profile, ok := targetAt(probe.Payload.Target); ok {
+			record.Target, p = target, profile
+		}
+		record.Sweep = probe.Payload.Sweep
+		if d := record.Time.Sub(probe.Payload.Sent); d >= 0 {
+			record.RTT = d.Seconds()
+		}
+	} else if _, ok := p.targets.index(probe.Dst.String()); ok {
+		record.Target = probe.Dst.String()
+	}
+	record.Profile = p.name
+	p.countAnswer(result.Node)
+	p.metrics.icmpErrors.With(map[string]string{
+		"type": result.Type,
+		"code": strconv.Itoa(result.Code),
+		"dst":  findNode(result.Node, currentNodes()),
+	}).Inc()
+	handleReply(record)
+}
+
+// listenAll starts the listeners of every source and raw socket
+func listenAll() {
+	for _, source := range probeSources.List() {
+		go listenReplies(source)
+	}
+	if tcpProber != nil {
+		go listenTCPReplies(tcp4, "ipv4")
+		go listenTCPReplies(tcp6, "ipv6")
+	}
+	if udpListener != nil {
+		go listenUDPReplies(udp4, "ipv4")
+		go listenUDPReplies(udp6, "ipv6")
+	}
+}
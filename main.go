@@ -1,221 +1,724 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
 	"flag"
 	"fmt"
-	"math/rand"
 	"net"
-	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/natesales/go-verfploeter/pkg/verfploeter"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/net/icmp"
-	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
-	"gopkg.in/yaml.v3"
 )
 
 var (
 	configFile  = flag.String("c", "config.yml", "Config file")
-	targetsFile = flag.String("t", "targets.txt", "Targets file")
+	targetsFile = flag.String("t", "targets.txt", "Comma-separated targets files (- for stdin) or HTTP(S) URLs")
+	watch       = flag.Bool("watch", false, "Reload targets files when they change")
+	excludeFile = flag.String("x", "", "Comma-separated files of addresses and prefixes to never probe")
 	verbose     = flag.Bool("v", false, "Enable verbose logging")
+	dryRun      = flag.Bool("dry-run", false, "Build probes without sending them")
+	checkConfig = flag.Bool("check-config", false, "Validate the config and targets, then exit")
+	count       = flag.Int("count", 0, "Stop after sending this many probes (0 for no limit)")
+	duration    = flag.Duration("duration", 0, "Stop after this long (0 for no limit)")
+	profileName = flag.String("profile", "", "Run only this profile of the config")
 
 	version = "dev" // Set by linker
-	pc4     *icmp.PacketConn
-	pc6     *icmp.PacketConn
 
-	// Metrics
-	requests prometheus.Counter
-	replies  *prometheus.CounterVec
+	// anySource counts replies from addresses that aren't targets
+	anySource bool
+	spoof4    *spoofConn
+	tracker   = verfploeter.NewTracker()
+	listener  *verfploeter.Listener
+	capture   *pcapWriter
+	dedup     *verfploeter.Dedup
+	resolver  = newResolveCache()
+	targets   targetList
+
+	// probeDevice is the interface or VRF that probes are bound to, if any
+	probeDevice string
+
+	// Totals for the shutdown summary
+	sentTotal    uint64
+	repliesTotal uint64
+
+	// nodes is replaced wholesale on reload, never mutated in place
+	nodes     map[uint16]string
+	nodesLock sync.RWMutex
 )
 
-type Config struct {
-	ID     uint8  `yaml:"id"`
-	Listen string `yaml:"listen"`
-	Probe  struct {
-		Interval time.Duration `yaml:"interval"`
-		Source4  string        `yaml:"source4"`
-		Source6  string        `yaml:"source6"`
-	} `yaml:"probe"`
-	Nodes map[uint8]string `yaml:"nodes"`
+// setNodes replaces the node map used to label replies
+func setNodes(n map[uint16]string) {
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+	nodes = n
+}
+
+// currentNodes returns the node map used to label replies
+func currentNodes() map[uint16]string {
+	nodesLock.RLock()
+	defer nodesLock.RUnlock()
+	return nodes
 }
 
-func findNode(id uint8, nodes map[uint8]string) string {
+func findNode(id uint16, nodes map[uint16]string) string {
 	if node, ok := nodes[id]; ok {
 		return node
 	}
 	return fmt.Sprintf("unknown (id %d)", id)
 }
 
-// icmpProbe sends an ICMP packet to a given target with an ID
-func icmpProbe(target string, id int) error {
-	targetIP, err := net.ResolveIPAddr("ip", target)
+// flagSet checks if a command line flag was given
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// usage prints the subcommands and flags
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, `Usage: verfploeter [command] [flags]
+
+Commands:
+  probe    Send probes to the targets (role: pinger)
+  listen   Collect replies without sending probes (role: collector)
+  analyze  Summarize the catchment in recorded results files or pcaps
+  diff     Compare the catchment in two recorded sweeps
+  hitlist  Find a responsive address per /24 and /48 of a list of prefixes to use as targets
+  version  Print the version
+
+Without a command, verfploeter runs in the role set in the config file.
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	// Subcommands override the configured role
+	flag.Usage = usage
+	var role, command string
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		switch command {
+		case "probe":
+			role = rolePinger
+		case "listen":
+			role = roleCollector
+		case "analyze":
+			if err := runAnalyze(args[1:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "diff":
+			if err := runDiff(args[1:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "hitlist":
+			if err := runHitlist(args[1:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "version":
+			fmt.Println("verfploeter", version)
+			return
+		default:
+			fmt.Fprintf(flag.CommandLine.Output(), "unknown command %q\n", command)
+			usage()
+			os.Exit(2)
+		}
+		args = args[1:]
+	}
+	_ = flag.CommandLine.Parse(args)
+	if *verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	// Load config
+	config, err := loadConfig(*configFile)
 	if err != nil {
-		return err
+		log.Fatal(err)
+	}
+	if role != "" {
+		config.Role = role
+	}
+	if err := checkRole(config); err != nil {
+		log.Fatal(err)
+	}
+	if config.Log.Format == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+	if *profileName != "" {
+		log.AddHook(profileHook(*profileName))
+	}
+	if *checkConfig {
+		if err := runCheckConfig(config); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	setNodes(config.Nodes)
+	if d := config.Discovery; d.DNS != "" || d.Consul.Address != "" || d.URL != "" {
+		discovery = newNodeDiscovery(config)
+		if err := discovery.refresh(); err != nil {
+			log.Warnf("Unable to discover nodes: %s", err)
+		}
+		go discovery.run(config.Discovery.Refresh)
 	}
 
-	// Create the ICMP message
-	icmpMessage := icmp.Message{
-		Code: 0,
-		Body: &icmp.Echo{ID: id},
+	reg, constLabels := prometheus.DefaultRegisterer, nodeLabels(config)
+	registerMetrics(config, reg)
+	summary = newSweepSummarizer(config.ID, time.Duration(config.Probe.Retries+1)*config.Probe.Timeout+summaryDelay,
+		reg, constLabels)
+	if len(config.Probe.PMTU) > 0 {
+		pmtu = newPathMTUMapper(config.Probe.PMTU, reg, constLabels)
 	}
-	if targetIP.IP.To4() != nil {
-		icmpMessage.Type = ipv4.ICMPTypeEcho
-	} else {
-		icmpMessage.Type = ipv6.ICMPTypeEchoRequest
+	if len(config.Anycast.Prefixes) > 0 {
+		anycast = newAnycastSite(config, reg, constLabels)
+	}
+	if config.Probe.Schedule.Cron != "" || len(config.Probe.Schedule.Windows) > 0 {
+		schedule = newSweepSchedule(config, reg, constLabels)
+	}
+	if config.UI.Enabled {
+		dash = newDashboard(config.UI.Window)
+	}
+	if config.OTLP.Endpoint != "" {
+		otlp = newOTLPExporter(config, reg, constLabels)
+		go otlp.run(config.OTLP.Interval)
+		log.Infof("Exporting metrics to %s every %s", config.OTLP.Endpoint, config.OTLP.Interval)
+	}
+	if config.Push.RemoteWrite != "" || config.Push.Pushgateway != "" {
+		pusher, err = newMetricsPusher(config, reg, constLabels)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go pusher.run(config.Push.Interval)
+		log.Infof("Pushing metrics to %s every %s", pusher.url, config.Push.Interval)
 	}
 
-	bytes, err := icmpMessage.Marshal(nil)
-	if err != nil {
-		return err
+	if interval := watchdogInterval(); interval > 0 {
+		watchdogEvery = interval / 2
+		go runWatchdog()
 	}
 
-	// Send the packet
-	if targetIP.IP.To4() != nil {
-		_, err = pc4.WriteTo(bytes, targetIP)
-	} else {
-		_, err = pc6.WriteTo(bytes, targetIP)
+	// Controllers only aggregate replies streamed from agents, and drop privileges once both listeners are bound
+	if config.Role == roleController {
+		startHTTP(config)
+		l, err := listenController(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := dropPrivileges(config); err != nil {
+			log.Fatalf("unable to drop privileges: %s", err)
+		}
+		atomic.StoreInt32(&listeners, 2)
+		atomic.StoreInt32(&probing, 1)
+		log.Fatal(runController(config, newController(config, reg, constLabels), l))
 	}
-	return err
-}
 
-// readEchoReply reads and parses an ICMP message from an icmp.PacketConn
-func readEchoReply(pc *icmp.PacketConn, nodes map[uint8]string) (*icmp.Echo, net.Addr, error) {
-	reply := make([]byte, 1500)
-	n, src, err := pc.ReadFrom(reply)
+	if err := loadExcludeFiles(); err != nil {
+		log.Fatal(err)
+	}
+	profiles, err = loadProfiles(config)
 	if err != nil {
-		return nil, nil, fmt.Errorf("unable to read from icmp.PacketConn: %s", err)
+		log.Fatal(err)
+	}
+	for _, p := range profiles {
+		if err := p.loadTargets(config); err != nil {
+			log.Fatal(err)
+		}
+		p.metrics = newProbeMetrics(config, reg, p.name)
+	}
+
+	var payloadKey []byte
+	if config.Probe.Secret != "" {
+		payloadKey = []byte(config.Probe.Secret)
 	}
 
-	var proto int
-	if ip := net.ParseIP(pc.LocalAddr().String()); ip.To4() != nil {
-		proto = 1 // ICMP
+	// DSCP is shifted past the two ECN bits
+	tos := config.Probe.TOS
+	if config.Probe.DSCP != 0 {
+		tos = config.Probe.DSCP << 2
+	}
+
+	if *dryRun {
+		log.Info("Dry run enabled, probes will not be sent")
+	}
+	if len(profiles) == 1 {
+		p := profiles[0]
+		log.Infof("Starting go-verfploeter %s id %d source %s probing %d targets at %.2f pps",
+			version, config.ID, strings.Join(p.sourceNames(), ", "),
+			len(p.targets.all()), float64(probeRate(p.config)))
 	} else {
-		proto = 58 // ICMPv6
+		log.Infof("Starting go-verfploeter %s id %d with profiles %s", version, config.ID, strings.Join(profileNames(config), ", "))
+		for _, p := range profiles {
+			p.logger().Infof("Probing %d targets with %s from %s at %.2f pps", len(p.targets.all()),
+				p.config.Probe.Protocol, strings.Join(p.sourceNames(), ", "), float64(probeRate(p.config)))
+		}
 	}
 
-	icmpMessage, err := icmp.ParseMessage(proto, reply[:n])
-	if err != nil {
-		return nil, nil, fmt.Errorf("unable to parse ICMP message: %s", err)
+	// Open ICMP listeners, bound to an interface or a VRF's master device so probes egress it
+	probeDevice = config.Probe.Interface
+	if config.Probe.VRF != "" {
+		if !sockets.isVRF(config.Probe.VRF) {
+			log.Fatalf("probe.vrf %s is not a VRF device", config.Probe.VRF)
+		}
+		probeDevice = config.Probe.VRF
+	}
+	if probeDevice != "" {
+		if _, err := net.InterfaceByName(probeDevice); err != nil {
+			log.Fatalf("unable to find interface %s: %s", probeDevice, err)
+		}
 	}
+	anySource = config.Probe.AnySource
 
-	if icmpMessage.Type != ipv4.ICMPTypeEchoReply && icmpMessage.Type != ipv6.ICMPTypeEchoReply {
-		return nil, nil, fmt.Errorf("unexpected ICMP message type %s", icmpMessage.Type)
+	// Profiles with the same source address share its socket
+	opened := map[string]*verfploeter.Source{}
+	for _, p := range profiles {
+		p.sources.All = p.config.Probe.SourceMode == sourceModeAll
+		addrs := configSources(p.config, p.targets)
+		for _, ipVersion := range []int{4, 6} {
+			for _, addr := range addrs[ipVersion] {
+				key := fmt.Sprintf("%d/%s", ipVersion, addr)
+				if source, ok := opened[key]; ok {
+					p.sources.Add(source)
+					continue
+				}
+				source, err := openSource(ipVersion, addr, probeDevice, config.ID, config.Probe.Unprivileged)
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer source.Conn.Close()
+				if err := setProbeOptions(source.Conn, ipVersion, tos, config.Probe.TTL); err != nil {
+					log.Fatal(err)
+				}
+				if pmtu != nil {
+					if err := sockets.setDontFragment(source.Conn, ipVersion); err != nil {
+						log.Fatalf("unable to set don't fragment on IPv%d probes: %s", ipVersion, err)
+					}
+				}
+				opened[key] = source
+				p.sources.Add(source)
+			}
+		}
 	}
+	minListeners = int32(len(probeSources.List()))
+	filterEchoReplies(config.ID, currentNodes())
 
-	body, ok := icmpMessage.Body.(*icmp.Echo)
-	if !ok {
-		return nil, nil, fmt.Errorf("unable to assert message body as *icmp.Echo (this should never happen): %+v", icmpMessage.Body)
+	// Open raw TCP sockets for SYN probes and their replies
+	if len(config.Probe.Fallback.Protocols) > 0 {
+		fallback = newProbeFallback(config, reg, constLabels)
+		log.Infof("Probing with %s until targets answer", strings.Join(config.Probe.Fallback.Protocols, ", then "))
+	}
+	if usesProtocol(protocolTCP) {
+		tcp4, err = listenRaw("ip4:tcp", config.Probe.Source4, probeDevice)
+		if err != nil {
+			log.Fatalf("unable to open raw IPv4 TCP socket: %s", err)
+		}
+		defer tcp4.Close()
+		tcp6, err = listenRaw("ip6:tcp", config.Probe.Source6, probeDevice)
+		if err != nil {
+			log.Fatalf("unable to open raw IPv6 TCP socket: %s", err)
+		}
+		defer tcp6.Close()
+		if err := ipv6.NewPacketConn(tcp6).SetChecksum(true, 16); err != nil {
+			log.Fatalf("unable to enable IPv6 TCP checksums: %s", err)
+		}
+		if err := setProbeOptions(tcp4, 4, tos, config.Probe.TTL); err != nil {
+			log.Fatal(err)
+		}
+		if err := setProbeOptions(tcp6, 6, tos, config.Probe.TTL); err != nil {
+			log.Fatal(err)
+		}
 	}
-	replies.With(map[string]string{"dst": findNode(uint8(body.ID), nodes)}).Inc()
-	return body, src, nil
-}
 
-func logICMPResponse(echo *icmp.Echo, src net.Addr) {
-	log.Debugf("ICMP echo reply from %s id %d", src, echo.ID)
-}
+	// Open raw UDP sockets for UDP probes and application replies
+	if usesProtocol(protocolUDP) || usesProtocol(protocolChaos) {
+		udp4, err = listenRaw("ip4:udp", config.Probe.Source4, probeDevice)
+		if err != nil {
+			log.Fatalf("unable to open raw IPv4 UDP socket: %s", err)
+		}
+		defer udp4.Close()
+		udp6, err = listenRaw("ip6:udp", config.Probe.Source6, probeDevice)
+		if err != nil {
+			log.Fatalf("unable to open raw IPv6 UDP socket: %s", err)
+		}
+		defer udp6.Close()
+		if err := ipv6.NewPacketConn(udp6).SetChecksum(true, 6); err != nil {
+			log.Fatalf("unable to enable IPv6 UDP checksums: %s", err)
+		}
+		if err := setProbeOptions(udp4, 4, tos, config.Probe.TTL); err != nil {
+			log.Fatal(err)
+		}
+		if err := setProbeOptions(udp6, 6, tos, config.Probe.TTL); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-func main() {
-	flag.Parse()
-	if *verbose {
-		log.SetLevel(log.DebugLevel)
+	// Send IPv4 probes from a spoofed source so replies land at whichever site the target's catchment is
+	if config.Probe.Spoof4 != "" {
+		spoof4, err = newSpoofConn(net.ParseIP(config.Probe.Spoof4), tos, config.Probe.TTL, probeDevice)
+		if err != nil {
+			log.Fatalf("unable to open spoofing socket: %s", err)
+		}
+		spoof4.dontFragment = pmtu != nil
+		defer spoof4.Close()
+		log.Infof("Sending IPv4 probes from %s", config.Probe.Spoof4)
 	}
 
-	// Load config
-	var config Config
-	configBytes, err := os.ReadFile(*configFile)
-	if err != nil {
-		log.Fatalf("unable to read config file: %s", err)
+	// Send echo requests from each source and correlate replies with them
+	for _, source := range probeSources.List() {
+		source.Prober = &verfploeter.Prober{
+			ID:          int(config.ID),
+			Tracker:     tracker,
+			PayloadSize: config.Probe.PayloadSize,
+			Key:         payloadKey,
+		}
+		if source.Proto == 1 && spoof4 != nil {
+			source.Prober.Conn4 = spoofWriter{spoof4, 1}
+		} else if source.Proto == 1 {
+			source.Prober.Conn4 = source.Conn
+		} else {
+			source.Prober.Conn6 = source.Conn
+		}
 	}
-	if err = yaml.Unmarshal(configBytes, &config); err != nil {
-		log.Fatalf("unable to parse config file: %s", err)
+
+	// Send SYNs and datagrams on the raw sockets, the same way
+	if tcp4 != nil {
+		tcpProber = &verfploeter.TCPProber{
+			ID:      int(config.ID),
+			Port:    config.Probe.TCPPort,
+			Conn4:   tcp4,
+			Conn6:   tcp6,
+			Tracker: tracker,
+			Source4: tcpSource,
+		}
+		if spoof4 != nil {
+			tcpProber.Conn4 = spoofWriter{spoof4, 6}
+		}
+		log.Infof("Sending TCP SYN probes to port %d", tcpProber.Port)
+	}
+	if udp4 != nil {
+		udpProber = &verfploeter.UDPProber{
+			ID:       int(config.ID),
+			Port:     config.Probe.UDPPort,
+			Protocol: udpProtocol(),
+			Conn4:    udp4,
+			Conn6:    udp6,
+			Tracker:  tracker,
+		}
+		udpProber.Payload, _ = hex.DecodeString(config.Probe.UDPPayload)
+		if usesProtocol(protocolChaos) {
+			udpProber.Payload, err = chaosQuery(config.Probe.ChaosName)
+			if err != nil {
+				log.Fatalf("invalid probe.chaos_name: %s", err)
+			}
+		}
+		if spoof4 != nil {
+			udpProber.Conn4 = spoofWriter{spoof4, 17}
+		}
+		udpListener = &verfploeter.UDPListener{
+			ID:      config.ID,
+			Port:    udpProber.Port,
+			Tracker: tracker,
+			Nodes:   currentNodes,
+		}
+		log.Infof("Sending %d byte UDP probes to port %d", len(udpProber.Payload), udpProber.Port)
+	}
+	dedup = verfploeter.NewDedup(config.Probe.DedupTTL)
+	listener = &verfploeter.Listener{
+		ID:      config.ID,
+		Tracker: tracker,
+		Dedup:   dedup,
+		Key:     payloadKey,
+		MaxAge:  config.Probe.Timeout,
+		Nodes:   currentNodes,
 	}
 
-	// Load targets
-	targetsBytes, err := os.ReadFile(*targetsFile)
-	if err != nil {
-		log.Fatalf("unable to read targets file: %s", err)
+	// Capture all received ICMP so results can be reconstructed offline with analyze
+	if config.Results.Pcap != "" {
+		capture, err = newPcapWriter(config.Results.Pcap, reg, constLabels)
+		if err != nil {
+			log.Fatalf("unable to open pcap directory: %s", err)
+		}
 	}
-	var targets []string
-	for _, line := range strings.Split(string(targetsBytes), "\n") {
-		if line != "" && !strings.HasPrefix(line, "#") {
-			targets = append(targets, line)
+
+	// Tag replies with the responder's country and origin AS
+	if config.GeoIP.CountryDB != "" || config.GeoIP.ASNDB != "" {
+		geo, err = openGeo(config.GeoIP.CountryDB, config.GeoIP.ASNDB)
+		if err != nil {
+			log.Fatalf("unable to open GeoIP database: %s", err)
 		}
+		defer geo.close()
 	}
 
-	requests = promauto.NewCounter(prometheus.CounterOpts{
-		Name:        "verfploeter_requests",
-		ConstLabels: map[string]string{"src": findNode(config.ID, config.Nodes)},
-	})
-	replies = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Name:        "verfploeter_replies",
-			ConstLabels: map[string]string{"src": findNode(config.ID, config.Nodes)},
-		}, []string{"dst"},
-	)
-
-	log.Infof("Starting go-verfploeter %s id %d source %s and %s probing %d targets every %s",
-		version, config.ID,
-		config.Probe.Source4, config.Probe.Source6,
-		len(targets), config.Probe.Interval)
-
-	// Open ICMP listeners
-	pc4, err = icmp.ListenPacket("ip4:icmp", config.Probe.Source4)
-	if err != nil {
-		log.Fatalf("unable to listen on IPv4: %s", err)
+	// Tag replies with the prefixes this node announces
+	if config.BGP.BIRD != "" || config.BGP.GoBGP != "" {
+		bgp, err = newBGPMonitor(config, reg, constLabels)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go bgp.run(config.BGP.Interval, config.BGP.SweepOnChange)
 	}
-	defer pc4.Close()
 
-	pc6, err = icmp.ListenPacket("ip6:icmp", config.Probe.Source6)
-	if err != nil {
-		log.Fatalf("unable to listen on IPv6: %s", err)
+	// Record replies to per-sweep results files
+	if config.Results.Path != "" {
+		format := config.Results.Format
+		if format == "" {
+			format = formatJSONL
+		}
+		results, err := newResultsWriter(config.Results.Path, format, config.ID, reg, constLabels)
+		if err != nil {
+			log.Fatalf("unable to open results: %s", err)
+		}
+		sinks = append(sinks, results)
+	}
+
+	// Log every reply separately from the process log
+	if replies := config.Log.Replies; replies.Path != "" || replies.Syslog != "" {
+		replyLog, err := newReplyLog(replies.Path, replies.Syslog, replies.MaxSize, replies.MaxBackups, replies.MaxAge)
+		if err != nil {
+			log.Fatalf("unable to open reply log: %s", err)
+		}
+		sinks = append(sinks, replyLog)
+	}
+
+	// Insert replies into ClickHouse
+	if config.ClickHouse.DSN != "" {
+		clickhouse, err := newClickhouseSink(config.ClickHouse.DSN, config.ClickHouse.Table,
+			config.ClickHouse.BatchSize, config.ClickHouse.FlushInterval, reg, constLabels)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sinks = append(sinks, clickhouse)
+	}
+
+	// Publish replies to message buses
+	if len(config.Publish.Kafka.Brokers) > 0 {
+		sinks = append(sinks, newPublisherSink("kafka",
+			newKafkaPublisher(config.Publish.Kafka.Brokers, config.Publish.Kafka.Topic), reg, constLabels))
+	}
+	if config.Publish.NATS.URL != "" {
+		p, err := newNATSPublisher(config.Publish.NATS.URL, config.Publish.NATS.Subject)
+		if err != nil {
+			log.Fatalf("Unable to connect to NATS: %s", err)
+		}
+		sinks = append(sinks, newPublisherSink("nats", p, reg, constLabels))
+	}
+
+	// Keep recent replies for the web UI
+	if dash != nil {
+		sinks = append(sinks, dash)
+	}
+	sinks = append(sinks, summary)
+
+	// Stream replies to the controller
+	if config.Controller.Address != "" {
+		agent := newAgentClient(config.Controller.Address, config.Controller.Token, reg, constLabels)
+		go agent.run()
+		sinks = append(sinks, agent)
 	}
-	defer pc6.Close()
 
-	// Start IPv4 echo listener
+	// Map the forward path to a sample of targets
+	if config.Traceroute.Interval > 0 && config.Role != roleCollector && !*dryRun {
+		tracer, err = newPathTracer(config, reg, constLabels)
+		if err != nil {
+			log.Fatalf("unable to start traceroute: %s", err)
+		}
+		go tracer.run(config.Traceroute.Interval)
+		log.Infof("Tracing the paths to %d targets every %s", config.Traceroute.Sample, config.Traceroute.Interval)
+	}
+
+	// Probe targets that keep timing out less often
+	if config.Probe.Backoff.After > 0 {
+		backoff = newTargetBackoff(config.ID, config.Probe.Backoff.After, config.Probe.Backoff.Recheck, reg, constLabels)
+	}
+
+	// Start echo listeners
+	listenAll()
+
+	// Retransmit probes that time out until they run out of retries, then count them as lost against the
+	// profile that sent them. Replies caught by other anycast sites never reach this node, so loss here is
+	// relative to this node's catchment.
 	go func() {
-		for {
-			reply, src, err := readEchoReply(pc4, config.Nodes)
-			if err != nil {
-				log.Warn(err)
-				continue
+		timeout := config.Probe.Timeout
+		for range time.Tick(timeout / 2) {
+			expired := map[*probeProfile]int{}
+			for _, probe := range tracker.ExpireOutstanding(timeout) {
+				p, ok := findProfile(probe.Tag)
+				if !ok {
+					p = profiles[0]
+				}
+				p.metrics.probeTimeouts.Inc()
+				retry := probeTarget{target: probe.Target, sweep: probe.Sweep, attempt: probe.Attempt + 1, size: probe.Size, protocol: probe.Protocol}
+				if fallback != nil && retry.protocol == "" {
+					retry.protocol = protocolICMP // Echo requests are tracked without a protocol
+				}
+				if probe.Attempt >= config.Probe.Retries && fallback != nil {
+					// Out of retries, so move on to the next protocol for the target
+					var ok bool
+					if retry.protocol, ok = fallback.next(probe.Target, retry.protocol); ok {
+						retry.attempt, retry.size = 0, 0
+					}
+				}
+				if retry.attempt <= config.Probe.Retries && probe.Target != "" && atomic.LoadInt32(&draining) == 0 {
+					select {
+					case p.retries <- retry:
+						continue
+					default:
+					}
+				}
+				expired[p]++
+				if backoff != nil && probe.Target != "" {
+					backoff.lost(probe.Target)
+				}
+			}
+
+			// Loss over the probes that were answered or given up on since the last tick
+			for _, p := range profiles {
+				p.metrics.lost.Add(float64(expired[p]))
+				answered := atomic.SwapUint64(&p.answered, 0)
+				if resolved := float64(answered) + float64(expired[p]); resolved > 0 {
+					p.metrics.lossRatio.Set(float64(expired[p]) / resolved)
+				}
 			}
-			logICMPResponse(reply, src)
 		}
 	}()
 
-	// Start IPv4 echo listener
-	go func() {
-		for {
-			reply, src, err := readEchoReply(pc6, config.Nodes)
-			if err != nil {
-				log.Warn(err)
-				continue
+	// Forget counted replies once duplicates of them are no longer expected
+	go dedup.Run(nil)
+
+	// Report the prober as unhealthy if it falls well behind the rate of its slowest profile
+	if config.Role != roleCollector {
+		stale := time.Minute
+		for _, p := range profiles {
+			if d := time.Duration(10 * float64(time.Second) / float64(probeRate(p.config))); d > stale {
+				stale = d
 			}
-			logICMPResponse(reply, src)
 		}
+		atomic.StoreInt64(&probeStale, int64(stale))
+	}
+
+	// Start metrics listener and tell systemd once the echo listeners are running
+	startHTTP(config)
+	if err := dropPrivileges(config); err != nil {
+		log.Fatalf("unable to drop privileges: %s", err)
+	}
+	go notifyReady()
+
+	// Resolve hostname targets in the background so probes don't wait on DNS, and keep them fresh
+	resolver.ttl = config.Probe.ResolveTTL
+	go func() {
+		resolver.resolve(allTargets())
+		resolver.run()
 	}()
 
-	// Start metrics listener
+	for _, p := range profiles {
+		if *watch {
+			if err := watchTargets(p.targets, p.files); err != nil {
+				log.Fatalf("unable to watch targets files: %s", err)
+			}
+		}
+		for _, filename := range p.files {
+			if isURL(filename) {
+				go refreshTargets(p.targets, p.files, p.config.Targets.Refresh)
+				break
+			}
+		}
+	}
+
+	// Reload config and targets on SIGHUP once probing starts, keeping the sockets and metrics
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for _, p := range profiles {
+		if err := p.start(); err != nil {
+			log.Fatal(err)
+		}
+	}
 	go func() {
-		http.Handle("/metrics", promhttp.Handler())
-		log.Fatal(http.ListenAndServe(config.Listen, nil))
+		for range sighup {
+			log.Infof("Reloading config from %s", *configFile)
+			newConfig, err := loadConfig(*configFile)
+			if err != nil {
+				log.Warnf("Keeping current config: %s", err)
+			} else {
+				if role != "" {
+					newConfig.Role = role
+				}
+				reloadConfig(config, newConfig)
+			}
+			for _, p := range profiles {
+				p.reload(newConfig)
+			}
+		}
 	}()
 
-	// Send the probes on a ticker
-	probeTicker := time.NewTicker(config.Probe.Interval)
-	for ; true; <-probeTicker.C { // Tick once at start
-		// Pick random target
-		target := targets[rand.Intn(len(targets))]
-		log.Debugf("Sending probe to %s", target)
-		requests.Inc()
-		if err := icmpProbe(target, int(config.ID)); err != nil {
-			log.Warn(err)
+	// Stop probing on SIGINT or SIGTERM and drain outstanding replies, so restarts don't lose the tail of a sweep
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	interrupted := ctx
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	if config.Role == roleCollector {
+		log.Info("Running as a collector, not sending probes")
+		atomic.StoreInt32(&probing, 1)
+		<-ctx.Done()
+	} else {
+		atomic.StoreInt64(&probesLeft, int64(*count))
+		var running sync.WaitGroup
+		for _, p := range profiles {
+			running.Add(1)
+			go func(p *probeProfile) {
+				defer running.Done()
+				p.run(ctx)
+			}(p)
 		}
+		running.Wait()
+	}
+
+	// Finish sending and give the last probes a chance to be answered. A second signal exits immediately.
+	if interrupted.Err() != nil {
+		log.Info("Interrupted, stopping probes")
+	}
+	stop()
+	atomic.StoreInt32(&draining, 1)
+	sdNotify("STOPPING=1")
+	log.Infof("Waiting %s for outstanding replies", config.Probe.Drain)
+	time.Sleep(config.Probe.Drain)
+	for _, sink := range sinks {
+		sink.close()
+	}
+	if capture != nil {
+		capture.close()
+	}
+	if otlp != nil {
+		otlp.close()
+	}
+	if pusher != nil {
+		pusher.close()
 	}
+	log.WithFields(log.Fields{
+		"requests": atomic.LoadUint64(&sentTotal),
+		"replies":  atomic.LoadUint64(&repliesTotal),
+	}).Info("Probing finished")
 }
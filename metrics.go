@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics shared by every profile, about replies that can't be told apart by profile
+var (
+	unsolicited        prometheus.Counter
+	unsolicitedReplies prometheus.Counter
+	resolveErrors      *prometheus.CounterVec
+	chaosSites         *prometheus.CounterVec
+	geoReplies         *prometheus.CounterVec
+	badSignatures      prometheus.Counter
+	duplicates         prometheus.Counter
+)
+
+// probeMetrics are the metrics of the probes sent by a profile and the replies to them
+type probeMetrics struct {
+	requests       prometheus.Counter
+	replies        *prometheus.CounterVec
+	rtt            *prometheus.HistogramVec
+	icmpErrors     *prometheus.CounterVec
+	lost           prometheus.Counter
+	probeTimeouts  prometheus.Counter
+	lossRatio      prometheus.Gauge
+	sendErrors     *prometheus.CounterVec
+	probeErrors    *prometheus.CounterVec
+	hops           *prometheus.HistogramVec
+	sourceRequests *prometheus.CounterVec
+	sourceReplies  *prometheus.CounterVec
+}
+
+// defaultRTTBuckets covers 500us to ~4s in powers of two
+var defaultRTTBuckets = prometheus.ExponentialBuckets(0.0005, 2, 14)
+
+// checkRTTBuckets checks that RTT histogram buckets are strictly increasing, which Prometheus requires
+func checkRTTBuckets(buckets []float64) error {
+	for i, b := range buckets {
+		if i > 0 && !(b > buckets[i-1]) {
+			return fmt.Errorf("metrics.rtt_buckets must be strictly increasing, but %g follows %g", b, buckets[i-1])
+		}
+	}
+	return nil
+}
+
+// startTime is when the process started, for verfploeter_uptime_seconds and the first probe's health check
+var startTime = time.Now()
+
+// Probe error classes, kept coarse to bound the cardinality of verfploeter_probe_errors_total. The send error
+// categories of verfploeter_send_errors_total are the same, except that no source counts as a write error.
+const (
+	probeErrorResolve  = "resolve"
+	probeErrorMarshal  = "marshal"
+	probeErrorWrite    = "write"
+	probeErrorNoSource = "no_source"
+)
+
+// countProbeError increments the probe and send error counters for a class and the family of the target's
+// address, which is nil if it didn't resolve
+func (m *probeMetrics) countProbeError(class string, ip net.IP) {
+	category := class
+	if class == probeErrorNoSource {
+		category = probeErrorWrite
+	}
+	m.sendErrors.With(map[string]string{"category": category}).Inc()
+
+	family := "unknown"
+	if ip.To4() != nil {
+		family = "ipv4"
+	} else if ip != nil {
+		family = "ipv6"
+	}
+	m.probeErrors.With(map[string]string{"class": class, "family": family}).Inc()
+}
+
+// nodeLabels returns the labels of every metric, which are this node's ID and name and the profile given
+// with -profile
+func nodeLabels(config *Config) prometheus.Labels {
+	labels := prometheus.Labels{
+		"src":    findNode(config.ID, currentNodes()),
+		"src_id": strconv.Itoa(int(config.ID)),
+	}
+	if *profileName != "" {
+		labels["profile"] = *profileName
+	}
+	return labels
+}
+
+// withLabel returns a copy of labels with another label added
+func withLabel(labels prometheus.Labels, name, value string) prometheus.Labels {
+	l := prometheus.Labels{name: value}
+	for k, v := range labels {
+		l[k] = v
+	}
+	return l
+}
+
+// registerMetrics registers the metrics shared by every profile with reg, labeled with this node's ID and name
+func registerMetrics(config *Config, reg prometheus.Registerer) {
+	constLabels := nodeLabels(config)
+	factory := promauto.With(reg)
+
+	unsolicited = factory.NewCounter(prometheus.CounterOpts{
+		Name:        "verfploeter_unsolicited_total",
+		ConstLabels: constLabels,
+	})
+	unsolicitedReplies = factory.NewCounter(prometheus.CounterOpts{
+		Name:        "verfploeter_unsolicited_replies_total",
+		ConstLabels: constLabels,
+	})
+	duplicates = factory.NewCounter(prometheus.CounterOpts{
+		Name:        "verfploeter_duplicate_replies_total",
+		ConstLabels: constLabels,
+	})
+	badSignatures = factory.NewCounter(prometheus.CounterOpts{
+		Name:        "verfploeter_bad_signatures_total",
+		ConstLabels: constLabels,
+	})
+	resolveErrors = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "verfploeter_resolve_errors_total",
+			ConstLabels: constLabels,
+		}, []string{"reason"},
+	)
+	chaosSites = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "verfploeter_chaos_replies",
+			ConstLabels: constLabels,
+		}, []string{"site"},
+	)
+	geoReplies = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "verfploeter_geo_replies",
+			ConstLabels: constLabels,
+		}, []string{"country", "dst"},
+	)
+	factory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:        "verfploeter_build_info",
+			ConstLabels: constLabels,
+		}, []string{"version", "goversion"},
+	).With(map[string]string{"version": version, "goversion": runtime.Version()}).Set(1)
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "verfploeter_uptime_seconds",
+		ConstLabels: constLabels,
+	}, func() float64 {
+		return time.Since(startTime).Seconds()
+	})
+}
+
+// newProbeMetrics registers the metrics of a profile's probes with reg, labeled with this node's ID and name
+// and the profile if it has a name
+func newProbeMetrics(config *Config, reg prometheus.Registerer, profile string) *probeMetrics {
+	constLabels := nodeLabels(config)
+	if profile != "" {
+		constLabels = withLabel(constLabels, "profile", profile)
+	}
+	factory := promauto.With(reg)
+
+	m := &probeMetrics{}
+	m.requests = factory.NewCounter(prometheus.CounterOpts{
+		Name:        "verfploeter_requests",
+		ConstLabels: constLabels,
+	})
+	m.replies = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "verfploeter_replies",
+			ConstLabels: constLabels,
+		}, []string{"dst"},
+	)
+	m.icmpErrors = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "verfploeter_icmp_errors",
+			ConstLabels: constLabels,
+		}, []string{"type", "code", "dst"},
+	)
+	m.lost = factory.NewCounter(prometheus.CounterOpts{
+		Name:        "verfploeter_lost_total",
+		ConstLabels: constLabels,
+	})
+	m.probeTimeouts = factory.NewCounter(prometheus.CounterOpts{
+		Name:        "verfploeter_probe_timeouts_total",
+		ConstLabels: constLabels,
+	})
+	m.lossRatio = factory.NewGauge(prometheus.GaugeOpts{
+		Name:        "verfploeter_probe_loss_ratio",
+		ConstLabels: constLabels,
+	})
+	m.sendErrors = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "verfploeter_send_errors_total",
+			ConstLabels: constLabels,
+		}, []string{"category"},
+	)
+	m.probeErrors = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "verfploeter_probe_errors_total",
+			ConstLabels: constLabels,
+		}, []string{"class", "family"},
+	)
+	rttBuckets := config.Metrics.RTTBuckets
+	if len(rttBuckets) == 0 {
+		rttBuckets = defaultRTTBuckets
+	}
+	m.rtt = factory.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:        "verfploeter_rtt_seconds",
+			Buckets:     rttBuckets,
+			ConstLabels: constLabels,
+		}, []string{"dst", "family"},
+	)
+	m.hops = factory.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:        "verfploeter_reply_hops",
+			Buckets:     prometheus.LinearBuckets(2, 2, 16),
+			ConstLabels: constLabels,
+		}, []string{"dst", "family"},
+	)
+	m.sourceRequests = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "verfploeter_source_requests_total",
+			ConstLabels: constLabels,
+		}, []string{"source"},
+	)
+	m.sourceReplies = factory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "verfploeter_source_replies_total",
+			ConstLabels: constLabels,
+		}, []string{"source"},
+	)
+	return m
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestRegisterMetrics(t *testing.T) {
+	setNodes(map[uint16]string{10: "ams"})
+	defer setNodes(nil)
+	reg := prometheus.NewRegistry()
+	registerMetrics(&Config{ID: 10}, reg)
+	m := newProbeMetrics(&Config{ID: 10}, reg, "")
+	m.requests.Add(3)
+	m.replies.With(map[string]string{"dst": "ams"}).Inc()
+
+	w := httptest.NewRecorder()
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, series := range []string{
+		`verfploeter_requests{src="ams",src_id="10"} 3`,
+		`verfploeter_replies{dst="ams",src="ams",src_id="10"} 1`,
+		`verfploeter_lost_total{src="ams",src_id="10"} 0`,
+		`verfploeter_unsolicited_total{src="ams",src_id="10"} 0`,
+		`verfploeter_build_info{goversion=`,
+		`verfploeter_uptime_seconds{src="ams",src_id="10"}`,
+	} {
+		if !strings.Contains(body, series) {
+			t.Errorf("missing series %s in:\n%s", series, body)
+		}
+	}
+}
+
+func TestRegisterProfileMetrics(t *testing.T) {
+	setNodes(map[uint16]string{10: "ams"})
+	defer setNodes(nil)
+	reg := prometheus.NewRegistry()
+	registerMetrics(&Config{ID: 10}, reg)
+	newProbeMetrics(&Config{ID: 10}, reg, "v4").requests.Add(2)
+	newProbeMetrics(&Config{ID: 10}, reg, "v6").requests.Inc()
+
+	w := httptest.NewRecorder()
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, series := range []string{
+		`verfploeter_requests{profile="v4",src="ams",src_id="10"} 2`,
+		`verfploeter_requests{profile="v6",src="ams",src_id="10"} 1`,
+		`verfploeter_unsolicited_total{src="ams",src_id="10"} 0`,
+	} {
+		if !strings.Contains(body, series) {
+			t.Errorf("missing series %s in:\n%s", series, body)
+		}
+	}
+}
+
+// descRegisterer records the descriptions of the metrics registered through it
+type descRegisterer struct {
+	prometheus.Registerer
+	descs []string
+}
+
+func (r *descRegisterer) Register(c prometheus.Collector) error {
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		c.Describe(ch)
+		close(ch)
+	}()
+	for desc := range ch {
+		r.descs = append(r.descs, desc.String())
+	}
+	return r.Registerer.Register(c)
+}
+
+func (r *descRegisterer) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestRegisterFeatureMetrics(t *testing.T) {
+	setNodes(map[uint16]string{10: "ams"})
+	defer setNodes(nil)
+	config := &Config{ID: 10}
+	config.BGP.BIRD = filepath.Join(t.TempDir(), "bird.ctl")
+	reg := &descRegisterer{Registerer: prometheus.NewRegistry()}
+	constLabels := nodeLabels(config)
+
+	// The traceroute metrics aren't covered, since the tracer opens raw sockets
+	newAnycastSite(config, reg, constLabels)
+	newTargetBackoff(config.ID, 3, 10, reg, constLabels)
+	if _, err := newBGPMonitor(config, reg, constLabels); err != nil {
+		t.Fatal(err)
+	}
+	newController(config, reg, constLabels)
+	if _, err := newClickhouseSink("http://localhost:8123/", "replies", 100, time.Hour, reg, constLabels); err != nil {
+		t.Fatal(err)
+	}
+	newAgentClient("localhost:9000", "secret", reg, constLabels)
+	newProbeFallback(config, reg, constLabels)
+	newOTLPExporter(config, reg, constLabels)
+	if _, err := newPcapWriter(t.TempDir(), reg, constLabels); err != nil {
+		t.Fatal(err)
+	}
+	newPathMTUMapper([]int{1500}, reg, constLabels)
+	newPublisherSink("nats", nil, reg, constLabels)
+	if _, err := newMetricsPusher(config, reg, constLabels); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newResultsWriter(t.TempDir(), formatJSONL, config.ID, reg, constLabels); err != nil {
+		t.Fatal(err)
+	}
+	newSweepSchedule(config, reg, constLabels)
+	newSweepSummarizer(config.ID, time.Second, reg, constLabels)
+
+	registered := map[string]bool{}
+	for _, desc := range reg.descs {
+		if !strings.Contains(desc, `src="ams"`) || !strings.Contains(desc, `src_id="10"`) {
+			t.Errorf("metric isn't labeled with the node: %s", desc)
+		}
+		registered[desc[strings.Index(desc, `"`)+1:strings.Index(desc, `",`)]] = true
+	}
+	for _, name := range []string{
+		"verfploeter_anycast_replies_total",
+		"verfploeter_backoff_targets",
+		"verfploeter_backoff_skipped_total",
+		"verfploeter_bgp_announced",
+		"verfploeter_bgp_changes_total",
+		"verfploeter_bgp_errors_total",
+		"verfploeter_catchment_replies",
+		"verfploeter_catchment_changes_total",
+		"verfploeter_catchment_shift_ratio",
+		"verfploeter_catchment_alerts_total",
+		"verfploeter_clickhouse_dropped_total",
+		"verfploeter_clickhouse_errors_total",
+		"verfploeter_agent_dropped_total",
+		"verfploeter_fallback_probes_total",
+		"verfploeter_otlp_errors_total",
+		"verfploeter_pcap_dropped_total",
+		"verfploeter_path_mtu_targets",
+		"verfploeter_path_mtu_blackholes",
+		"verfploeter_publish_dropped_total",
+		"verfploeter_publish_errors_total",
+		"verfploeter_push_errors_total",
+		"verfploeter_results_dropped_total",
+		"verfploeter_next_sweep_timestamp_seconds",
+		"verfploeter_catchment_share",
+		"verfploeter_sweep_targets",
+		"verfploeter_sweep_responders",
+		"verfploeter_sweep_loss_ratio",
+	} {
+		if !registered[name] {
+			t.Errorf("%s isn't registered with the given registerer", name)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// OTLP aggregation temporality of Prometheus counters and histograms
+const otlpCumulative = 2
+
+// OTLP span kind of sweep spans
+const otlpSpanInternal = 1
+
+// otlpExporter pushes the Prometheus metrics, and optionally a span per sweep, to an OpenTelemetry collector
+// over OTLP/HTTP with JSON encoding. Metrics are exported as cumulative sums, gauges, and histograms.
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+	resource otlpResource
+	start    time.Time
+	errors   prometheus.Counter
+
+	// Sweep in progress when exporting traces
+	traces  bool
+	lock    sync.Mutex
+	current *otlpSpan
+}
+
+// otlp is nil unless an OTLP endpoint is configured
+var otlp *otlpExporter
+
+// OTLP JSON messages, see https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding. 64-bit integers
+// are encoded as strings.
+type (
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		String *string `json:"stringValue,omitempty"`
+		Int    *string `json:"intValue,omitempty"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+
+	otlpMetricsRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpMetric struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description,omitempty"`
+		Sum         *otlpSum       `json:"sum,omitempty"`
+		Gauge       *otlpGauge     `json:"gauge,omitempty"`
+		Histogram   *otlpHistogram `json:"histogram,omitempty"`
+		Summary     *otlpSummary   `json:"summary,omitempty"`
+	}
+	otlpSum struct {
+		DataPoints             []otlpNumberPoint `json:"dataPoints"`
+		AggregationTemporality int               `json:"aggregationTemporality"`
+		IsMonotonic            bool              `json:"isMonotonic"`
+	}
+	otlpGauge struct {
+		DataPoints []otlpNumberPoint `json:"dataPoints"`
+	}
+	otlpHistogram struct {
+		DataPoints             []otlpHistogramPoint `json:"dataPoints"`
+		AggregationTemporality int                  `json:"aggregationTemporality"`
+	}
+	otlpSummary struct {
+		DataPoints []otlpSummaryPoint `json:"dataPoints"`
+	}
+	otlpNumberPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		AsDouble          float64         `json:"asDouble"`
+	}
+	otlpHistogramPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		Count             string          `json:"count"`
+		Sum               float64         `json:"sum"`
+		BucketCounts      []string        `json:"bucketCounts"`
+		ExplicitBounds    []float64       `json:"explicitBounds"`
+	}
+	otlpSummaryPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		Count             string          `json:"count"`
+		Sum               float64         `json:"sum"`
+		QuantileValues    []otlpQuantile  `json:"quantileValues"`
+	}
+	otlpQuantile struct {
+		Quantile float64 `json:"quantile"`
+		Value    float64 `json:"value"`
+	}
+
+	otlpTracesRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes"`
+
+		sweep  uint32
+		probes int
+	}
+)
+
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{String: &value}}
+}
+
+func otlpInt(key string, value int64) otlpAttribute {
+	s := strconv.FormatInt(value, 10)
+	return otlpAttribute{Key: key, Value: otlpValue{Int: &s}}
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// otlpID returns a random trace or span ID of n bytes
+func otlpID(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newOTLPExporter creates an exporter for an OTLP/HTTP endpoint such as http://otel-collector:4318
+func newOTLPExporter(config *Config, reg prometheus.Registerer, constLabels prometheus.Labels) *otlpExporter {
+	factory := promauto.With(reg)
+	return &otlpExporter{
+		endpoint: strings.TrimSuffix(config.OTLP.Endpoint, "/"),
+		headers:  config.OTLP.Headers,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		resource: otlpResource{Attributes: []otlpAttribute{
+			otlpString("service.name", "verfploeter"),
+			otlpString("service.version", version),
+			otlpString("service.instance.id", findNode(config.ID, currentNodes())),
+			otlpInt("verfploeter.node_id", int64(config.ID)),
+			otlpString("verfploeter.role", config.Role),
+		}},
+		start:  time.Now(),
+		traces: config.OTLP.Traces,
+		errors: factory.NewCounter(prometheus.CounterOpts{
+			Name:        "verfploeter_otlp_errors_total",
+			ConstLabels: constLabels,
+		}),
+	}
+}
+
+// run exports the metrics every interval
+func (e *otlpExporter) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		e.exportMetrics()
+	}
+}
+
+// close ends the sweep in progress and exports the final metrics
+func (e *otlpExporter) close() {
+	e.lock.Lock()
+	span := e.current
+	e.current = nil
+	e.lock.Unlock()
+	if span != nil {
+		e.exportSpan(span)
+	}
+	e.exportMetrics()
+}
+
+// sweep is called for every probe, ending the span of the previous sweep and starting a new one when the
+// sweep number changes. Probes outside of sweeps are ignored.
+func (e *otlpExporter) sweep(sweep uint32) {
+	if !e.traces || sweep == 0 {
+		return
+	}
+	e.lock.Lock()
+	if e.current != nil && e.current.sweep == sweep {
+		e.current.probes++
+		e.lock.Unlock()
+		return
+	}
+	ended := e.current
+	e.current = &otlpSpan{
+		TraceID:           otlpID(16),
+		SpanID:            otlpID(8),
+		Name:              "sweep",
+		Kind:              otlpSpanInternal,
+		StartTimeUnixNano: otlpTime(time.Now()),
+		sweep:             sweep,
+		probes:            1,
+	}
+	e.lock.Unlock()
+	if ended != nil {
+		go e.exportSpan(ended)
+	}
+}
+
+// exportSpan ends a sweep span and sends it
+func (e *otlpExporter) exportSpan(span *otlpSpan) {
+	span.EndTimeUnixNano = otlpTime(time.Now())
+	span.Attributes = []otlpAttribute{
+		otlpInt("verfploeter.sweep", int64(span.sweep)),
+		otlpInt("verfploeter.probes", int64(span.probes)),
+	}
+	e.post("/v1/traces", otlpTracesRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: e.resource,
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "verfploeter", Version: version},
+			Spans: []otlpSpan{*span},
+		}},
+	}}})
+}
+
+// exportMetrics sends the current value of every registered metric
+func (e *otlpExporter) exportMetrics() {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		log.Warnf("Unable to gather metrics for OTLP: %s", err)
+	}
+	now := time.Now()
+	var metrics []otlpMetric
+	for _, family := range families {
+		if m, ok := e.convert(family, now); ok {
+			metrics = append(metrics, m)
+		}
+	}
+	e.post("/v1/metrics", otlpMetricsRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: e.resource,
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: "verfploeter", Version: version},
+			Metrics: metrics,
+		}},
+	}}})
+}
+
+// convert maps a Prometheus metric family to an OTLP metric, with labels as attributes
+func (e *otlpExporter) convert(family *dto.MetricFamily, now time.Time) (otlpMetric, bool) {
+	m := otlpMetric{Name: family.GetName(), Description: family.GetHelp()}
+	start, ts := otlpTime(e.start), otlpTime(now)
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		m.Sum = &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+		for _, metric := range family.Metric {
+			m.Sum.DataPoints = append(m.Sum.DataPoints, otlpNumberPoint{
+				Attributes:        otlpLabels(metric),
+				StartTimeUnixNano: start,
+				TimeUnixNano:      ts,
+				AsDouble:          metric.GetCounter().GetValue(),
+			})
+		}
+	case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+		m.Gauge = &otlpGauge{}
+		for _, metric := range family.Metric {
+			value := metric.GetGauge().GetValue()
+			if family.GetType() == dto.MetricType_UNTYPED {
+				value = metric.GetUntyped().GetValue()
+			}
+			m.Gauge.DataPoints = append(m.Gauge.DataPoints, otlpNumberPoint{
+				Attributes:   otlpLabels(metric),
+				TimeUnixNano: ts,
+				AsDouble:     value,
+			})
+		}
+	case dto.MetricType_HISTOGRAM:
+		m.Histogram = &otlpHistogram{AggregationTemporality: otlpCumulative}
+		for _, metric := range family.Metric {
+			h := metric.GetHistogram()
+			point := otlpHistogramPoint{
+				Attributes:        otlpLabels(metric),
+				StartTimeUnixNano: start,
+				TimeUnixNano:      ts,
+				Count:             strconv.FormatUint(h.GetSampleCount(), 10),
+				Sum:               h.GetSampleSum(),
+			}
+
+			// Prometheus buckets are cumulative, OTLP buckets count only the samples within them
+			var below uint64
+			for _, bucket := range h.Bucket {
+				if math.IsInf(bucket.GetUpperBound(), 1) {
+					continue
+				}
+				point.ExplicitBounds = append(point.ExplicitBounds, bucket.GetUpperBound())
+				point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(bucket.GetCumulativeCount()-below, 10))
+				below = bucket.GetCumulativeCount()
+			}
+			point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(h.GetSampleCount()-below, 10))
+			m.Histogram.DataPoints = append(m.Histogram.DataPoints, point)
+		}
+	case dto.MetricType_SUMMARY:
+		m.Summary = &otlpSummary{}
+		for _, metric := range family.Metric {
+			s := metric.GetSummary()
+			point := otlpSummaryPoint{
+				Attributes:        otlpLabels(metric),
+				StartTimeUnixNano: start,
+				TimeUnixNano:      ts,
+				Count:             strconv.FormatUint(s.GetSampleCount(), 10),
+				Sum:               s.GetSampleSum(),
+			}
+			for _, q := range s.Quantile {
+				point.QuantileValues = append(point.QuantileValues, otlpQuantile{q.GetQuantile(), q.GetValue()})
+			}
+			m.Summary.DataPoints = append(m.Summary.DataPoints, point)
+		}
+	default:
+		return m, false
+	}
+	return m, true
+}
+
+func otlpLabels(metric *dto.Metric) []otlpAttribute {
+	var attributes []otlpAttribute
+	for _, label := range metric.Label {
+		attributes = append(attributes, otlpString(label.GetName(), label.GetValue()))
+	}
+	return attributes
+}
+
+// post sends a request to the collector, counting and logging failures
+func (e *otlpExporter) post(path string, v interface{}) {
+	if err := e.send(path, v); err != nil {
+		e.errors.Inc()
+		log.Warnf("Unable to export to OTLP collector: %s", err)
+	}
+}
+
+func (e *otlpExporter) send(path string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/natesales/go-verfploeter/pkg/verfploeter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Raw sockets return ICMP messages without the IPv4 header (and never with the IPv6 header), so captured
+// packets get a rebuilt IP header with the source, the local address of the socket, and the received TTL,
+// or a placeholder if it isn't known.
+const pcapTTL = 64
+
+// capturedPacket is an ICMP message read by a listener
+type capturedPacket struct {
+	time  time.Time
+	src   net.IP
+	dst   net.IP
+	proto int
+	ttl   int
+	data  []byte
+}
+
+// pcapWriter writes every ICMP message received to a pcap file per sweep of the node that sent the probe,
+// with other messages going to the file of the last sweep seen. Packets are written from a single
+// goroutine and dropped if it falls behind.
+type pcapWriter struct {
+	dir     string
+	packets chan capturedPacket
+	done    chan struct{}
+	dropped prometheus.Counter
+
+	lock   sync.RWMutex
+	closed bool
+
+	// Owned by the writer goroutine
+	file  *os.File
+	w     *pcapgo.Writer
+	sweep uint32
+}
+
+func newPcapWriter(dir string, reg prometheus.Registerer, constLabels prometheus.Labels) (*pcapWriter, error) {
+	factory := promauto.With(reg)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	w := &pcapWriter{
+		dir:     dir,
+		packets: make(chan capturedPacket, 4096),
+		done:    make(chan struct{}),
+		dropped: factory.NewCounter(prometheus.CounterOpts{
+			Name:        "verfploeter_pcap_dropped_total",
+			ConstLabels: constLabels,
+		}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// hook returns a verfploeter.Listener Capture hook that queues ICMP messages received at local to be written
+func (w *pcapWriter) hook(local net.IP) func(b []byte, src net.Addr, proto, ttl int) {
+	return func(b []byte, src net.Addr, proto, ttl int) {
+		var ip net.IP
+		if addr, ok := src.(*net.IPAddr); ok {
+			ip = addr.IP
+		} else if addr, ok := src.(*net.UDPAddr); ok {
+			ip = addr.IP
+		}
+		w.lock.RLock()
+		defer w.lock.RUnlock()
+		if w.closed {
+			return
+		}
+		select {
+		case w.packets <- capturedPacket{time.Now(), ip, local, proto, ttl, b}:
+		default:
+			w.dropped.Inc()
+		}
+	}
+}
+
+// close writes all queued packets and closes the current file, ignoring packets captured after
+func (w *pcapWriter) close() {
+	w.lock.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.packets)
+	}
+	w.lock.Unlock()
+	<-w.done
+}
+
+func (w *pcapWriter) run() {
+	defer close(w.done)
+	for p := range w.packets {
+		if err := w.writePacket(p); err != nil {
+			log.Warnf("Unable to write to pcap: %s", err)
+		}
+	}
+	if w.file != nil {
+		w.file.Close()
+	}
+}
+
+// open switches to the pcap file for a sweep, appending if it already exists
+func (w *pcapWriter) open(sweep uint32) error {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	filename := filepath.Join(w.dir, "replies.pcap")
+	if sweep != 0 {
+		filename = filepath.Join(w.dir, fmt.Sprintf("sweep-%d.pcap", sweep))
+	}
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	log.Debugf("Writing packets to %s", filename)
+
+	w.file = file
+	w.w = pcapgo.NewWriter(file)
+	w.sweep = sweep
+	if info.Size() == 0 {
+		return w.w.WriteFileHeader(65535, layers.LinkTypeRaw)
+	}
+	return nil
+}
+
+func (w *pcapWriter) writePacket(p capturedPacket) error {
+	sweep := w.sweep
+	if msg, err := icmp.ParseMessage(p.proto, p.data); err == nil {
+		if echo, ok := msg.Body.(*icmp.Echo); ok && (msg.Type == ipv4.ICMPTypeEchoReply || msg.Type == ipv6.ICMPTypeEchoReply) {
+			if payload, ok := verfploeter.ParsePayload(echo.Data); ok {
+				sweep = payload.Sweep
+			}
+		}
+	}
+	if w.file == nil || sweep != w.sweep {
+		if err := w.open(sweep); err != nil {
+			return err
+		}
+	}
+
+	ttl := p.ttl
+	if ttl == 0 {
+		ttl = pcapTTL
+	}
+	var packet []byte
+	if p.proto == 1 {
+		packet = ipv4Packet(p.src.To4(), p.dst.To4(), ttl, p.data)
+	} else {
+		packet = ipv6Packet(p.src.To16(), p.dst.To16(), ttl, p.data)
+	}
+	return w.w.WritePacket(gopacket.CaptureInfo{
+		Timestamp:     p.time,
+		CaptureLength: len(packet),
+		Length:        len(packet),
+	}, packet)
+}
+
+// ipv4Packet prepends an IPv4 header to an ICMP message
+func ipv4Packet(src, dst net.IP, ttl int, data []byte) []byte {
+	b := make([]byte, ipv4.HeaderLen+len(data))
+	b[0] = 4<<4 | ipv4.HeaderLen/4
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[8] = byte(ttl)
+	b[9] = 1
+	copy(b[12:16], src)
+	copy(b[16:20], dst)
+	var sum uint32
+	for i := 0; i < ipv4.HeaderLen; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	binary.BigEndian.PutUint16(b[10:12], ^uint16(sum))
+	copy(b[ipv4.HeaderLen:], data)
+	return b
+}
+
+// ipv6Packet prepends an IPv6 header to an ICMPv6 message
+func ipv6Packet(src, dst net.IP, ttl int, data []byte) []byte {
+	b := make([]byte, ipv6.HeaderLen+len(data))
+	b[0] = 6 << 4
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(data)))
+	b[6] = 58
+	b[7] = byte(ttl)
+	copy(b[8:24], src)
+	copy(b[24:40], dst)
+	copy(b[ipv6.HeaderLen:], data)
+	return b
+}
+
+// readPcap reconstructs the replies received by collector from a pcap file written by pcapWriter or any
+// other raw IP capture. Replies are only accepted from the given nodes if any, and signatures are checked
+// against the time each packet was captured if key is set. Duplicates are dropped.
+func readPcap(filename string, collector uint16, nodes map[uint16]string, key []byte, maxAge time.Duration) ([]replyRecord, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	if r.LinkType() != layers.LinkTypeRaw && r.LinkType() != layers.LinkTypeIPv4 && r.LinkType() != layers.LinkTypeIPv6 {
+		return nil, fmt.Errorf("unsupported link type %s (expected raw IP)", r.LinkType())
+	}
+
+	var records []replyRecord
+	seen := map[verfploeter.DedupKey]bool{}
+	for {
+		data, ci, err := r.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		var src, dst net.IP
+		var proto, ttl int
+		switch {
+		case len(data) >= ipv4.HeaderLen && data[0]>>4 == 4 && data[9] == 1 && len(data) >= int(data[0]&0x0f)<<2:
+			src, dst, proto, ttl = net.IP(data[12:16]), net.IP(data[16:20]), 1, int(data[8])
+			data = data[int(data[0]&0x0f)<<2:]
+		case len(data) >= ipv6.HeaderLen && data[0]>>4 == 6 && data[6] == 58:
+			src, dst, proto, ttl = net.IP(data[8:24]), net.IP(data[24:40]), 58, int(data[7])
+			data = data[ipv6.HeaderLen:]
+		default:
+			continue
+		}
+
+		msg, err := icmp.ParseMessage(proto, data)
+		if err != nil || (msg.Type != ipv4.ICMPTypeEchoReply && msg.Type != ipv6.ICMPTypeEchoReply) {
+			continue
+		}
+		echo, ok := msg.Body.(*icmp.Echo)
+		if !ok || !verfploeter.VerifyPayloadAt(echo.ID, echo.Data, key, maxAge, ci.Timestamp) {
+			continue
+		}
+		if _, ok := nodes[uint16(echo.ID)]; len(nodes) > 0 && !ok && echo.ID != int(collector) {
+			continue
+		}
+		payload, hasPayload := verfploeter.ParsePayload(echo.Data)
+		seq := echo.Seq
+		if hasPayload {
+			seq = int(payload.Seq)
+		}
+		dedupKey := verfploeter.DedupKey{Addr: src.String(), ID: echo.ID, Seq: seq, Sweep: payload.Sweep}
+		if seen[dedupKey] {
+			continue
+		}
+		seen[dedupKey] = true
+
+		record := newReplyRecord(&verfploeter.Result{
+			Time:       ci.Timestamp,
+			Collector:  collector,
+			Node:       uint16(echo.ID),
+			Src:        &net.IPAddr{IP: src},
+			Proto:      proto,
+			Seq:        seq,
+			TTL:        ttl,
+			Payload:    payload,
+			HasPayload: hasPayload,
+		})
+		if !dst.IsUnspecified() {
+			record.Source = dst.String()
+		}
+		records = append(records, record)
+	}
+}
@@ -0,0 +1,67 @@
+package verfploeter
+
+import (
+	"sync"
+	"time"
+)
+
+// DedupKey identifies a single probe's reply by responder, echo ID, sequence number, and sweep
+type DedupKey struct {
+	Addr  string
+	ID    int
+	Seq   int
+	Sweep uint32
+}
+
+// Dedup remembers recently counted replies so duplicates from targets or middleboxes are only counted once
+type Dedup struct {
+	lock sync.Mutex
+	ttl  time.Duration
+	seen map[DedupKey]time.Time
+}
+
+// NewDedup creates a cache that remembers replies for ttl
+func NewDedup(ttl time.Duration) *Dedup {
+	return &Dedup{ttl: ttl, seen: map[DedupKey]time.Time{}}
+}
+
+// Duplicate checks if a reply has already been counted
+func (d *Dedup) Duplicate(key DedupKey) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	at, ok := d.seen[key]
+	return ok && time.Since(at) < d.ttl
+}
+
+// Add records a reply as counted
+func (d *Dedup) Add(key DedupKey) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.seen[key] = time.Now()
+}
+
+// Expire forgets replies counted more than the TTL ago
+func (d *Dedup) Expire() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	deadline := time.Now().Add(-d.ttl)
+	for key, at := range d.seen {
+		if at.Before(deadline) {
+			delete(d.seen, key)
+		}
+	}
+}
+
+// Run expires replies every half TTL until stop is closed
+func (d *Dedup) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(d.ttl / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.Expire()
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package verfploeter
+
+import (
+	"golang.org/x/net/bpf"
+)
+
+// maxFilterIDs is the most node IDs matched individually by EchoFilter, more pass every echo reply
+const maxFilterIDs = 64
+
+// EchoFilter assembles a classic BPF program for a raw ICMP socket of ipVersion 4 or 6 that passes echo
+// replies with one of ids as the echo ID and ICMP errors that may quote a probe, dropping everything else
+// in the kernel. Raw IPv4 sockets see the IP header, raw IPv6 sockets start at the ICMPv6 header.
+func EchoFilter(ipVersion int, ids []uint16) ([]bpf.RawInstruction, error) {
+	var prog []bpf.Instruction
+	var echoReply uint32
+	var errorTypes []uint32
+	var loadID bpf.Instruction
+	if ipVersion == 4 {
+		prog = []bpf.Instruction{
+			bpf.LoadMemShift{Off: 0},          // X = IP header length
+			bpf.LoadIndirect{Off: 0, Size: 1}, // A = ICMP type
+		}
+		echoReply = 0
+		errorTypes = []uint32{3, 11, 12} // Destination unreachable, time exceeded, parameter problem
+		loadID = bpf.LoadIndirect{Off: 4, Size: 2}
+	} else {
+		prog = []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 0, Size: 1},
+		}
+		echoReply = 129
+		errorTypes = []uint32{1, 2, 3, 4} // Destination unreachable, packet too big, time exceeded, parameter problem
+		loadID = bpf.LoadAbsolute{Off: 4, Size: 2}
+	}
+
+	// With too many nodes to check individually, every echo ID is a node's
+	var idChecks []bpf.JumpIf
+	if len(ids) > maxFilterIDs {
+		idChecks = []bpf.JumpIf{{Cond: bpf.JumpLessOrEqual, Val: 0xffff}}
+	} else {
+		for _, id := range ids {
+			idChecks = append(idChecks, bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(id)})
+		}
+	}
+
+	// Jumps are relative, so count forward to the accept at the end of the program
+	accept := len(errorTypes) + len(idChecks) + 4
+	prog = append(prog, bpf.JumpIf{Cond: bpf.JumpEqual, Val: echoReply, SkipTrue: uint8(len(errorTypes) + 1)})
+	for i, t := range errorTypes {
+		prog = append(prog, bpf.JumpIf{Cond: bpf.JumpEqual, Val: t, SkipTrue: uint8(accept - i - 2)})
+	}
+	prog = append(prog, bpf.RetConstant{Val: 0}, loadID)
+	for i, check := range idChecks {
+		check.SkipTrue = uint8(accept - len(errorTypes) - i - 4)
+		prog = append(prog, check)
+	}
+	prog = append(prog, bpf.RetConstant{Val: 0}, bpf.RetConstant{Val: 0xffff})
+	return bpf.Assemble(prog)
+}
@@ -0,0 +1,384 @@
+package verfploeter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// maxPacketSize is the largest ICMP message read from a socket
+const maxPacketSize = 1500
+
+// Reasons a received reply isn't returned as a Result
+var (
+	ErrUnsolicited  = errors.New("unsolicited reply")
+	ErrDuplicate    = errors.New("duplicate reply")
+	ErrBadSignature = errors.New("echo reply has an invalid or stale signature")
+)
+
+// ReplyError is a reply that was rejected for one of the reasons above
+type ReplyError struct {
+	Err error
+	Src net.Addr
+	ID  int
+	Seq int
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("%s from %s id %d seq %d", e.Err, e.Src, e.ID, e.Seq)
+}
+
+func (e *ReplyError) Unwrap() error { return e.Err }
+
+// ICMPError is an ICMP destination unreachable, time exceeded, packet too big, or parameter problem received
+// instead of a reply
+type ICMPError struct {
+	Message *icmp.Message
+	Proto   int // 1 for ICMP or 58 for ICMPv6
+	Src     net.Addr
+	MTU     int // Next-hop MTU of an IPv4 fragmentation needed error, zero if the router didn't set it
+}
+
+func (e *ICMPError) Error() string {
+	return fmt.Sprintf("ICMP %s from %s", e.Message.Type, e.Src)
+}
+
+// Result is a reply to a probe sent by this node or another known node, an echo reply unless Response is set
+type Result struct {
+	Time       time.Time
+	Collector  uint16 // Node that received the reply
+	Node       uint16 // Node that sent the probe
+	Src        net.Addr
+	Proto      int    // 1 for ICMP or 58 for ICMPv6, zero for TCP and UDP replies
+	Seq        int    // Probe sequence number from the payload, or the echo sequence number without one
+	TTL        int    // TTL or hop limit the reply arrived with, zero if unknown
+	Dst        net.IP // Local address the reply was sent to, nil if unknown
+	Size       int    // IP packet size of the reply, the same as the probe's
+	Payload    Payload
+	HasPayload bool
+
+	// Replies to TCP and UDP probes
+	Response string    // syn-ack, rst, udp, or port-unreachable
+	Sent     time.Time // When the probe was sent, zero if it isn't known such as for UDP probes from other nodes
+	Data     []byte    // Application payload of a UDP reply
+}
+
+// RTT returns the time since the probe was sent, which is only meaningful for other nodes' probes if
+// clocks are in sync
+func (r Result) RTT() (time.Duration, bool) {
+	sent := r.Sent
+	if r.HasPayload {
+		sent = r.Payload.Sent
+	}
+	if sent.IsZero() {
+		return 0, false
+	}
+	d := r.Time.Sub(sent)
+	return d, d >= 0
+}
+
+// Handler receives what a listener reads from a socket until it is closed. Funcs left nil are skipped.
+type Handler struct {
+	Reply func(result *Result)
+
+	// Error receives the ICMP errors read by a Listener, which Correlate matches with the probe they quote
+	Error func(e *ICMPError)
+
+	// Reject receives rejected replies as a *ReplyError, and messages that couldn't be read or parsed
+	Reject func(err error)
+}
+
+func (h Handler) reply(result *Result) {
+	if h.Reply != nil {
+		h.Reply(result)
+	}
+}
+
+func (h Handler) reject(err error) {
+	if h.Reject != nil {
+		h.Reject(err)
+	}
+}
+
+// KnownNodes returns the other nodes whose replies are accepted by listeners, which can't be checked against
+// the tracker since it only holds this node's probes
+type KnownNodes func() map[uint16]string
+
+// known checks if a node is one of the other nodes, false if there are none
+func (n KnownNodes) known(id int) bool {
+	if n == nil {
+		return false
+	}
+	_, ok := n()[uint16(id)]
+	return ok
+}
+
+// Listener reads echo replies at a node and correlates them with probes
+type Listener struct {
+	ID      uint16
+	Tracker *Tracker // Probes sent by this node
+	Dedup   *Dedup   // Optional, suppresses duplicate replies
+	Key     []byte   // Verifies signed payloads if set
+	MaxAge  time.Duration
+	Nodes   KnownNodes
+
+	// Capture is called with every ICMP message read and its TTL before it is parsed, if set
+	Capture func(b []byte, src net.Addr, proto, ttl int)
+}
+
+// Read reads and correlates a single ICMP message from pc, where proto is 1 for ICMP or 58 for ICMPv6. ICMP
+// errors are returned as an *ICMPError and rejected replies as a *ReplyError. Results only carry a TTL and
+// destination address if pc is a *TTLConn.
+func (l *Listener) Read(pc net.PacketConn, proto int) (*Result, error) {
+	b := make([]byte, maxPacketSize)
+	var n, ttl int
+	var dst net.IP
+	var src net.Addr
+	var err error
+	if c, ok := pc.(*TTLConn); ok {
+		n, ttl, dst, src, err = c.ReadMsg(b)
+	} else {
+		n, src, err = pc.ReadFrom(b)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read from socket: %w", err)
+	}
+	if l.Capture != nil {
+		l.Capture(b[:n], src, proto, ttl)
+	}
+
+	msg, err := icmp.ParseMessage(proto, b[:n])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse ICMP message: %s", err)
+	}
+
+	switch msg.Type {
+	case ipv4.ICMPTypeEchoReply, ipv6.ICMPTypeEchoReply:
+	case ipv4.ICMPTypeDestinationUnreachable, ipv6.ICMPTypeDestinationUnreachable,
+		ipv4.ICMPTypeTimeExceeded, ipv6.ICMPTypeTimeExceeded, ipv6.ICMPTypePacketTooBig,
+		ipv4.ICMPTypeParameterProblem, ipv6.ICMPTypeParameterProblem:
+		e := &ICMPError{Message: msg, Proto: proto, Src: src}
+		if msg.Type == ipv4.ICMPTypeDestinationUnreachable && msg.Code == 4 && n >= 8 {
+			// RFC 1191 puts the next-hop MTU in the otherwise unused second half of the header
+			e.MTU = int(binary.BigEndian.Uint16(b[6:8]))
+		}
+		return nil, e
+	default:
+		return nil, fmt.Errorf("unexpected ICMP message type %s", msg.Type)
+	}
+
+	body, ok := msg.Body.(*icmp.Echo)
+	if !ok {
+		return nil, fmt.Errorf("unable to assert message body as *icmp.Echo (this should never happen): %+v", msg.Body)
+	}
+	if !VerifyPayload(body.ID, body.Data, l.Key, l.MaxAge) {
+		return nil, &ReplyError{Err: ErrBadSignature, Src: src, ID: body.ID, Seq: body.Seq}
+	}
+
+	// Duplicates of our own replies would otherwise look unsolicited once the probe is answered
+	payload, hasPayload := ParsePayload(body.Data)
+	seq := body.Seq
+	if hasPayload {
+		seq = int(payload.Seq)
+	}
+	key := DedupKey{src.String(), body.ID, seq, payload.Sweep}
+	if l.Dedup != nil && l.Dedup.Duplicate(key) {
+		return nil, &ReplyError{Err: ErrDuplicate, Src: src, ID: body.ID, Seq: body.Seq}
+	}
+
+	// Our own probes must still be outstanding, other nodes' probes can only be checked against the node map
+	var solicited bool
+	if body.ID == int(l.ID) {
+		solicited = l.Tracker.Answered(src, body.ID, body.Seq)
+	} else {
+		solicited = l.Nodes.known(body.ID)
+	}
+	if !solicited {
+		return nil, &ReplyError{Err: ErrUnsolicited, Src: src, ID: body.ID, Seq: body.Seq}
+	}
+	if l.Dedup != nil {
+		l.Dedup.Add(key)
+	}
+
+	return &Result{
+		Time:       time.Now(),
+		Collector:  l.ID,
+		Node:       uint16(body.ID),
+		Src:        src,
+		Proto:      proto,
+		Seq:        seq,
+		TTL:        ttl,
+		Dst:        dst,
+		Size:       ipHeaderLen(proto) + n,
+		Payload:    payload,
+		HasPayload: hasPayload,
+	}, nil
+}
+
+// Serve passes everything read from pc to h until the socket is closed
+func (l *Listener) Serve(pc net.PacketConn, proto int, h Handler) error {
+	for {
+		result, err := l.Read(pc, proto)
+		var icmpErr *ICMPError
+		switch {
+		case errors.Is(err, net.ErrClosed):
+			return nil
+		case errors.As(err, &icmpErr):
+			if h.Error != nil {
+				h.Error(icmpErr)
+			}
+		case err != nil:
+			h.reject(err)
+		default:
+			h.reply(result)
+		}
+	}
+}
+
+// Listen sends every reply read from pc to results until the socket is closed, skipping ICMP errors,
+// rejected replies, and malformed messages
+func (l *Listener) Listen(pc net.PacketConn, proto int, results chan<- Result) error {
+	return l.Serve(pc, proto, Handler{Reply: func(result *Result) {
+		results <- *result
+	}})
+}
+
+// ErrorResult is an ICMP error quoting a probe sent by this node or another known node
+type ErrorResult struct {
+	Time      time.Time
+	Collector uint16 // Node that received the error
+	Node      uint16 // Node that sent the probe
+	Src       net.Addr
+	Type      string // destination_unreachable, time_exceeded, packet_too_big, or parameter_problem
+	Code      int
+	MTU       int // MTU reported by a packet too big or fragmentation needed error, zero otherwise
+	Probe     QuotedProbe
+}
+
+// Correlate matches an ICMP error with the echo request it quotes. Errors answer the probe, so a probe from
+// this node is no longer outstanding afterwards.
+func (l *Listener) Correlate(e *ICMPError) (*ErrorResult, error) {
+	msg := e.Message
+	quoted, errType, ok := QuotedPacket(msg)
+	if !ok {
+		return nil, fmt.Errorf("ICMP %s from %s with unexpected body %T", msg.Type, e.Src, msg.Body)
+	}
+	probe, ok := ParseQuoted(e.Proto, quoted)
+	if !ok {
+		return nil, fmt.Errorf("ICMP %s from %s does not quote one of our probes", msg.Type, e.Src)
+	}
+	if probe.ID != int(l.ID) {
+		if !l.Nodes.known(probe.ID) {
+			return nil, fmt.Errorf("ICMP %s from %s quotes a probe from unknown node %d", msg.Type, e.Src, probe.ID)
+		}
+	}
+
+	result := &ErrorResult{
+		Time:      time.Now(),
+		Collector: l.ID,
+		Node:      uint16(probe.ID),
+		Src:       e.Src,
+		Type:      errType,
+		Code:      msg.Code,
+		MTU:       e.MTU,
+		Probe:     probe,
+	}
+	if body, ok := msg.Body.(*icmp.PacketTooBig); ok {
+		result.MTU = body.MTU
+	}
+	if probe.ID == int(l.ID) {
+		l.Tracker.Answered(&net.IPAddr{IP: probe.Dst}, probe.ID, probe.Seq)
+	}
+	return result, nil
+}
+
+// QuotedPacket returns the packet quoted in an ICMP error message and the name of the error
+func QuotedPacket(msg *icmp.Message) ([]byte, string, bool) {
+	switch body := msg.Body.(type) {
+	case *icmp.DstUnreach:
+		return body.Data, "destination_unreachable", true
+	case *icmp.TimeExceeded:
+		return body.Data, "time_exceeded", true
+	case *icmp.PacketTooBig:
+		return body.Data, "packet_too_big", true
+	case *icmp.ParamProb:
+		return body.Data, "parameter_problem", true
+	}
+	return nil, "", false
+}
+
+// QuotedProbe is an echo request quoted in an ICMP error message
+type QuotedProbe struct {
+	Dst        net.IP
+	ID         int
+	Seq        int // Probe sequence number from the payload, or the echo sequence number without one
+	Payload    Payload
+	HasPayload bool // Routers only have to quote the first 8 bytes of the echo request
+	Size       int  // IP packet size of the probe, from the quoted header
+}
+
+// ParseQuoted extracts the echo request quoted in an ICMP error message, where proto is 1 for ICMP or 58
+// for ICMPv6, returning false if the quoted packet isn't an echo request
+func ParseQuoted(proto int, quoted []byte) (QuotedProbe, bool) {
+	var hdrLen, echoType, size int
+	var dst net.IP
+	if proto == 1 {
+		if len(quoted) < ipv4.HeaderLen || quoted[9] != 1 {
+			return QuotedProbe{}, false
+		}
+		hdrLen = int(quoted[0]&0x0f) << 2
+		size = int(binary.BigEndian.Uint16(quoted[2:4]))
+		dst = net.IP(quoted[16:20])
+		echoType = int(ipv4.ICMPTypeEcho)
+	} else {
+		if len(quoted) < ipv6.HeaderLen || quoted[6] != 58 {
+			return QuotedProbe{}, false // Extension headers are not supported
+		}
+		hdrLen = ipv6.HeaderLen
+		size = ipv6.HeaderLen + int(binary.BigEndian.Uint16(quoted[4:6]))
+		dst = net.IP(quoted[24:40])
+		echoType = int(ipv6.ICMPTypeEchoRequest)
+	}
+
+	// Only the ICMP header is guaranteed to be quoted: type, code, checksum, id, seq
+	if len(quoted) < hdrLen+8 {
+		return QuotedProbe{}, false
+	}
+	echo := quoted[hdrLen:]
+	if int(echo[0]) != echoType {
+		return QuotedProbe{}, false
+	}
+	q := QuotedProbe{
+		Dst:  append(net.IP{}, dst...),
+		ID:   int(binary.BigEndian.Uint16(echo[4:6])),
+		Seq:  int(binary.BigEndian.Uint16(echo[6:8])),
+		Size: size,
+	}
+	q.Payload, q.HasPayload = ParsePayload(echo[8:])
+	if q.HasPayload {
+		q.Seq = int(q.Payload.Seq)
+	}
+	return q, true
+}
+
+// ipHeaderLen returns the length of the IP header, without options, that ICMP (proto 1) or ICMPv6 (proto
+// 58) messages arrive in
+func ipHeaderLen(proto int) int {
+	if proto == 1 {
+		return ipv4.HeaderLen
+	}
+	return ipv6.HeaderLen
+}
+
+// QuotedEchoID extracts the echo ID from the original packet quoted in an ICMP error message, where proto
+// is 1 for ICMP or 58 for ICMPv6
+func QuotedEchoID(proto int, quoted []byte) (int, bool) {
+	q, ok := ParseQuoted(proto, quoted)
+	return q.ID, ok
+}
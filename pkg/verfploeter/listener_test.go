@@ -0,0 +1,94 @@
+package verfploeter
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+// packetConn is a net.PacketConn that returns a single packet from src, then reports the socket as closed
+type packetConn struct {
+	net.PacketConn
+	packet []byte
+	src    net.Addr
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if c.packet == nil {
+		return 0, nil, net.ErrClosed
+	}
+	n := copy(b, c.packet)
+	c.packet = nil
+	return n, c.src, nil
+}
+
+// echoReply6 marshals an ICMPv6 echo reply carrying a payload with a probe sequence number
+func echoReply6(t *testing.T, id, seq int) []byte {
+	t.Helper()
+	payload := Payload{Sent: time.Now(), Target: 3, Sweep: 2, Seq: uint64(seq)}
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypeEchoReply,
+		Body: &icmp.Echo{ID: id, Seq: EchoSeq(seq), Data: payload.Marshal(id, 0, nil)},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		t.Fatalf("unable to marshal echo reply: %s", err)
+	}
+	return b
+}
+
+func TestListenerReadEchoReply6(t *testing.T) {
+	const id, seq = 10, 0x10005
+	src := &net.IPAddr{IP: net.ParseIP("2001:db8::1")}
+	l := &Listener{ID: id, Tracker: NewTracker()}
+	l.Tracker.Sent(src, id, seq, time.Now())
+
+	result, err := l.Read(&packetConn{packet: echoReply6(t, id, seq), src: src}, 58)
+	if err != nil {
+		t.Fatalf("unable to read echo reply: %s", err)
+	}
+	if result.Node != id || result.Collector != id {
+		t.Errorf("got node %d collector %d, want %d", result.Node, result.Collector, id)
+	}
+	if result.Seq != seq {
+		t.Errorf("got seq %d, want %d", result.Seq, seq)
+	}
+	if result.Src.String() != src.String() {
+		t.Errorf("got src %s, want %s", result.Src, src)
+	}
+	if result.Proto != 58 || !result.HasPayload || result.Payload.Sweep != 2 || result.Payload.Target != 3 {
+		t.Errorf("got proto %d payload %+v (%t)", result.Proto, result.Payload, result.HasPayload)
+	}
+	if answers := l.Tracker.Answers(); answers != 1 {
+		t.Errorf("got %d answers, want 1", answers)
+	}
+}
+
+func TestListenerReadUnsolicited(t *testing.T) {
+	const id, seq = 10, 7
+	src := &net.IPAddr{IP: net.ParseIP("2001:db8::1")}
+	l := &Listener{ID: id, Tracker: NewTracker()}
+	l.Tracker.Sent(src, id, seq, time.Now())
+
+	// No node ever probed with this ID
+	_, err := l.Read(&packetConn{packet: echoReply6(t, 4242, seq), src: src}, 58)
+	if !errors.Is(err, ErrUnsolicited) {
+		t.Fatalf("got error %v, want %s", err, ErrUnsolicited)
+	}
+	var replyErr *ReplyError
+	if !errors.As(err, &replyErr) || replyErr.ID != 4242 || replyErr.Seq != seq {
+		t.Errorf("got %#v, want a *ReplyError for id 4242 seq %d", err, seq)
+	}
+
+	// The probe that was sent is still outstanding and nothing was counted as answered
+	if answers := l.Tracker.Answers(); answers != 0 {
+		t.Errorf("got %d answers, want 0", answers)
+	}
+	if !l.Tracker.Answered(src, id, seq) {
+		t.Error("sent probe is no longer outstanding")
+	}
+}
@@ -0,0 +1,95 @@
+package verfploeter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+)
+
+// Echo payload layout: 8 byte send timestamp (unix nanoseconds), 4 byte target index, 4 byte sweep ID,
+// 8 byte probe sequence number, an 8 byte HMAC if probes are signed, then zero padding
+const (
+	PayloadHeaderLen = 24
+	PayloadMACLen    = 8
+
+	// NoTarget marks probes to targets outside the targets list, such as on-demand probes
+	NoTarget = ^uint32(0)
+
+	// MaxClockSkew is how far other nodes' clocks may be off when checking signed replies for staleness
+	MaxClockSkew = 30 * time.Second
+)
+
+// Payload is the data carried in each echo request and returned in the reply
+type Payload struct {
+	Sent   time.Time
+	Target uint32 // Index into the targets list
+	Sweep  uint32 // Sweep ID, zero outside of sweep mode
+	Seq    uint64 // Probe sequence number of the sending node, the echo sequence number is its low 16 bits
+}
+
+// Marshal encodes the payload for a probe with an echo ID, zero padded to size bytes. The payload is
+// signed with HMAC-SHA256 if key is set.
+func (p Payload) Marshal(id, size int, key []byte) []byte {
+	minSize := PayloadHeaderLen
+	if key != nil {
+		minSize += PayloadMACLen
+	}
+	if size < minSize {
+		size = minSize
+	}
+	b := make([]byte, size)
+	binary.BigEndian.PutUint64(b[0:8], uint64(p.Sent.UnixNano()))
+	binary.BigEndian.PutUint32(b[8:12], p.Target)
+	binary.BigEndian.PutUint32(b[12:16], p.Sweep)
+	binary.BigEndian.PutUint64(b[16:24], p.Seq)
+	if key != nil {
+		copy(b[PayloadHeaderLen:], payloadMAC(key, id, b[:PayloadHeaderLen]))
+	}
+	return b
+}
+
+// ParsePayload decodes an echo payload, returning false if it is too short to be one of ours
+func ParsePayload(data []byte) (Payload, bool) {
+	if len(data) < PayloadHeaderLen {
+		return Payload{}, false
+	}
+	return Payload{
+		Sent:   time.Unix(0, int64(binary.BigEndian.Uint64(data[0:8]))),
+		Target: binary.BigEndian.Uint32(data[8:12]),
+		Sweep:  binary.BigEndian.Uint32(data[12:16]),
+		Seq:    binary.BigEndian.Uint64(data[16:24]),
+	}, true
+}
+
+// payloadMAC signs the echo ID (the node ID) and payload header
+func payloadMAC(key []byte, id int, header []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(id))
+	mac.Write(b[:])
+	mac.Write(header)
+	return mac.Sum(nil)[:PayloadMACLen]
+}
+
+// VerifyPayload checks that an echo payload was signed with key and is no older than maxAge, allowing for
+// clock skew between nodes. Every payload passes if key is nil.
+func VerifyPayload(id int, data, key []byte, maxAge time.Duration) bool {
+	return VerifyPayloadAt(id, data, key, maxAge, time.Now())
+}
+
+// VerifyPayloadAt is VerifyPayload for a reply received at a given time, such as when replaying a capture
+func VerifyPayloadAt(id int, data, key []byte, maxAge time.Duration, received time.Time) bool {
+	if key == nil {
+		return true
+	}
+	if len(data) < PayloadHeaderLen+PayloadMACLen {
+		return false
+	}
+	if !hmac.Equal(data[PayloadHeaderLen:PayloadHeaderLen+PayloadMACLen], payloadMAC(key, id, data[:PayloadHeaderLen])) {
+		return false
+	}
+	payload, _ := ParsePayload(data)
+	age := received.Sub(payload.Sent)
+	return age <= maxAge+MaxClockSkew && age >= -MaxClockSkew
+}
@@ -0,0 +1,73 @@
+package verfploeter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// TCP and UDP probes carry the node ID in their source port, since they have no echo ID
+const (
+	// ProbePortBase is the source port of TCP and UDP probes from node 0, each node sends from ProbePortBase
+	// plus its ID. It's above Linux's default ephemeral port range so replies aren't confused with other traffic.
+	ProbePortBase = 61000
+
+	// MaxPortNode is the highest node ID that fits in the source port of TCP and UDP probes
+	MaxPortNode = 0xffff - ProbePortBase
+)
+
+// ErrNotReply is returned for packets read from a raw TCP or UDP socket that don't answer a probe, since
+// those sockets receive every segment or datagram of their protocol
+var ErrNotReply = errors.New("not a reply to a probe")
+
+// portNode returns the node that sent a TCP or UDP probe from a source port, or false if it isn't one
+func portNode(port int) (int, bool) {
+	node := port - ProbePortBase
+	return node, node >= 0 && node <= MaxPortNode
+}
+
+// sendTracked tracks a probe as outstanding and writes it, untracking it again if the write fails. Probes
+// are tracked first since a reply from a nearby target can arrive before the write returns. Echo requests
+// are tracked without a protocol.
+func sendTracked(tracker *Tracker, conn PacketWriter, probe *Probe, id int, protocol string) error {
+	tracker.Track(Outstanding{
+		Addr:     probe.Addr,
+		ID:       id,
+		Seq:      probe.Seq,
+		Sent:     probe.Sent,
+		Target:   probe.Target,
+		Sweep:    probe.Sweep,
+		Attempt:  probe.Attempt,
+		Size:     probe.Size,
+		Protocol: protocol,
+		Tag:      probe.Tag,
+	})
+	if _, err := conn.WriteTo(probe.Packet, probe.Addr); err != nil {
+		tracker.Untrack(probe.Addr, id, probe.Seq)
+		return &SendError{Op: "write", Err: err}
+	}
+	return nil
+}
+
+// serveRaw reads packets from a raw TCP or UDP socket until it is closed, passing those that answer a
+// probe to read
+func serveRaw(pc net.PacketConn, h Handler, read func(b []byte, src net.Addr) (*Result, error)) error {
+	b := make([]byte, maxPacketSize)
+	for {
+		n, src, err := pc.ReadFrom(b)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			h.reject(fmt.Errorf("unable to read from socket: %w", err))
+			continue
+		}
+		result, err := read(b[:n], src)
+		switch {
+		case errors.Is(err, ErrNotReply):
+		case err != nil:
+			h.reject(err)
+		default:
+			h.reply(result)
+		}
+	}
+}
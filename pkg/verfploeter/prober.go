@@ -0,0 +1,112 @@
+// Package verfploeter measures anycast catchments by sending ICMP echo requests that carry a node ID and
+// correlating the replies, which may arrive at any node announcing the anycast prefix.
+//
+// A Prober sends echo requests from one node and a Listener reads the replies that arrive at a node,
+// including replies to other nodes' probes. Both share a Tracker to match replies to outstanding probes.
+// TCPProber and UDPProber send SYNs and datagrams from a port that carries the node ID instead, and
+// TCPListener and UDPListener correlate their replies. Sources spreads probes across local addresses.
+package verfploeter
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// PacketWriter sends packets, such as a net.PacketConn
+type PacketWriter interface {
+	WriteTo(b []byte, addr net.Addr) (int, error)
+}
+
+// SendError is returned when a probe can't be built or sent, where Op is "marshal" or "write"
+type SendError struct {
+	Op  string
+	Err error
+}
+
+func (e *SendError) Error() string { return e.Op + ": " + e.Err.Error() }
+func (e *SendError) Unwrap() error { return e.Err }
+
+// Prober sends echo requests with this node's ID as the echo ID, which allows up to 65536 nodes
+type Prober struct {
+	ID          int
+	Conn4       PacketWriter // Sends IPv4 probes, such as an ip4:icmp socket
+	Conn6       PacketWriter // Sends IPv6 probes, such as an ip6:icmp socket
+	Tracker     *Tracker
+	PayloadSize int
+	Key         []byte // Signs payloads if set, must match the listeners' key
+}
+
+// Probe is an echo request ready to send
+type Probe struct {
+	Addr    *net.IPAddr
+	Target  string // Name the probe's sequence number is tracked under
+	Seq     int    // Probe sequence number, the echo sequence number is its low 16 bits
+	Sweep   uint32
+	Attempt int // Retransmissions of the probe before this one
+	Size    int // IP packet size for path MTU probes, zero for the prober's payload size
+	Sent    time.Time
+	Packet  []byte
+	Tag     string // Set by callers to tell apart outstanding probes sent for different purposes
+}
+
+// Build creates an echo request to addr for a target, carrying the target's index in the targets list (or
+// NoTarget) and a sweep ID
+func (p *Prober) Build(addr *net.IPAddr, target string, index, sweep uint32) (*Probe, error) {
+	return p.build(addr, target, index, sweep, p.PayloadSize)
+}
+
+// BuildSize is Build for an echo request padded to make an IP packet of size bytes, such as to probe the
+// path MTU with the don't fragment flag set. Sizes too small for the payload are rounded up.
+func (p *Prober) BuildSize(addr *net.IPAddr, target string, index, sweep uint32, size int) (*Probe, error) {
+	hdrLen := ipv6.HeaderLen
+	if addr.IP.To4() != nil {
+		hdrLen = ipv4.HeaderLen
+	}
+	probe, err := p.build(addr, target, index, sweep, size-hdrLen-8)
+	if probe != nil {
+		probe.Size = hdrLen + len(probe.Packet)
+	}
+	return probe, err
+}
+
+func (p *Prober) build(addr *net.IPAddr, target string, index, sweep uint32, payloadSize int) (*Probe, error) {
+	probe := &Probe{Addr: addr, Target: target, Seq: p.Tracker.Next(), Sweep: sweep, Sent: time.Now()}
+	payload := Payload{Sent: probe.Sent, Target: index, Sweep: sweep, Seq: uint64(probe.Seq)}
+	msg := icmp.Message{
+		Code: 0,
+		Body: &icmp.Echo{ID: p.ID, Seq: EchoSeq(probe.Seq), Data: payload.Marshal(p.ID, payloadSize, p.Key)},
+	}
+	if addr.IP.To4() != nil {
+		msg.Type = ipv4.ICMPTypeEcho
+	} else {
+		msg.Type = ipv6.ICMPTypeEchoRequest
+	}
+
+	var err error
+	if probe.Packet, err = msg.Marshal(nil); err != nil {
+		return nil, &SendError{Op: "marshal", Err: err}
+	}
+	return probe, nil
+}
+
+// Send sends a probe and tracks it as outstanding
+func (p *Prober) Send(probe *Probe) error {
+	conn := p.Conn6
+	if probe.Addr.IP.To4() != nil {
+		conn = p.Conn4
+	}
+	return sendTracked(p.Tracker, conn, probe, p.ID, "")
+}
+
+// Probe builds and sends an echo request to addr
+func (p *Prober) Probe(addr *net.IPAddr, target string, index, sweep uint32) (*Probe, error) {
+	probe, err := p.Build(addr, target, index, sweep)
+	if err != nil {
+		return nil, err
+	}
+	return probe, p.Send(probe)
+}
@@ -0,0 +1,67 @@
+package verfploeter
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Source is a local address that echo requests are sent from and replies are received at, such as one per
+// announced anycast prefix
+type Source struct {
+	Addr   net.IP // Nil or unspecified for a wildcard address
+	Proto  int    // 1 for ICMP or 58 for ICMPv6
+	Conn   net.PacketConn
+	Prober *Prober
+}
+
+// Label returns the source recorded with replies, empty if it's a wildcard address
+func (s *Source) Label() string {
+	if s.Addr == nil || s.Addr.IsUnspecified() {
+		return ""
+	}
+	return s.Addr.String()
+}
+
+// Sources are the sources of each family that probes are sent from, spread across them round-robin unless
+// All is set. Sources are added at startup, before probes are sent.
+type Sources struct {
+	All bool // Send each probe from every source of the target's family
+
+	v4, v6 []*Source
+	next   uint64
+}
+
+// Add adds a source to its family
+func (s *Sources) Add(source *Source) {
+	if source.Proto == 1 {
+		s.v4 = append(s.v4, source)
+	} else {
+		s.v6 = append(s.v6, source)
+	}
+}
+
+// List returns every source, IPv4 first
+func (s *Sources) List() []*Source {
+	return append(append([]*Source{}, s.v4...), s.v6...)
+}
+
+// Family returns the sources of an IP version, 4 or 6
+func (s *Sources) Family(ipVersion int) []*Source {
+	if ipVersion == 4 {
+		return s.v4
+	}
+	return s.v6
+}
+
+// Pick returns the sources to send a probe to addr from
+func (s *Sources) Pick(addr net.IP) []*Source {
+	sources := s.v6
+	if addr.To4() != nil {
+		sources = s.v4
+	}
+	if s.All || len(sources) <= 1 {
+		return sources
+	}
+	i := atomic.AddUint64(&s.next, 1) % uint64(len(sources))
+	return sources[i : i+1]
+}
@@ -0,0 +1,163 @@
+package verfploeter
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// TCP probes are SYNs sent from port ProbePortBase plus the node ID, so the SYN-ACK or RST that answers one
+// identifies the node that sent it. The sequence number carries the low 16 bits of the send time in
+// milliseconds and the low 16 bits of the probe sequence number, which come back in the acknowledgement number.
+const (
+	tcpHeaderLen = 24 // Including the MSS option
+
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+)
+
+// TCPProber sends SYNs to a port. Sweep IDs and target indexes don't fit in a SYN, so replies to TCP probes
+// aren't attributed to a sweep.
+type TCPProber struct {
+	ID      int
+	Port    int
+	Conn4   PacketWriter // Sends IPv4 segments, such as an ip4:tcp socket
+	Conn6   PacketWriter // Sends IPv6 segments, such as an ip6:tcp socket with kernel checksums enabled
+	Tracker *Tracker
+
+	// Source4 returns the source address of IPv4 probes to dst, which the checksum's pseudo-header covers
+	Source4 func(dst net.IP) (net.IP, error)
+}
+
+// Build creates a SYN to addr for a target
+func (p *TCPProber) Build(addr *net.IPAddr, target string, sweep uint32) (*Probe, error) {
+	probe := &Probe{Addr: addr, Target: target, Seq: p.Tracker.Next(), Sweep: sweep, Sent: time.Now()}
+	probe.Packet = MarshalSYN(uint16(ProbePortBase+p.ID), uint16(p.Port),
+		uint32(probe.Sent.UnixMilli())<<16|uint32(EchoSeq(probe.Seq)))
+
+	// The kernel fills in the IPv6 checksum, but IPv4 needs the source address for the pseudo-header
+	if addr.IP.To4() != nil {
+		src, err := p.Source4(addr.IP)
+		if err != nil {
+			return nil, &SendError{Op: "source", Err: err}
+		}
+		binary.BigEndian.PutUint16(probe.Packet[16:18], TCPChecksum(src.To4(), addr.IP.To4(), probe.Packet))
+	}
+	return probe, nil
+}
+
+// Send sends a SYN and tracks it as outstanding
+func (p *TCPProber) Send(probe *Probe) error {
+	conn := p.Conn6
+	if probe.Addr.IP.To4() != nil {
+		conn = p.Conn4
+	}
+	return sendTracked(p.Tracker, conn, probe, p.ID, "tcp")
+}
+
+// MarshalSYN builds a SYN segment with an MSS option and a zero checksum
+func MarshalSYN(srcPort, dstPort uint16, seq uint32) []byte {
+	b := make([]byte, tcpHeaderLen)
+	binary.BigEndian.PutUint16(b[0:2], srcPort)
+	binary.BigEndian.PutUint16(b[2:4], dstPort)
+	binary.BigEndian.PutUint32(b[4:8], seq)
+	b[12] = tcpHeaderLen / 4 << 4
+	b[13] = tcpFlagSYN
+	binary.BigEndian.PutUint16(b[14:16], 65535) // Window
+	b[20], b[21] = 2, 4                         // MSS option
+	binary.BigEndian.PutUint16(b[22:24], 1460)
+	return b
+}
+
+// TCPChecksum computes the checksum of an IPv4 TCP segment
+func TCPChecksum(src, dst net.IP, segment []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	add(src)
+	add(dst)
+	sum += 6 + uint32(len(segment)) // Protocol and length
+	add(segment)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// TCPListener reads the SYN-ACKs and RSTs that answer TCP probes to a port from this node or another known node
+type TCPListener struct {
+	ID      uint16
+	Port    int
+	Tracker *Tracker // Probes sent by this node
+	Dedup   *Dedup   // Optional, suppresses duplicate replies
+	Nodes   KnownNodes
+}
+
+// Parse correlates a segment read from a raw TCP socket, returning ErrNotReply for any other traffic and
+// rejected replies as a *ReplyError. Results carry the response, syn-ack or rst, and the send time of the probe.
+func (l *TCPListener) Parse(b []byte, src net.Addr) (*Result, error) {
+	if len(b) < 20 || int(binary.BigEndian.Uint16(b[0:2])) != l.Port {
+		return nil, ErrNotReply
+	}
+	node, ok := portNode(int(binary.BigEndian.Uint16(b[2:4])))
+	if !ok {
+		return nil, ErrNotReply
+	}
+
+	var response string
+	flags := b[13]
+	switch {
+	case flags&(tcpFlagSYN|tcpFlagACK) == tcpFlagSYN|tcpFlagACK:
+		response = "syn-ack"
+	case flags&tcpFlagRST != 0:
+		response = "rst"
+	default:
+		return nil, ErrNotReply
+	}
+
+	// Both acknowledge our sequence number plus one for the SYN
+	ack := binary.BigEndian.Uint32(b[8:12]) - 1
+	seq := int(ack & 0xffff)
+
+	key := DedupKey{Addr: src.String(), ID: node, Seq: seq}
+	if l.Dedup != nil && l.Dedup.Duplicate(key) {
+		return nil, &ReplyError{Err: ErrDuplicate, Src: src, ID: node, Seq: seq}
+	}
+	var solicited bool
+	if node == int(l.ID) {
+		solicited = l.Tracker.Answered(src, node, seq)
+	} else {
+		solicited = l.Nodes.known(node)
+	}
+	if !solicited {
+		return nil, &ReplyError{Err: ErrUnsolicited, Src: src, ID: node, Seq: seq}
+	}
+	if l.Dedup != nil {
+		l.Dedup.Add(key)
+	}
+
+	// The send time wraps every ~65s, which is well beyond any probe timeout
+	now := time.Now()
+	elapsed := time.Duration(uint16(now.UnixMilli())-uint16(ack>>16)) * time.Millisecond
+	return &Result{
+		Time:      now,
+		Collector: l.ID,
+		Node:      uint16(node),
+		Src:       src,
+		Seq:       seq,
+		Response:  response,
+		Sent:      now.Add(-elapsed),
+	}, nil
+}
+
+// Serve passes every reply read from pc, a raw TCP socket, to h until the socket is closed
+func (l *TCPListener) Serve(pc net.PacketConn, h Handler) error {
+	return serveRaw(pc, h, l.Parse)
+}
@@ -0,0 +1,154 @@
+package verfploeter
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// probeKey identifies a single probe by destination address, echo ID, and echo sequence number
+type probeKey struct {
+	addr string
+	id   int
+	seq  int
+}
+
+// latestKey identifies the probes sent to a destination address with an echo ID
+type latestKey struct {
+	addr string
+	id   int
+}
+
+// Outstanding is a probe awaiting a reply
+type Outstanding struct {
+	Addr    net.Addr
+	ID      int
+	Seq     int
+	Sent    time.Time
+	Target  string // Name the probe was sent to, if known
+	Sweep   uint32
+	Attempt int // Retransmissions of the probe before this one
+	Size    int // IP packet size of a path MTU probe
+	// Protocol is set by callers that track other kinds of probes, such as TCP SYNs, and empty for echo requests
+	Protocol string
+	Tag      string // Copied from the probe
+}
+
+// EchoSeq returns the echo sequence number that carries a probe sequence number, which is its low 16 bits
+func EchoSeq(seq int) int {
+	return seq & 0xffff
+}
+
+// Tracker numbers probes and keeps the ones that are still awaiting a reply. Probes are tracked by their
+// echo sequence number, since that's all an ICMP error quoting a probe may carry.
+type Tracker struct {
+	lock        sync.Mutex
+	seq         int
+	outstanding map[probeKey]Outstanding
+	answered    uint64
+
+	// latest is the most recent probe sequence number sent to each address, for replies that don't carry one
+	latest map[latestKey]int
+}
+
+// NewTracker creates a tracker with no outstanding probes
+func NewTracker() *Tracker {
+	return &Tracker{
+		outstanding: map[probeKey]Outstanding{},
+		latest:      map[latestKey]int{},
+	}
+}
+
+// Next returns the next probe sequence number, which increases with every probe sent
+func (t *Tracker) Next() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	seq := t.seq
+	t.seq++
+	return seq
+}
+
+// Sent records a probe as outstanding
+func (t *Tracker) Sent(addr net.Addr, id, seq int, at time.Time) {
+	t.Track(Outstanding{Addr: addr, ID: id, Seq: seq, Sent: at})
+}
+
+// Track records a probe as outstanding along with what's needed to retransmit it
+func (t *Tracker) Track(probe Outstanding) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.outstanding[probeKey{probe.Addr.String(), probe.ID, EchoSeq(probe.Seq)}] = probe
+	t.latest[latestKey{probe.Addr.String(), probe.ID}] = probe.Seq
+}
+
+// Untrack removes a probe that couldn't be sent from the outstanding set
+func (t *Tracker) Untrack(addr net.Addr, id, seq int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.outstanding, probeKey{addr.String(), id, EchoSeq(seq)})
+}
+
+// Answered removes a probe from the outstanding set by its echo or probe sequence number, returning false if
+// it wasn't outstanding
+func (t *Tracker) Answered(addr net.Addr, id, seq int) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := probeKey{addr.String(), id, EchoSeq(seq)}
+	if _, ok := t.outstanding[key]; !ok {
+		return false
+	}
+	delete(t.outstanding, key)
+	t.answered++
+	return true
+}
+
+// AnsweredLatest removes the most recent probe to an address from the outstanding set, returning its
+// probe sequence number and send time, or false if it wasn't outstanding
+func (t *Tracker) AnsweredLatest(addr net.Addr, id int) (int, time.Time, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	seq, ok := t.latest[latestKey{addr.String(), id}]
+	if !ok {
+		return 0, time.Time{}, false
+	}
+	key := probeKey{addr.String(), id, EchoSeq(seq)}
+	probe, ok := t.outstanding[key]
+	if !ok {
+		return 0, time.Time{}, false
+	}
+	delete(t.outstanding, key)
+	t.answered++
+	return seq, probe.Sent, true
+}
+
+// Answers returns how many outstanding probes have been answered
+func (t *Tracker) Answers() uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.answered
+}
+
+// Expire removes probes sent more than timeout ago and returns how many were removed
+func (t *Tracker) Expire(timeout time.Duration) int {
+	return len(t.ExpireOutstanding(timeout))
+}
+
+// ExpireOutstanding removes probes sent more than timeout ago and returns them
+func (t *Tracker) ExpireOutstanding(timeout time.Duration) []Outstanding {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var expired []Outstanding
+	deadline := time.Now().Add(-timeout)
+	for key, probe := range t.outstanding {
+		if probe.Sent.Before(deadline) {
+			delete(t.outstanding, key)
+			expired = append(expired, probe)
+		}
+	}
+	for key, seq := range t.latest {
+		if _, ok := t.outstanding[probeKey{key.addr, key.id, EchoSeq(seq)}]; !ok {
+			delete(t.latest, key)
+		}
+	}
+	return expired
+}
@@ -0,0 +1,95 @@
+package verfploeter
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// TTLConn is an ICMP socket that also reads the TTL or hop limit and the destination address of each packet
+// from control messages
+type TTLConn struct {
+	net.PacketConn
+	read func(b []byte) (int, int, net.IP, net.Addr, error)
+}
+
+// NewTTLConn enables TTL (proto 1) or hop limit (proto 58) control messages on c, which must be a raw
+// *net.IPConn or an ICMP datagram *net.UDPConn. Destination addresses are read too where the platform
+// supports it.
+func NewTTLConn(c net.PacketConn, proto int) (*TTLConn, error) {
+	if proto == 1 {
+		p := ipv4.NewPacketConn(c)
+		if err := p.SetControlMessage(ipv4.FlagTTL, true); err != nil {
+			return nil, err
+		}
+		_ = p.SetControlMessage(ipv4.FlagDst, true)
+		return &TTLConn{PacketConn: c, read: func(b []byte) (int, int, net.IP, net.Addr, error) {
+			n, cm, src, err := p.ReadFrom(b)
+			if cm == nil {
+				return n, 0, nil, src, err
+			}
+			return n, cm.TTL, cm.Dst, src, err
+		}}, nil
+	}
+
+	p := ipv6.NewPacketConn(c)
+	if err := p.SetControlMessage(ipv6.FlagHopLimit, true); err != nil {
+		return nil, err
+	}
+	_ = p.SetControlMessage(ipv6.FlagDst, true)
+	return &TTLConn{PacketConn: c, read: func(b []byte) (int, int, net.IP, net.Addr, error) {
+		n, cm, src, err := p.ReadFrom(b)
+		if cm == nil {
+			return n, 0, nil, src, err
+		}
+		return n, cm.HopLimit, cm.Dst, src, err
+	}}, nil
+}
+
+// NewHeaderTTLConn wraps an IPv4 ICMP datagram socket whose reads start with the IP header, as on macOS,
+// stripping the header and reading the TTL and destination address from it
+func NewHeaderTTLConn(c net.PacketConn) *TTLConn {
+	return &TTLConn{PacketConn: c, read: func(b []byte) (int, int, net.IP, net.Addr, error) {
+		n, src, err := c.ReadFrom(b)
+		if n < ipv4.HeaderLen {
+			return n, 0, nil, src, err
+		}
+		hl := int(b[0]&0x0f) << 2
+		if hl < ipv4.HeaderLen || hl > n {
+			return n, 0, nil, src, err
+		}
+		ttl := int(b[8])
+		dst := net.IPv4(b[16], b[17], b[18], b[19])
+		return copy(b, b[hl:n]), ttl, dst, src, err
+	}}
+}
+
+// ReadFromTTL reads a packet and its TTL or hop limit, which is zero if the kernel didn't report it.
+// Addresses are always returned as *net.IPAddr.
+func (c *TTLConn) ReadFromTTL(b []byte) (int, int, net.Addr, error) {
+	n, ttl, _, src, err := c.ReadMsg(b)
+	return n, ttl, src, err
+}
+
+// ReadMsg reads a packet, its TTL or hop limit, and the local address it was sent to, which are zero and nil
+// if the kernel didn't report them. Addresses are always returned as *net.IPAddr.
+func (c *TTLConn) ReadMsg(b []byte) (int, int, net.IP, net.Addr, error) {
+	n, ttl, dst, src, err := c.read(b)
+	if addr, ok := src.(*net.UDPAddr); ok {
+		src = &net.IPAddr{IP: addr.IP, Zone: addr.Zone}
+	}
+	return n, ttl, dst, src, err
+}
+
+// HopCount infers how many hops a reply took from its received TTL, assuming the responder used the
+// smallest common initial TTL (32, 64, 128, or 255) that is at least the received one. It is only
+// meaningful for a nonzero TTL.
+func HopCount(ttl int) int {
+	for _, initial := range []int{32, 64, 128, 255} {
+		if ttl <= initial {
+			return initial - ttl
+		}
+	}
+	return 0
+}
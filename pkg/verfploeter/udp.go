@@ -0,0 +1,138 @@
+package verfploeter
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// UDP probes are sent from port ProbePortBase plus the node ID with an operator-supplied payload, such as
+// a DNS query. Either an application reply or an ICMP port unreachable from the target shows that the
+// probe reached it. Neither carries a sequence number, so replies are matched to the latest probe.
+const UDPHeaderLen = 8
+
+// UDPProber sends datagrams with a payload to a port. Sweep IDs and target indexes can't be carried in the
+// datagram, so replies to UDP probes aren't attributed to a sweep.
+type UDPProber struct {
+	ID       int
+	Port     int
+	Payload  []byte
+	Protocol string       // Name probes are tracked with, such as udp or chaos
+	Conn4    PacketWriter // Sends IPv4 datagrams, such as an ip4:udp socket
+	Conn6    PacketWriter // Sends IPv6 datagrams, such as an ip6:udp socket with kernel checksums enabled
+	Tracker  *Tracker
+}
+
+// Build creates a datagram to addr for a target. The IPv4 checksum is optional and left as zero, the kernel
+// fills in the IPv6 checksum.
+func (p *UDPProber) Build(addr *net.IPAddr, target string, sweep uint32) *Probe {
+	b := make([]byte, UDPHeaderLen+len(p.Payload))
+	binary.BigEndian.PutUint16(b[0:2], uint16(ProbePortBase+p.ID))
+	binary.BigEndian.PutUint16(b[2:4], uint16(p.Port))
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(b)))
+	copy(b[UDPHeaderLen:], p.Payload)
+	return &Probe{Addr: addr, Target: target, Seq: p.Tracker.Next(), Sweep: sweep, Sent: time.Now(), Packet: b}
+}
+
+// Send sends a datagram and tracks it as outstanding
+func (p *UDPProber) Send(probe *Probe) error {
+	conn := p.Conn6
+	if probe.Addr.IP.To4() != nil {
+		conn = p.Conn4
+	}
+	return sendTracked(p.Tracker, conn, probe, p.ID, p.Protocol)
+}
+
+// UDPListener reads the application replies and port unreachables that answer UDP probes to a port from
+// this node or another known node
+type UDPListener struct {
+	ID      uint16
+	Port    int
+	Tracker *Tracker // Probes sent by this node
+	Nodes   KnownNodes
+}
+
+// Parse correlates a datagram read from a raw UDP socket, returning ErrNotReply for any other traffic and
+// unsolicited replies as a *ReplyError. Results carry the application's reply in Data.
+func (l *UDPListener) Parse(b []byte, src net.Addr) (*Result, error) {
+	if len(b) < UDPHeaderLen || int(binary.BigEndian.Uint16(b[0:2])) != l.Port {
+		return nil, ErrNotReply
+	}
+	result, err := l.correlate(int(binary.BigEndian.Uint16(b[2:4])), src, "udp")
+	if err != nil {
+		return nil, err
+	}
+	result.Data = append([]byte{}, b[UDPHeaderLen:]...)
+	return result, nil
+}
+
+// Unreachable correlates an ICMP port unreachable quoting a UDP probe, returning ErrNotReply for any other
+// error, which are left to Listener.Correlate
+func (l *UDPListener) Unreachable(e *ICMPError) (*Result, error) {
+	body, ok := e.Message.Body.(*icmp.DstUnreach)
+	if !ok || (e.Proto == 1 && e.Message.Code != 3) || (e.Proto == 58 && e.Message.Code != 4) {
+		return nil, ErrNotReply
+	}
+	_, srcPort, dstPort, ok := QuotedUDP(e.Proto, body.Data)
+	if !ok || dstPort != l.Port {
+		return nil, ErrNotReply
+	}
+	result, err := l.correlate(srcPort, e.Src, "port-unreachable")
+	if result != nil {
+		result.Proto = e.Proto
+	}
+	return result, err
+}
+
+// correlate matches a reply from src to a UDP probe sent from a source port
+func (l *UDPListener) correlate(port int, src net.Addr, response string) (*Result, error) {
+	node, ok := portNode(port)
+	if !ok {
+		return nil, ErrNotReply
+	}
+
+	// Only our own probes are tracked, so only they have a sequence number and send time
+	result := &Result{Time: time.Now(), Collector: l.ID, Node: uint16(node), Src: src, Response: response}
+	var solicited bool
+	if node == int(l.ID) {
+		result.Seq, result.Sent, solicited = l.Tracker.AnsweredLatest(src, node)
+	} else {
+		solicited = l.Nodes.known(node)
+	}
+	if !solicited {
+		return nil, &ReplyError{Err: ErrUnsolicited, Src: src, ID: node, Seq: result.Seq}
+	}
+	return result, nil
+}
+
+// Serve passes every reply read from pc, a raw UDP socket, to h until the socket is closed
+func (l *UDPListener) Serve(pc net.PacketConn, h Handler) error {
+	return serveRaw(pc, h, l.Parse)
+}
+
+// QuotedUDP extracts the destination address and ports of the UDP datagram quoted in an ICMP error
+// message, where proto is 1 for ICMP or 58 for ICMPv6
+func QuotedUDP(proto int, quoted []byte) (net.IP, int, int, bool) {
+	var hdrLen int
+	var dst net.IP
+	if proto == 1 {
+		if len(quoted) < 20 || quoted[9] != 17 {
+			return nil, 0, 0, false
+		}
+		hdrLen = int(quoted[0]&0x0f) << 2
+		dst = net.IP(quoted[16:20])
+	} else {
+		if len(quoted) < 40 || quoted[6] != 17 {
+			return nil, 0, 0, false // Extension headers are not supported
+		}
+		hdrLen = 40
+		dst = net.IP(quoted[24:40])
+	}
+	if len(quoted) < hdrLen+4 {
+		return nil, 0, 0, false
+	}
+	udp := quoted[hdrLen:]
+	return append(net.IP{}, dst...), int(binary.BigEndian.Uint16(udp[0:2])), int(binary.BigEndian.Uint16(udp[2:4])), true
+}
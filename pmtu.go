@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv6"
+
+	"github.com/natesales/go-verfploeter/pkg/verfploeter"
+)
+
+// minPMTUSize is the smallest path MTU probe, an IPv6 echo request with an unsigned payload. Smaller
+// probes are padded, as are signed ones.
+const minPMTUSize = ipv6.HeaderLen + 8 + verfploeter.PayloadHeaderLen
+
+// pathMTUMapper estimates the path MTU to every target in each sweep from probes of increasing size sent
+// with the don't fragment flag set. The estimate is the smallest next-hop MTU reported by a router, or the
+// largest probe answered if none was. Targets that stop answering above some size without an error are
+// behind a PMTU black hole.
+type pathMTUMapper struct {
+	sizes []int // IP packet sizes probed, ascending
+
+	targets    *prometheus.GaugeVec
+	blackholes *prometheus.GaugeVec
+	seen       map[string]map[string]bool // MTUs set for each node, so ones no longer seen drop to zero
+}
+
+// targetMTU is what the path MTU probes to a target found in a sweep
+type targetMTU struct {
+	answered int  // Largest probe answered
+	reported int  // Smallest next-hop MTU reported, zero if none
+	tooBig   bool // A router reported a probe as too big
+}
+
+// pmtu is nil unless probe.pmtu is set
+var pmtu *pathMTUMapper
+
+func newPathMTUMapper(sizes []int, reg prometheus.Registerer, constLabels prometheus.Labels) *pathMTUMapper {
+	factory := promauto.With(reg)
+	return &pathMTUMapper{
+		sizes: sizes,
+		targets: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "verfploeter_path_mtu_targets",
+			ConstLabels: constLabels,
+		}, []string{"dst", "mtu"}),
+		blackholes: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "verfploeter_path_mtu_blackholes",
+			ConstLabels: constLabels,
+		}, []string{"dst"}),
+		seen: map[string]map[string]bool{},
+	}
+}
+
+// tally adds a reply or error to a path MTU probe to the targets of a sweep
+func (m *pathMTUMapper) tally(targets map[string]*targetMTU, record replyRecord) {
+	if record.Size == 0 || record.Target == "" {
+		return
+	}
+	t, ok := targets[record.Target]
+	if !ok {
+		t = &targetMTU{}
+		targets[record.Target] = t
+	}
+	switch {
+	case record.Error == "":
+		if record.Size > t.answered {
+			t.answered = record.Size
+		}
+	case isTooBig(record):
+		t.tooBig = true
+		if record.MTU > 0 && (t.reported == 0 || record.MTU < t.reported) {
+			t.reported = record.MTU
+		}
+	}
+}
+
+// isTooBig checks if an ICMP error reports a probe as too big for the next hop
+func isTooBig(record replyRecord) bool {
+	return record.Error == "packet_too_big" || (record.Error == "destination_unreachable" && record.Code == 4)
+}
+
+// finish sets the MTU distribution of a node's sweep and adds it to the sweep summary
+func (m *pathMTUMapper) finish(dst string, targets map[string]*targetMTU, fields log.Fields) {
+	counts := map[string]int{}
+	blackholes := 0
+	for _, t := range targets {
+		mtu := t.answered
+		if t.reported > 0 {
+			mtu = t.reported
+		}
+		if mtu == 0 {
+			continue
+		}
+		counts[strconv.Itoa(mtu)]++
+		if !t.tooBig && t.answered < m.sizes[len(m.sizes)-1] {
+			blackholes++
+		}
+	}
+
+	previous := m.seen[dst]
+	m.seen[dst] = map[string]bool{}
+	for mtu, n := range counts {
+		m.targets.With(map[string]string{"dst": dst, "mtu": mtu}).Set(float64(n))
+		m.seen[dst][mtu] = true
+	}
+	for mtu := range previous {
+		if !m.seen[dst][mtu] {
+			m.targets.With(map[string]string{"dst": dst, "mtu": mtu}).Set(0)
+		}
+	}
+	m.blackholes.With(map[string]string{"dst": dst}).Set(float64(blackholes))
+
+	if len(counts) > 0 {
+		fields["pmtu"] = topCounts(counts)
+		fields["pmtu_blackholes"] = blackholes
+	}
+}
+
+// checkPMTUSizes sorts the path MTU probe sizes, checking that each fits in a probe and an unfragmented packet
+func checkPMTUSizes(sizes []int) error {
+	sort.Ints(sizes)
+	for i, size := range sizes {
+		if size < minPMTUSize || size > mtu {
+			return fmt.Errorf("probe.pmtu size %d out of range %d-%d", size, minPMTUSize, mtu)
+		}
+		if i > 0 && size == sizes[i-1] {
+			return fmt.Errorf("probe.pmtu size %d is repeated", size)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build windows || plan9
+
+package main
+
+import "errors"
+
+// dropPrivileges is only supported on Unix
+func dropPrivileges(config *Config) error {
+	if config.Security.User == "" {
+		return nil
+	}
+	return errors.New("security.user is only supported on Unix")
+}
+
+// lookupCredentials is only supported on Unix
+func lookupCredentials(_, _ string) (int, int, error) {
+	return 0, 0, errors.New("security.user is only supported on Unix")
+}
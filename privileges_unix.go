@@ -0,0 +1,65 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dropPrivileges switches to security.user and security.group once every socket is open, doing nothing if
+// security.user isn't set. Leaving root clears every capability, so nothing can open raw sockets or bind
+// privileged ports afterwards.
+func dropPrivileges(config *Config) error {
+	if config.Security.User == "" {
+		return nil
+	}
+	uid, gid, err := lookupCredentials(config.Security.User, config.Security.Group)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups: %s", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %s", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %s", err)
+	}
+	if uid != 0 && syscall.Setuid(0) == nil {
+		return errors.New("regained root after dropping privileges")
+	}
+	log.Infof("Running as user %s (uid %d, gid %d)", config.Security.User, uid, gid)
+	return nil
+}
+
+// lookupCredentials returns the IDs of a user and group, which defaults to the user's primary group
+func lookupCredentials(username, groupname string) (int, int, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return 0, 0, err
+	}
+	gidString := u.Gid
+	if groupname != "" {
+		g, err := user.LookupGroup(groupname)
+		if err != nil {
+			return 0, 0, err
+		}
+		gidString = g.Gid
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid uid %q for user %s", u.Uid, username)
+	}
+	gid, err := strconv.Atoi(gidString)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid gid %q", gidString)
+	}
+	return uid, gid, nil
+}
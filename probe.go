@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/natesales/go-verfploeter/pkg/verfploeter"
+	log "github.com/sirupsen/logrus"
+)
+
+// errExcluded is returned for targets that resolve to an excluded address
+var errExcluded = errors.New("target address is excluded")
+
+// sendProbe sends a probe to a given target using its profile's protocol
+func sendProbe(p probeTarget) error {
+	proto := p.profile.config.Probe.Protocol
+	if fallback != nil {
+		proto = p.protocol
+		if proto == "" {
+			proto = fallback.first(p.target)
+		}
+	}
+	switch proto {
+	case protocolTCP:
+		return tcpProbe(p)
+	case protocolUDP, protocolChaos:
+		return udpProbe(p)
+	}
+	return icmpProbe(p)
+}
+
+// icmpProbe sends an ICMP echo request to a given target, as part of a sweep if the sweep is nonzero
+func icmpProbe(p probeTarget) error {
+	target := p.target
+	metrics := p.profile.metrics
+	targetIP, err := resolver.lookup(target)
+	if err != nil {
+		metrics.countProbeError(probeErrorResolve, nil)
+		return err
+	}
+	if isExcluded(targetIP.IP) {
+		return errExcluded
+	}
+
+	index := p.profile.index(target)
+	sources := p.profile.sources.Pick(targetIP.IP)
+	if len(sources) == 0 {
+		metrics.countProbeError(probeErrorNoSource, targetIP.IP)
+		return fmt.Errorf("no source address to probe %s from", targetIP)
+	}
+	sizes := []int{p.size}
+	if pmtu != nil && p.size == 0 {
+		sizes = pmtu.sizes
+	}
+	for _, source := range sources {
+		for _, size := range sizes {
+			if err := sendICMP(source, p, targetIP, index, size); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sendICMP sends an echo request from a source, padded to an IP packet of size bytes if size is nonzero
+func sendICMP(source *verfploeter.Source, p probeTarget, targetIP *net.IPAddr, index uint32, size int) error {
+	metrics := p.profile.metrics
+	var probe *verfploeter.Probe
+	var err error
+	if size > 0 {
+		probe, err = source.Prober.BuildSize(targetIP, p.target, index, p.sweep, size)
+	} else {
+		probe, err = source.Prober.Build(targetIP, p.target, index, p.sweep)
+	}
+	if err != nil {
+		metrics.countProbeError(probeErrorMarshal, targetIP.IP)
+		return err
+	}
+	probe.Attempt = p.attempt
+	probe.Tag = p.profile.name
+
+	if *dryRun {
+		log.WithFields(log.Fields{
+			"target": p.target,
+			"addr":   targetIP.String(),
+			"source": source.Label(),
+			"id":     source.Prober.ID,
+			"seq":    probe.Seq,
+			"bytes":  len(probe.Packet),
+		}).Info("Dry run, not sending probe")
+		return nil
+	}
+
+	metrics.requests.Inc()
+	metrics.sourceRequests.With(map[string]string{"source": source.Label()}).Inc()
+	atomic.AddUint64(&sentTotal, 1)
+	if err := source.Prober.Send(probe); err != nil {
+		metrics.countProbeError(probeErrorWrite, targetIP.IP)
+		return err
+	}
+	return nil
+}
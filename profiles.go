@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/natesales/go-verfploeter/pkg/verfploeter"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+)
+
+// profileIndexBits is how many low bits of the target index in echo payloads are the index in the profile's
+// targets when the config has profiles, the high bits number the profile
+const profileIndexBits = 24
+
+// maxProfiles is how many profiles can be numbered in target indexes, leaving NoTarget unambiguous
+const maxProfiles = 1<<(32-profileIndexBits) - 1
+
+// profileOptions are the options a profile may set, by section, where nil allows every option of the section.
+// The rest of the config, such as the node ID, sockets, and sinks, is shared by every profile.
+var profileOptions = map[string]map[string]bool{
+	"targets": nil,
+	"probe": {
+		"mode":        true,
+		"strategy":    true,
+		"protocol":    true,
+		"interval":    true,
+		"rate_pps":    true,
+		"rate":        true,
+		"burst":       true,
+		"source4":     true,
+		"source6":     true,
+		"sources":     true,
+		"source_mode": true,
+		"workers":     true,
+	},
+}
+
+// probeProfile is a set of targets probed in a loop of its own, at its own rate, with its own protocol and
+// sources. A config without profiles is probed as a single unnamed profile.
+type probeProfile struct {
+	name    string
+	num     uint32  // Position in the config, carried in target indexes
+	config  *Config // Rest of the config with the profile applied
+	targets *targetList
+	files   []string // Targets files and URLs to reload the targets from
+	sources verfploeter.Sources
+	control *controlState
+	metrics *probeMetrics
+	retries chan probeTarget
+	next    func() probeTarget
+
+	// answered counts replies to this node's probes since the loss ratio was last updated
+	answered uint64
+}
+
+// profiles are probed concurrently, set once at startup
+var profiles []*probeProfile
+
+// applyProfile decodes a profile over the rest of the config. Fields the profile sets replace the config's.
+func applyProfile(config *Config, name string) error {
+	node, ok := config.Profiles[name]
+	if !ok {
+		return fmt.Errorf("no profile %q in config", name)
+	}
+	if err := checkProfileOptions(&node); err != nil {
+		return err
+	}
+
+	// Nodes are decoded without rejecting unknown keys, so decode the profile's YAML instead
+	profileBytes, err := yaml.Marshal(&node)
+	if err != nil {
+		return fmt.Errorf("unable to parse profile %s: %s", name, err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(profileBytes))
+	dec.KnownFields(true)
+	if err := dec.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("unable to parse profile %s: %s", name, yamlError(err))
+	}
+	return nil
+}
+
+// checkProfileOptions checks that a profile only sets options in profileOptions
+func checkProfileOptions(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return errors.New("must be a map of options")
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		section, value := node.Content[i].Value, node.Content[i+1]
+		options, ok := profileOptions[section]
+		if !ok {
+			return fmt.Errorf("%s can't be set per profile", section)
+		}
+		if options == nil || value.Kind != yaml.MappingNode {
+			continue
+		}
+		for j := 0; j+1 < len(value.Content); j += 2 {
+			if option := value.Content[j].Value; !options[option] {
+				return fmt.Errorf("%s.%s can't be set per profile", section, option)
+			}
+		}
+	}
+	return nil
+}
+
+// checkProfiles validates every profile of a config. Options that steer a single probe loop can't be used
+// with profiles, since each profile has a loop of its own.
+func checkProfiles(filename string, config *Config) error {
+	if len(config.Profiles) > maxProfiles {
+		return fmt.Errorf("too many profiles (%d, at most %d)", len(config.Profiles), maxProfiles)
+	}
+	for option, set := range map[string]bool{
+		"api.control":    config.API.Control,
+		"probe.schedule": config.Probe.Schedule.Cron != "" || len(config.Probe.Schedule.Windows) > 0,
+		"probe.fallback": len(config.Probe.Fallback.Protocols) > 0 || len(config.Probe.Fallback.Targets) > 0,
+	} {
+		if set {
+			return fmt.Errorf("%s can't be used with profiles", option)
+		}
+	}
+	protocols := map[string]bool{}
+	for _, name := range profileNames(config) {
+		profile, err := loadProfile(filename, name)
+		if err != nil {
+			return fmt.Errorf("profile %s: %s", name, err)
+		}
+		protocols[profile.Probe.Protocol] = true
+	}
+
+	// UDP and CHAOS probes share the raw UDP sockets and the payload they send
+	if protocols[protocolUDP] && protocols[protocolChaos] {
+		return fmt.Errorf("profiles can't probe with both %s and %s", protocolUDP, protocolChaos)
+	}
+	return nil
+}
+
+// profileNames returns the names of a config's profiles in order
+func profileNames(config *Config) []string {
+	names := make([]string, 0, len(config.Profiles))
+	for name := range config.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadProfiles returns the profiles of a config, or a single profile of the whole config if it has none or
+// -profile picked one
+func loadProfiles(config *Config) ([]*probeProfile, error) {
+	if len(config.Profiles) == 0 || *profileName != "" {
+		return []*probeProfile{{name: *profileName, config: config, targets: &targets, control: control}}, nil
+	}
+	var list []*probeProfile
+	for i, name := range profileNames(config) {
+		profileConfig, err := loadProfile(*configFile, name)
+		if err != nil {
+			return nil, err
+		}
+		profileConfig.Role = config.Role // Which may be set by the command
+		list = append(list, &probeProfile{
+			name:    name,
+			num:     uint32(i),
+			config:  profileConfig,
+			targets: &targetList{},
+			control: &controlState{},
+		})
+	}
+	return list, nil
+}
+
+// findProfile returns the profile with a name, or the first profile if the name is empty
+func findProfile(name string) (*probeProfile, bool) {
+	if name == "" {
+		return profiles[0], true
+	}
+	for _, p := range profiles {
+		if p.name == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// recordProfile returns the profile that sent the probe a reply answered, the first profile if it's unknown
+func recordProfile(record replyRecord) *probeProfile {
+	if p, ok := findProfile(record.Profile); ok {
+		return p
+	}
+	return profiles[0]
+}
+
+// addrProfile returns the first profile that probes an address, or the first profile if none does
+func addrProfile(ip net.IP) *probeProfile {
+	for _, p := range profiles {
+		if p.targets.contains(ip) {
+			return p
+		}
+	}
+	return profiles[0]
+}
+
+// targetProfile returns the first profile that probes a target, by name or address, or the first profile if
+// none does
+func targetProfile(target string) *probeProfile {
+	for _, p := range profiles {
+		if _, ok := p.targets.index(target); ok {
+			return p
+		}
+	}
+	if ip := net.ParseIP(target); ip != nil {
+		return addrProfile(ip)
+	}
+	return profiles[0]
+}
+
+// targetAt returns the target at an index carried in an echo payload and the profile that probes it, which
+// is nil outside of probing, such as in analyze. Indexes only resolve correctly across nodes if every node
+// has the same profiles.
+func targetAt(index uint32) (string, *probeProfile, bool) {
+	if len(profiles) == 0 {
+		target, ok := targets.at(int(index))
+		return target, nil, ok
+	}
+	p := profiles[0]
+	if len(profiles) > 1 {
+		num := index >> profileIndexBits
+		if index == verfploeter.NoTarget || int(num) >= len(profiles) {
+			return "", nil, false
+		}
+		p, index = profiles[num], index&(1<<profileIndexBits-1)
+	}
+	target, ok := p.targets.at(int(index))
+	return target, p, ok
+}
+
+// allTargets returns the targets of every profile
+func allTargets() []string {
+	if len(profiles) == 1 {
+		return profiles[0].targets.all()
+	}
+	var all []string
+	for _, p := range profiles {
+		all = append(all, p.targets.all()...)
+	}
+	return all
+}
+
+// targetsLoaded checks if every profile has targets
+func targetsLoaded() bool {
+	for _, p := range profiles {
+		if len(p.targets.all()) == 0 {
+			return false
+		}
+	}
+	return len(profiles) > 0
+}
+
+// index returns the index of a target in the profile's targets to carry in echo payloads
+func (p *probeProfile) index(target string) uint32 {
+	i, ok := p.targets.index(target)
+	if !ok {
+		return verfploeter.NoTarget
+	}
+	if len(profiles) <= 1 {
+		return uint32(i)
+	}
+	if i >= 1<<profileIndexBits {
+		return verfploeter.NoTarget
+	}
+	return p.num<<profileIndexBits | uint32(i)
+}
+
+// answer counts a reply to one of the profile's probes sent by node, returning the node's name
+func (p *probeProfile) answer(node uint16) string {
+	dst := findNode(node, currentNodes())
+	p.metrics.replies.With(map[string]string{"dst": dst}).Inc()
+	p.countAnswer(node)
+	return dst
+}
+
+// countAnswer counts a reply or ICMP error towards the profile's loss ratio if it answers one of this
+// node's probes
+func (p *probeProfile) countAnswer(node uint16) {
+	if node == listener.ID {
+		atomic.AddUint64(&p.answered, 1)
+	}
+}
+
+// loadTargets loads the profile's initial targets
+func (p *probeProfile) loadTargets(config *Config) error {
+	files, initialTargets, err := loadInitialTargets(p.config, config)
+	if err != nil {
+		if p.name != "" {
+			return fmt.Errorf("profile %s: %s", p.name, err)
+		}
+		return err
+	}
+	p.files = files
+	p.targets.set(initialTargets)
+	return nil
+}
+
+// sourceNames returns the profile's source addresses as configured
+func (p *probeProfile) sourceNames() []string {
+	if len(p.config.Probe.Sources) > 0 {
+		return p.config.Probe.Sources
+	}
+	var names []string
+	for _, source := range []string{p.config.Probe.Source4, p.config.Probe.Source6} {
+		if source != "" {
+			names = append(names, source)
+		}
+	}
+	return names
+}
+
+// logger returns the logger of the profile's probe loop, which adds the profile to every entry
+func (p *probeProfile) logger() *log.Entry {
+	if p.name == "" || *profileName != "" {
+		return log.NewEntry(log.StandardLogger())
+	}
+	return log.WithField("profile", p.name)
+}
+
+// start picks how the profile's targets are probed and attaches its rate limiter to its control state
+func (p *probeProfile) start() error {
+	// Either pick targets with the configured strategy or sweep over all of them in order
+	next, err := newStrategy(p.config, p.targets)
+	if err != nil {
+		return err
+	}
+	var sweep *sweeper
+	if p.config.Probe.Mode == modeSweep {
+		sweep = newSweeper(p.targets)
+		next = sweep.next
+	}
+	if backoff != nil {
+		next = backoff.wrap(next)
+	}
+	p.next = next
+	p.retries = make(chan probeTarget, 1024)
+	p.control.start(p.config, p.targets, rate.NewLimiter(probeRate(p.config), probeBurst(p.config)), sweep)
+	return nil
+}
+
+// probesLeft is how many more probes -count allows, shared by every profile
+var probesLeft int64
+
+// reserveProbe takes one of the probes left under -count, returning false once every profile together has
+// sent that many
+func reserveProbe() bool {
+	return *count == 0 || atomic.AddInt64(&probesLeft, -1) >= 0
+}
+
+// run sends the profile's probes as evenly as its rate limiter allows until ctx is done or the profiles have
+// sent -count probes between them, then waits for the probes being sent
+func (p *probeProfile) run(ctx context.Context) {
+	logger := p.logger()
+
+	// Resolve and send probes on a pool of workers so a slow DNS lookup doesn't stall the others.
+	// Writes to the sockets are safe for concurrent use, so the workers share them.
+	probes := make(chan probeTarget, p.config.Probe.Workers)
+	var workers sync.WaitGroup
+	for i := 0; i < p.config.Probe.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for pt := range probes {
+				fields := log.Fields{"target": pt.target, "sweep": pt.sweep, "attempt": pt.attempt}
+				if pt.protocol != "" {
+					fields["protocol"] = pt.protocol
+				}
+				logger.WithFields(fields).Debug("Sending probe")
+				if err := sendProbe(pt); errors.Is(err, errUnresolved) || errors.Is(err, errExcluded) {
+					logger.WithField("target", pt.target).Debug(err)
+				} else if err != nil {
+					logger.WithField("target", pt.target).Warn(err)
+				} else {
+					atomic.StoreInt64(&lastProbe, time.Now().UnixNano())
+				}
+				atomic.StoreInt32(&probing, 1)
+			}
+		}()
+	}
+
+	limiter := p.control.limiter
+	for {
+		// Waits only fail once the duration has elapsed
+		if !p.control.wait(ctx) {
+			break
+		}
+		if schedule != nil && !schedule.wait(ctx, p.control.sweepDone) {
+			break
+		}
+		if err := limiter.Wait(ctx); err != nil {
+			break
+		}
+
+		// Retransmits take priority over new probes and don't count towards -count
+		select {
+		case pt := <-p.retries:
+			pt.profile = p
+			probes <- pt
+			pingWatchdog()
+			continue
+		default:
+		}
+		if !reserveProbe() {
+			break
+		}
+		pt := p.control.next(p.next)
+		pt.profile = p
+		if otlp != nil {
+			otlp.sweep(pt.sweep)
+		}
+		probes <- pt
+		pingWatchdog()
+	}
+	close(probes)
+	workers.Wait()
+}
+
+// reload applies the probe rate of a reloaded config, or of the profile applied to it, and re-reads the
+// profile's targets
+func (p *probeProfile) reload(newConfig *Config) {
+	if newConfig != nil && p.name != "" && *profileName == "" {
+		var err error
+		if newConfig, err = loadProfile(*configFile, p.name); err != nil {
+			p.logger().Warnf("Keeping current config: %s", err)
+			newConfig = nil
+		}
+	}
+	if newConfig != nil {
+		if newConfig.Probe.Rate <= 0 && newConfig.Probe.Interval <= 0 {
+			p.logger().Warnf("Ignoring invalid probe interval %s on reload", newConfig.Probe.Interval)
+		} else {
+			p.control.reloadRate(newConfig.Probe.Interval, newConfig.Probe.Rate, newConfig.Probe.Burst)
+		}
+		if len(profiles) > 1 {
+			p.warnRestart(newConfig)
+		}
+	}
+	reloadTargets(p.targets, p.files)
+}
+
+// warnRestart logs the options the profile sets that changed in a reloaded config but require a restart
+func (p *probeProfile) warnRestart(newConfig *Config) {
+	probe, newProbe := p.config.Probe, newConfig.Probe
+	for option, changed := range map[string]bool{
+		"targets":           !reflect.DeepEqual(newConfig.Targets, p.config.Targets),
+		"probe.mode":        newProbe.Mode != probe.Mode,
+		"probe.strategy":    newProbe.Strategy != probe.Strategy,
+		"probe.protocol":    newProbe.Protocol != probe.Protocol,
+		"probe.source4":     newProbe.Source4 != probe.Source4,
+		"probe.source6":     newProbe.Source6 != probe.Source6,
+		"probe.sources":     !reflect.DeepEqual(newProbe.Sources, probe.Sources),
+		"probe.source_mode": newProbe.SourceMode != probe.SourceMode,
+		"probe.workers":     newProbe.Workers != probe.Workers,
+	} {
+		if changed {
+			p.logger().Warnf("Ignoring change to %s on reload (requires restart)", option)
+		}
+	}
+}
+
+// profileHook adds the profile picked with -profile to every log entry
+type profileHook string
+
+func (h profileHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h profileHook) Fire(entry *log.Entry) error {
+	entry.Data["profile"] = string(h)
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReserveProbeSharedByProfiles(t *testing.T) {
+	defer func(n int) { *count = n }(*count)
+	*count = 100
+	atomic.StoreInt64(&probesLeft, int64(*count))
+
+	// Every profile's loop takes from the same -count
+	var reserved int64
+	var loops sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			for reserveProbe() {
+				atomic.AddInt64(&reserved, 1)
+			}
+		}()
+	}
+	loops.Wait()
+	if reserved != 100 {
+		t.Errorf("profiles reserved %d probes, want 100", reserved)
+	}
+}
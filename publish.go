@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// publisher sends encoded reply events to a message bus
+type publisher interface {
+	publish(key string, value []byte) error
+	close() error
+}
+
+// kafkaPublisher produces reply events to a Kafka topic, keyed by collector
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func newKafkaPublisher(brokers []string, topic string) *kafkaPublisher {
+	return &kafkaPublisher{writer: &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		BatchTimeout: time.Second,
+		Async:        true,
+		Completion: func(messages []kafka.Message, err error) {
+			if err != nil {
+				log.Warnf("Unable to publish %d replies to Kafka: %s", len(messages), err)
+			}
+		},
+	}}
+}
+
+func (p *kafkaPublisher) publish(key string, value []byte) error {
+	return p.writer.WriteMessages(context.Background(), kafka.Message{Key: []byte(key), Value: value})
+}
+
+func (p *kafkaPublisher) close() error {
+	return p.writer.Close()
+}
+
+// natsPublisher publishes reply events to a NATS subject
+type natsPublisher struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func newNATSPublisher(url, subject string) (*natsPublisher, error) {
+	conn, err := nats.Connect(url, nats.Name("verfploeter"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	return &natsPublisher{conn: conn, subject: subject}, nil
+}
+
+func (p *natsPublisher) publish(_ string, value []byte) error {
+	return p.conn.Publish(p.subject, value)
+}
+
+func (p *natsPublisher) close() error {
+	return p.conn.Drain()
+}
+
+// publisherSink encodes replies as JSON events and hands them to a publisher from its own goroutine
+type publisherSink struct {
+	name      string
+	publisher publisher
+	queue     *recordQueue
+	done      chan struct{}
+	errors    prometheus.Counter
+}
+
+func newPublisherSink(name string, p publisher, reg prometheus.Registerer, constLabels prometheus.Labels) *publisherSink {
+	factory := promauto.With(reg)
+	s := &publisherSink{
+		name:      name,
+		publisher: p,
+		queue: newRecordQueue(4096, factory.NewCounter(prometheus.CounterOpts{
+			Name:        "verfploeter_publish_dropped_total",
+			ConstLabels: withLabel(constLabels, "bus", name),
+		})),
+		done: make(chan struct{}),
+		errors: factory.NewCounter(prometheus.CounterOpts{
+			Name:        "verfploeter_publish_errors_total",
+			ConstLabels: withLabel(constLabels, "bus", name),
+		}),
+	}
+	go s.run()
+	return s
+}
+
+// write queues a reply to be published
+func (s *publisherSink) write(record replyRecord) {
+	s.queue.write(record)
+}
+
+// close publishes any queued replies and closes the publisher
+func (s *publisherSink) close() {
+	s.queue.close()
+	<-s.done
+	if err := s.publisher.close(); err != nil {
+		log.Warnf("Closing %s publisher: %s", s.name, err)
+	}
+}
+
+func (s *publisherSink) run() {
+	defer close(s.done)
+	for record := range s.queue.records {
+		b, err := json.Marshal(record)
+		if err != nil {
+			log.Warnf("Unable to encode reply: %s", err)
+			continue
+		}
+		if err := s.publisher.publish(strconv.Itoa(int(record.Collector)), b); err != nil {
+			s.errors.Inc()
+			log.Debugf("Unable to publish reply to %s: %s", s.name, err)
+		}
+	}
+}
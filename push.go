@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// metricsPusher pushes the Prometheus metrics to a remote_write endpoint or a Pushgateway, for nodes that
+// can't be scraped
+type metricsPusher struct {
+	url      string
+	job      string
+	instance string
+	client   *bearerClient
+	gateway  *push.Pusher // Nil when using remote_write
+	errors   prometheus.Counter
+}
+
+// pusher is nil unless pushing metrics is configured
+var pusher *metricsPusher
+
+// bearerClient is an HTTP client that authenticates with a bearer token, if set
+type bearerClient struct {
+	client *http.Client
+	token  string
+}
+
+func (c *bearerClient) Do(req *http.Request) (*http.Response, error) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.client.Do(req)
+}
+
+// newMetricsPusher creates a pusher for the remote_write endpoint or Pushgateway in config
+func newMetricsPusher(config *Config, reg prometheus.Registerer, constLabels prometheus.Labels) (*metricsPusher, error) {
+	factory := promauto.With(reg)
+	tlsConfig, err := pushTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	p := &metricsPusher{
+		url:      config.Push.RemoteWrite,
+		job:      config.Push.Job,
+		instance: findNode(config.ID, currentNodes()),
+		client: &bearerClient{
+			client: &http.Client{
+				Timeout:   10 * time.Second,
+				Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+			},
+			token: config.Push.BearerToken,
+		},
+		errors: factory.NewCounter(prometheus.CounterOpts{
+			Name:        "verfploeter_push_errors_total",
+			ConstLabels: constLabels,
+		}),
+	}
+	if config.Push.Pushgateway != "" {
+		p.url = config.Push.Pushgateway
+		p.gateway = push.New(config.Push.Pushgateway, config.Push.Job).
+			Gatherer(prometheus.DefaultGatherer).
+			Grouping("instance", p.instance).
+			Client(p.client)
+	}
+	return p, nil
+}
+
+// pushTLSConfig loads the CA and client certificate for pushing metrics
+func pushTLSConfig(config *Config) (*tls.Config, error) {
+	c := config.Push.TLS
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CA != "" {
+		pem, err := os.ReadFile(c.CA)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read push.tls.ca: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CA)
+		}
+	}
+	if c.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load push.tls.cert: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// run pushes the metrics every interval
+func (p *metricsPusher) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		p.push()
+	}
+}
+
+// close pushes the final metrics
+func (p *metricsPusher) close() {
+	p.push()
+}
+
+// push sends the current value of every registered metric, counting and logging failures
+func (p *metricsPusher) push() {
+	var err error
+	if p.gateway != nil {
+		err = p.gateway.Push()
+	} else {
+		err = p.remoteWrite()
+	}
+	if err != nil {
+		p.errors.Inc()
+		log.Warnf("Unable to push metrics to %s: %s", p.url, err)
+	}
+}
+
+// remoteWrite sends the metrics as a snappy compressed protobuf WriteRequest, see
+// https://prometheus.io/docs/concepts/remote_write_spec/
+func (p *metricsPusher) remoteWrite() error {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		log.Warnf("Unable to gather metrics to push: %s", err)
+	}
+	now := time.Now().UnixMilli()
+	var body []byte
+	for _, family := range families {
+		for _, series := range p.series(family) {
+			body = protowire.AppendTag(body, 1, protowire.BytesType)
+			body = protowire.AppendBytes(body, series.marshal(now))
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(snappy.Encode(nil, body)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "verfploeter/"+version)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// remoteSeries is a single sample of a time series
+type remoteSeries struct {
+	labels map[string]string
+	value  float64
+}
+
+// series flattens a metric family into time series the way they're exposed for scraping, with histograms
+// and summaries split into their buckets or quantiles, sum, and count
+func (p *metricsPusher) series(family *dto.MetricFamily) []remoteSeries {
+	var series []remoteSeries
+	add := func(metric *dto.Metric, name string, value float64, extra ...string) {
+		labels := map[string]string{"__name__": name, "job": p.job, "instance": p.instance}
+		for _, label := range metric.Label {
+			labels[label.GetName()] = label.GetValue()
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			labels[extra[i]] = extra[i+1]
+		}
+		series = append(series, remoteSeries{labels, value})
+	}
+	name := family.GetName()
+	for _, metric := range family.Metric {
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			add(metric, name, metric.GetCounter().GetValue())
+		case dto.MetricType_GAUGE:
+			add(metric, name, metric.GetGauge().GetValue())
+		case dto.MetricType_UNTYPED:
+			add(metric, name, metric.GetUntyped().GetValue())
+		case dto.MetricType_HISTOGRAM:
+			h := metric.GetHistogram()
+			infSeen := false
+			for _, bucket := range h.Bucket {
+				if math.IsInf(bucket.GetUpperBound(), 1) {
+					infSeen = true
+				}
+				add(metric, name+"_bucket", float64(bucket.GetCumulativeCount()), "le", formatFloat(bucket.GetUpperBound()))
+			}
+			if !infSeen {
+				add(metric, name+"_bucket", float64(h.GetSampleCount()), "le", "+Inf")
+			}
+			add(metric, name+"_sum", h.GetSampleSum())
+			add(metric, name+"_count", float64(h.GetSampleCount()))
+		case dto.MetricType_SUMMARY:
+			s := metric.GetSummary()
+			for _, q := range s.Quantile {
+				add(metric, name, q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+			}
+			add(metric, name+"_sum", s.GetSampleSum())
+			add(metric, name+"_count", float64(s.GetSampleCount()))
+		}
+	}
+	return series
+}
+
+// formatFloat formats a bucket bound or quantile as Prometheus does
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// marshal encodes a TimeSeries message with labels sorted by name and a single sample
+func (s remoteSeries) marshal(timestamp int64) []byte {
+	names := make([]string, 0, len(s.labels))
+	for name := range s.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b []byte
+	for _, name := range names {
+		var label []byte
+		label = protowire.AppendTag(label, 1, protowire.BytesType)
+		label = protowire.AppendString(label, name)
+		label = protowire.AppendTag(label, 2, protowire.BytesType)
+		label = protowire.AppendString(label, s.labels[name])
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, label)
+	}
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(timestamp))
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, sample)
+}
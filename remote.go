@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// remoteTimeout bounds a single fetch of a remote targets list
+const remoteTimeout = time.Minute
+
+// remoteFile is the last copy of a remote file and the validators to request it conditionally
+type remoteFile struct {
+	body         []byte
+	etag         string
+	lastModified string
+}
+
+// remoteFiles caches fetched files by URL so unchanged lists aren't downloaded again
+var (
+	remoteLock  sync.Mutex
+	remoteFiles = map[string]*remoteFile{}
+	remoteHTTP  = &http.Client{Timeout: remoteTimeout}
+)
+
+// isURL checks if a targets or exclusions file name is an HTTP(S) URL
+func isURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// fetchURL downloads a file, sending the ETag and Last-Modified of the previous copy so an unchanged file
+// is answered with a 304 and served from the cache. It reports whether the file changed since the last fetch.
+func fetchURL(url string) ([]byte, bool, error) {
+	remoteLock.Lock()
+	cached := remoteFiles[url]
+	remoteLock.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("User-Agent", "verfploeter/"+version)
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+	resp, err := remoteHTTP.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		log.WithField("url", url).Debug("Remote file not modified")
+		return cached.body, false, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+
+	remoteLock.Lock()
+	remoteFiles[url] = &remoteFile{
+		body:         body,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+	remoteLock.Unlock()
+	log.WithField("url", url).Debugf("Fetched %d bytes", len(body))
+	return body, cached == nil || !bytes.Equal(body, cached.body), nil
+}
+
+// refreshTargets re-fetches remote targets lists on an interval, reloading them into list when one changes
+func refreshTargets(list *targetList, filenames []string, interval time.Duration) {
+	for range time.Tick(interval) {
+		changed := false
+		for _, filename := range filenames {
+			if !isURL(filename) {
+				continue
+			}
+			if _, modified, err := fetchURL(filename); err != nil {
+				log.WithField("url", filename).Warnf("Unable to refresh targets: %s", err)
+			} else if modified {
+				changed = true
+			}
+		}
+		if changed {
+			reloadTargets(list, filenames)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/natesales/go-verfploeter/pkg/verfploeter"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// replyRecord is a single echo reply as logged, written to results files, and exported to the controller
+type replyRecord struct {
+	Time        time.Time `json:"time"`
+	Collector   uint16    `json:"collector"` // Node that received the reply
+	Node        uint16    `json:"node"`      // Node that sent the probe
+	Responder   string    `json:"responder"`
+	Target      string    `json:"target,omitempty"`
+	Sweep       uint32    `json:"sweep,omitempty"`
+	Seq         int       `json:"seq"`
+	RTT         float64   `json:"rtt,omitempty"`          // Seconds, only meaningful across nodes with synced clocks
+	Response    string    `json:"response,omitempty"`     // syn-ack, rst, udp, or port-unreachable for TCP and UDP probes
+	Site        string    `json:"site,omitempty"`         // Site identity from a CHAOS TXT answer
+	Country     string    `json:"country,omitempty"`      // Responder's ISO country code, with GeoIP enabled
+	ASN         uint32    `json:"asn,omitempty"`          // Responder's origin AS, with GeoIP enabled
+	TTL         int       `json:"ttl,omitempty"`          // TTL or hop limit of the reply
+	Source      string    `json:"source,omitempty"`       // Local address the reply was received at, with multiple sources
+	Destination string    `json:"destination,omitempty"`  // Local address the reply was sent to, where the kernel reports it
+	AnycastSite string    `json:"anycast_site,omitempty"` // Site that received a reply sent to an anycast address
+	Announced   []string  `json:"announced,omitempty"`    // Prefixes the collector announced when the reply arrived, with BGP integration
+	Error       string    `json:"error,omitempty"`        // ICMP error received instead of a reply, from Responder
+	Code        int       `json:"code,omitempty"`         // ICMP code of the error
+	MTU         int       `json:"mtu,omitempty"`          // Next-hop MTU of a packet too big or fragmentation needed error
+	Size        int       `json:"size,omitempty"`         // IP packet size of a path MTU probe
+	Protocol    string    `json:"protocol,omitempty"`     // Protocol of the probe that was answered, with probe.fallback or traceroute
+	Hop         int       `json:"hop,omitempty"`          // TTL of the traceroute probe answered, zero for catchment replies
+	Profile     string    `json:"profile,omitempty"`      // Profile of the probe that was answered, with profiles
+}
+
+// replySink receives every reply, such as a results file or the controller
+type replySink interface {
+	write(record replyRecord)
+	close()
+}
+
+// sinks are registered at startup before the listeners start
+var sinks []replySink
+
+// recordQueue buffers records between the listeners and a sink's own goroutine. When full, writes
+// block if dropped is nil or are dropped and counted otherwise. Writes after close are ignored.
+type recordQueue struct {
+	records chan replyRecord
+	dropped prometheus.Counter
+
+	lock   sync.RWMutex
+	closed bool
+}
+
+func newRecordQueue(size int, dropped prometheus.Counter) *recordQueue {
+	return &recordQueue{records: make(chan replyRecord, size), dropped: dropped}
+}
+
+// write queues a record
+func (q *recordQueue) write(record replyRecord) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	if q.closed {
+		return
+	}
+	if q.dropped == nil {
+		q.records <- record
+		return
+	}
+	select {
+	case q.records <- record:
+	default:
+		q.dropped.Inc()
+	}
+}
+
+// close stops accepting records and closes the channel once all writers are done
+func (q *recordQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.records)
+	}
+}
+
+// newReplyRecord builds a record for an echo reply. Target indexes from other nodes' probes only resolve
+// correctly if every node uses the same targets lists.
+func newReplyRecord(result *verfploeter.Result) replyRecord {
+	record := replyRecord{
+		Time:      result.Time,
+		Collector: result.Collector,
+		Node:      result.Node,
+		Responder: result.Src.String(),
+		Seq:       result.Seq,
+		TTL:       result.TTL,
+	}
+	if result.Dst != nil {
+		record.Destination = result.Dst.String()
+	}
+	if pmtu != nil {
+		record.Size = result.Size
+	}
+	if result.HasPayload {
+		if target, p, ok := targetAt(result.Payload.Target); ok {
+			record.Target = target
+			if p != nil {
+				record.Profile = p.name
+			}
+		}
+		record.Sweep = result.Payload.Sweep
+		if d, ok := result.RTT(); ok {
+			record.RTT = d.Seconds()
+		}
+	}
+	return record
+}
+
+// replyFields returns the log fields for a reply from a probe sent by node
+func replyFields(record replyRecord, node string) log.Fields {
+	fields := log.Fields{
+		"src":  record.Responder,
+		"id":   record.Node,
+		"seq":  record.Seq,
+		"node": node,
+	}
+	if record.Target != "" {
+		fields["target"] = record.Target
+	}
+	if record.Sweep != 0 {
+		fields["sweep"] = record.Sweep
+	}
+	if record.Site != "" {
+		fields["site"] = record.Site
+	}
+	if record.Country != "" {
+		fields["country"] = record.Country
+	}
+	if record.ASN != 0 {
+		fields["asn"] = record.ASN
+	}
+	if record.Response != "" {
+		fields["response"] = record.Response
+	}
+	if record.TTL != 0 {
+		fields["ttl"] = record.TTL
+	}
+	if record.Source != "" {
+		fields["source"] = record.Source
+	}
+	if record.Destination != "" {
+		fields["destination"] = record.Destination
+	}
+	if record.AnycastSite != "" {
+		fields["anycast_site"] = record.AnycastSite
+	}
+	if record.Error != "" {
+		fields["error"] = record.Error
+		fields["code"] = record.Code
+	}
+	if record.MTU != 0 {
+		fields["mtu"] = record.MTU
+	}
+	if record.Size != 0 {
+		fields["size"] = record.Size
+	}
+	if record.Protocol != "" {
+		fields["protocol"] = record.Protocol
+	}
+	if record.Hop != 0 {
+		fields["hop"] = record.Hop
+	}
+	if record.Profile != "" {
+		fields["profile"] = record.Profile
+	}
+	return fields
+}
+
+// handleReply logs a reply and passes it to every sink
+func handleReply(record replyRecord) {
+	atomic.StoreInt64(&lastReply, record.Time.UnixNano())
+	node := findNode(record.Node, currentNodes())
+	if fallback != nil && record.Protocol == "" {
+		record.Protocol = recordProtocol(record)
+	}
+	if geo != nil {
+		geo.enrich(&record)
+		if geo.country != nil {
+			geoReplies.With(map[string]string{"country": record.Country, "dst": node}).Inc()
+		}
+	}
+	if bgp != nil {
+		record.Announced = bgp.prefixes()
+	}
+	if backoff != nil {
+		backoff.answered(record)
+	}
+
+	fields := replyFields(record, node)
+	if record.Error != "" {
+		log.WithFields(fields).Debug("ICMP error")
+	} else if record.Response != "" {
+		log.WithFields(fields).Debug("Reply")
+	} else {
+		log.WithFields(fields).Debug("ICMP echo reply")
+	}
+
+	for _, sink := range sinks {
+		sink.write(record)
+	}
+}
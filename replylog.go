@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// replyLog writes one structured log record per reply to a rotated file or syslog, separately from the
+// process log so it can be shipped to a log pipeline without parsing free-form lines
+type replyLog struct {
+	logger *log.Logger
+	out    io.WriteCloser
+	queue  *recordQueue
+	done   chan struct{}
+}
+
+// newReplyLog opens the reply log at a file path, or a syslog address if path is empty
+func newReplyLog(path, syslog string, maxSize, maxBackups, maxAge int) (*replyLog, error) {
+	var out io.WriteCloser
+	if path != "" {
+		out = &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    maxSize,
+			MaxBackups: maxBackups,
+			MaxAge:     maxAge,
+		}
+	} else if syslog != "" {
+		var err error
+		out, err = dialSyslog(syslog)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, errors.New("no reply log path or syslog address")
+	}
+
+	logger := log.New()
+	logger.SetOutput(out)
+	logger.SetFormatter(&log.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	l := &replyLog{
+		logger: logger,
+		out:    out,
+		queue:  newRecordQueue(4096, nil),
+		done:   make(chan struct{}),
+	}
+	go l.run()
+	return l, nil
+}
+
+// write queues a record to be logged
+func (l *replyLog) write(record replyRecord) {
+	l.queue.write(record)
+}
+
+// close logs all queued records and closes the output
+func (l *replyLog) close() {
+	l.queue.close()
+	<-l.done
+}
+
+func (l *replyLog) run() {
+	defer close(l.done)
+	defer l.out.Close()
+	for record := range l.queue.records {
+		fields := replyFields(record, findNode(record.Node, currentNodes()))
+		fields["collector"] = record.Collector
+		if record.RTT != 0 {
+			fields["rtt"] = record.RTT
+		}
+		l.logger.WithFields(fields).WithTime(record.Time).Info("reply")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errUnresolved is returned for targets whose last resolution failed
+var errUnresolved = errors.New("target could not be resolved")
+
+const (
+	// resolveWorkers is how many hostnames are resolved at once
+	resolveWorkers = 16
+
+	// resolveRetry is the longest a failed resolution is cached before it's retried
+	resolveRetry = time.Minute
+)
+
+// resolveCache holds resolved addresses for hostname targets, so probes don't wait on DNS. Failed
+// resolutions are stored as nil so that probes skip them until they're retried instead of hitting DNS
+// again. Go's resolver doesn't expose record TTLs, so entries expire after the configured TTL, and failures
+// within resolveRetry even without one.
+type resolveCache struct {
+	ttl time.Duration // Zero to never expire resolved entries
+
+	lock      sync.RWMutex
+	entries   map[string]resolveEntry
+	addresses map[string]int // Number of hostname targets resolved to each address, to validate reply sources
+}
+
+// resolveEntry is a resolved hostname target
+type resolveEntry struct {
+	addr    *net.IPAddr // Nil if the resolution failed
+	expires time.Time   // Zero to never expire, only for resolved entries
+}
+
+func newResolveCache() *resolveCache {
+	return &resolveCache{entries: map[string]resolveEntry{}, addresses: map[string]int{}}
+}
+
+// resolve resolves the hostname targets that aren't cached yet on a pool of workers, skipping IP literals
+func (c *resolveCache) resolve(targets []string) {
+	var hostnames []string
+	c.lock.RLock()
+	for _, target := range targets {
+		if _, ok := c.entries[target]; !ok && net.ParseIP(target) == nil {
+			hostnames = append(hostnames, target)
+		}
+	}
+	c.lock.RUnlock()
+	c.resolveAll(hostnames)
+}
+
+// run refreshes expired entries in the background and forgets those of removed targets, until the
+// process exits
+func (c *resolveCache) run() {
+	interval := 10 * time.Second
+	if c.ttl > 0 && c.ttl/10 < interval {
+		interval = c.ttl / 10
+	}
+	for range time.Tick(interval) {
+		current := map[string]bool{}
+		for _, target := range allTargets() {
+			current[target] = true
+		}
+
+		var expired []string
+		now := time.Now()
+		c.lock.Lock()
+		for target, entry := range c.entries {
+			if !current[target] {
+				c.remove(target)
+			} else if !entry.expires.IsZero() && now.After(entry.expires) {
+				expired = append(expired, target)
+			}
+		}
+		c.lock.Unlock()
+		c.resolveAll(expired)
+	}
+}
+
+// resolveAll resolves hostnames on a pool of workers and caches the results
+func (c *resolveCache) resolveAll(hostnames []string) {
+	if len(hostnames) == 0 {
+		return
+	}
+	work := make(chan string)
+	var wg sync.WaitGroup
+	var failures int
+	var failuresLock sync.Mutex
+	for i := 0; i < resolveWorkers && i < len(hostnames); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range work {
+				if _, err := c.resolveOne(target); err != nil {
+					failuresLock.Lock()
+					failures++
+					failuresLock.Unlock()
+				}
+			}
+		}()
+	}
+	for _, target := range hostnames {
+		work <- target
+	}
+	close(work)
+	wg.Wait()
+	log.Debugf("Resolved %d hostname targets (%d failed)", len(hostnames)-failures, failures)
+}
+
+// resolveOne resolves a hostname and caches the result
+func (c *resolveCache) resolveOne(target string) (*net.IPAddr, error) {
+	addr, err := net.ResolveIPAddr("ip", target)
+	entry := resolveEntry{addr: addr}
+	if err != nil {
+		resolveErrors.With(map[string]string{"reason": resolveErrorReason(err)}).Inc()
+		log.WithField("target", target).Debugf("Unable to resolve target: %s", err)
+		entry.addr = nil
+	}
+	if err != nil && (c.ttl == 0 || c.ttl > resolveRetry) {
+		entry.expires = time.Now().Add(resolveRetry)
+	} else if c.ttl > 0 {
+		entry.expires = time.Now().Add(c.ttl)
+	}
+
+	c.lock.Lock()
+	c.remove(target)
+	c.entries[target] = entry
+	if entry.addr != nil {
+		c.addresses[entry.addr.IP.String()]++
+	}
+	c.lock.Unlock()
+	return entry.addr, err
+}
+
+// remove forgets a target, with the lock held
+func (c *resolveCache) remove(target string) {
+	entry, ok := c.entries[target]
+	if !ok {
+		return
+	}
+	delete(c.entries, target)
+	if entry.addr == nil {
+		return
+	}
+	key := entry.addr.IP.String()
+	if c.addresses[key]--; c.addresses[key] <= 0 {
+		delete(c.addresses, key)
+	}
+}
+
+// lookup returns the address of a target, resolving and caching it on demand if it isn't cached yet, such
+// as while the targets are still being resolved at startup
+func (c *resolveCache) lookup(target string) (*net.IPAddr, error) {
+	if ip := net.ParseIP(target); ip != nil {
+		return &net.IPAddr{IP: ip}, nil
+	}
+
+	c.lock.RLock()
+	entry, ok := c.entries[target]
+	c.lock.RUnlock()
+	if !ok {
+		return c.resolveOne(target)
+	}
+	if entry.addr == nil {
+		return nil, errUnresolved
+	}
+	return entry.addr, nil
+}
+
+// resolved checks if an address is that of a hostname target
+func (c *resolveCache) resolved(ip net.IP) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.addresses[ip.String()] > 0
+}
+
+// resolveErrorReason maps a resolution error to a low cardinality label value
+func resolveErrorReason(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		switch {
+		case dnsErr.IsNotFound:
+			return "not_found"
+		case dnsErr.IsTimeout:
+			return "timeout"
+		case dnsErr.IsTemporary:
+			return "temporary"
+		}
+	}
+	return "other"
+}
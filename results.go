@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+// Results formats
+const (
+	formatJSONL = "jsonl"
+	formatCSV   = "csv"
+)
+
+var csvHeader = []string{"time", "collector", "node", "responder", "target", "sweep", "seq", "rtt", "response", "site", "country", "asn", "ttl", "source", "announced", "error", "code", "mtu", "size", "protocol", "hop", "destination", "anycast_site", "profile"}
+
+// resultsWriter records every reply to a file per node and sweep, named after the time this run started so
+// restarts don't append to the files of an earlier run. Replies outside of sweep mode go to a single file.
+// Records are written from a single goroutine so the listeners never block on disk, and are dropped and counted
+// if the queue fills up because the disk can't keep up.
+type resultsWriter struct {
+	dir    string
+	format string
+	id     uint16
+	prefix string // Start time of this run, which file names begin with
+	queue  *recordQueue
+	done   chan struct{}
+
+	// Owned by the writer goroutine
+	files map[resultsKey]*resultsFile
+	sweep uint32 // Latest sweep of this node
+	gen   uint64 // Incremented whenever this node starts a sweep
+}
+
+// resultsKey identifies the results file of a node's sweep, which is zero for replies outside of sweep mode
+type resultsKey struct {
+	node  uint16
+	sweep uint32
+}
+
+// resultsFile is an open results file
+type resultsFile struct {
+	file *os.File
+	buf  *bufio.Writer
+	csv  *csv.Writer
+	gen  uint64 // Generation of the last write
+}
+
+func newResultsWriter(dir, format string, id uint16,
+	reg prometheus.Registerer, constLabels prometheus.Labels) (*resultsWriter, error) {
+	if format != formatJSONL && format != formatCSV {
+		return nil, fmt.Errorf("unknown results format %q (expected %s or %s)", format, formatJSONL, formatCSV)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	factory := promauto.With(reg)
+	w := &resultsWriter{
+		dir:    dir,
+		format: format,
+		id:     id,
+		prefix: startTime.UTC().Format("20060102T150405Z"),
+		queue: newRecordQueue(4096, factory.NewCounter(prometheus.CounterOpts{
+			Name:        "verfploeter_results_dropped_total",
+			ConstLabels: constLabels,
+		})),
+		done:  make(chan struct{}),
+		files: map[resultsKey]*resultsFile{},
+	}
+	go w.run()
+	return w, nil
+}
+
+// write queues a record to be written
+func (w *resultsWriter) write(record replyRecord) {
+	w.queue.write(record)
+}
+
+// close flushes all queued records and closes the open files
+func (w *resultsWriter) close() {
+	w.queue.close()
+	<-w.done
+}
+
+func (w *resultsWriter) run() {
+	defer close(w.done)
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+	for {
+		select {
+		case record, ok := <-w.queue.records:
+			if !ok {
+				for key := range w.files {
+					w.closeFile(key)
+				}
+				return
+			}
+			if err := w.writeRecord(record); err != nil {
+				log.Warnf("Unable to write result: %s", err)
+			}
+		case <-flush.C:
+			for _, f := range w.files {
+				w.flush(f)
+			}
+		}
+	}
+}
+
+// filename returns the results file for a node's sweep
+func (w *resultsWriter) filename(key resultsKey) string {
+	if key.sweep == 0 {
+		return filepath.Join(w.dir, fmt.Sprintf("%s-replies.%s", w.prefix, w.format))
+	}
+	return filepath.Join(w.dir, fmt.Sprintf("%s-node-%d-sweep-%d.%s", w.prefix, key.node, key.sweep, w.format))
+}
+
+// open opens the results file for a node's sweep, appending if it was written and closed before
+func (w *resultsWriter) open(key resultsKey) (*resultsFile, error) {
+	filename := w.filename(key)
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	log.Debugf("Writing results to %s", filename)
+
+	f := &resultsFile{file: file, buf: bufio.NewWriter(file)}
+	w.files[key] = f
+	if w.format == formatCSV {
+		f.csv = csv.NewWriter(f.buf)
+		if info.Size() == 0 {
+			return f, f.csv.Write(csvHeader)
+		}
+	}
+	return f, nil
+}
+
+// rotate closes the files of sweeps that weren't written since this node started its previous sweep, once it
+// starts a new one. Late replies to the previous sweep still go to its open file.
+func (w *resultsWriter) rotate(sweep uint32) {
+	w.sweep = sweep
+	w.gen++
+	for key, f := range w.files {
+		if key.sweep != 0 && f.gen+1 < w.gen {
+			w.closeFile(key)
+		}
+	}
+}
+
+func (w *resultsWriter) writeRecord(record replyRecord) error {
+	if record.Node == w.id && record.Sweep > w.sweep {
+		w.rotate(record.Sweep)
+	}
+	key := resultsKey{node: record.Node, sweep: record.Sweep}
+	if record.Sweep == 0 {
+		key.node = 0
+	}
+	f, ok := w.files[key]
+	if !ok {
+		var err error
+		if f, err = w.open(key); err != nil {
+			return err
+		}
+	}
+	f.gen = w.gen
+
+	if w.format == formatCSV {
+		return f.csv.Write([]string{
+			record.Time.Format(time.RFC3339Nano),
+			strconv.Itoa(int(record.Collector)),
+			strconv.Itoa(int(record.Node)),
+			record.Responder,
+			record.Target,
+			strconv.FormatUint(uint64(record.Sweep), 10),
+			strconv.Itoa(record.Seq),
+			strconv.FormatFloat(record.RTT, 'f', -1, 64),
+			record.Response,
+			record.Site,
+			record.Country,
+			strconv.FormatUint(uint64(record.ASN), 10),
+			strconv.Itoa(record.TTL),
+			record.Source,
+			strings.Join(record.Announced, " "),
+			record.Error,
+			strconv.Itoa(record.Code),
+			strconv.Itoa(record.MTU),
+			strconv.Itoa(record.Size),
+			record.Protocol,
+			strconv.Itoa(record.Hop),
+			record.Destination,
+			record.AnycastSite,
+			record.Profile,
+		})
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = f.buf.Write(append(b, '\n'))
+	return err
+}
+
+func (w *resultsWriter) flush(f *resultsFile) {
+	if f.csv != nil {
+		f.csv.Flush()
+	}
+	if err := f.buf.Flush(); err != nil {
+		log.Warnf("Unable to flush results: %s", err)
+	}
+}
+
+// closeFile flushes and closes the results file of a node's sweep
+func (w *resultsWriter) closeFile(key resultsKey) {
+	f := w.files[key]
+	w.flush(f)
+	if err := f.file.Close(); err != nil {
+		log.Warnf("Unable to close results file: %s", err)
+	}
+	delete(w.files, key)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+// sweepSchedule limits when probes are sent. With a cron expression, each sweep starts at one of its times
+// and the next waits for the following one. With time windows, probes are only sent inside them, and a
+// sweep that's still running when a window closes carries on when the next one opens.
+type sweepSchedule struct {
+	cron     *cronExpr // Nil to sweep continuously
+	windows  []timeWindow
+	location *time.Location
+
+	fired    bool      // The cron time that starts the next sweep has passed
+	upcoming time.Time // Next cron time while sweeping
+	waiting  time.Time // When probing resumes, zero while probing
+	idle     int32     // Set while waiting, so the prober isn't reported as wedged
+
+	wake      chan struct{} // Signaled by on-demand sweeps, which don't wait for the cron time
+	nextSweep prometheus.Gauge
+}
+
+// schedule is nil unless probe.schedule is set
+var schedule *sweepSchedule
+
+func newSweepSchedule(config *Config, reg prometheus.Registerer, constLabels prometheus.Labels) *sweepSchedule {
+	factory := promauto.With(reg)
+	s := &sweepSchedule{
+		location: scheduleLocation(config),
+		wake:     make(chan struct{}, 1),
+		nextSweep: factory.NewGauge(prometheus.GaugeOpts{
+			Name:        "verfploeter_next_sweep_timestamp_seconds",
+			ConstLabels: constLabels,
+		}),
+	}
+	if config.Probe.Schedule.Cron != "" {
+		s.cron, _ = parseCron(config.Probe.Schedule.Cron)
+	}
+	for _, w := range config.Probe.Schedule.Windows {
+		window, _ := parseTimeWindow(w)
+		s.windows = append(s.windows, window)
+	}
+	return s
+}
+
+// wait blocks until the schedule allows the next probe, returning false if ctx is done first. done reports
+// whether the current sweep has finished, so the next one has to wait for the cron time.
+func (s *sweepSchedule) wait(ctx context.Context, done func() bool) bool {
+	for {
+		now := time.Now().In(s.location)
+		start, cron := now, false
+		if s.cron != nil {
+			if !done() {
+				s.fired = false
+			} else if !s.fired {
+				start, cron = s.cron.next(now), true
+			}
+		}
+		start = s.opening(start)
+		if !start.After(now) {
+			s.probing(now)
+			return true
+		}
+
+		s.nextSweep.Set(float64(start.Unix()))
+		if !start.Equal(s.waiting) {
+			if cron {
+				log.Infof("Waiting until %s to start the next sweep", start.Format(time.RFC3339))
+			} else {
+				log.Infof("Outside probe windows, waiting until %s", start.Format(time.RFC3339))
+			}
+			s.waiting = start
+			atomic.StoreInt32(&s.idle, 1)
+			atomic.StoreInt32(&probing, 1)
+		}
+		timer := time.NewTimer(time.Until(start))
+		select {
+		case <-timer.C:
+			if cron {
+				s.fired = true
+			}
+		case <-s.wake:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// probing updates the next sweep time once probes are being sent
+func (s *sweepSchedule) probing(now time.Time) {
+	if !s.waiting.IsZero() {
+		log.Info("Probing resumed by schedule")
+		s.waiting = time.Time{}
+		atomic.StoreInt32(&s.idle, 0)
+	}
+	if s.cron == nil {
+		s.nextSweep.Set(0)
+	} else if !now.Before(s.upcoming) {
+		s.upcoming = s.cron.next(now)
+		s.nextSweep.Set(float64(s.opening(s.upcoming).Unix()))
+	}
+}
+
+// wakeUp re-checks the schedule, such as when an on-demand sweep is requested
+func (s *sweepSchedule) wakeUp() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// waitingForSchedule checks if probes are held back by the schedule
+func waitingForSchedule() bool {
+	return schedule != nil && atomic.LoadInt32(&schedule.idle) != 0
+}
+
+// opening returns t if it's inside a window, otherwise when the next window opens
+func (s *sweepSchedule) opening(t time.Time) time.Time {
+	if len(s.windows) == 0 {
+		return t
+	}
+	var earliest time.Time
+	for _, w := range s.windows {
+		if w.contains(t) {
+			return t
+		}
+		start := time.Date(t.Year(), t.Month(), t.Day(), 0, w.start, 0, 0, s.location)
+		if !start.After(t) {
+			start = time.Date(t.Year(), t.Month(), t.Day()+1, 0, w.start, 0, 0, s.location)
+		}
+		if earliest.IsZero() || start.Before(earliest) {
+			earliest = start
+		}
+	}
+	return earliest
+}
+
+// scheduleLocation returns the time zone of the schedule, the system's unless probe.schedule.timezone is set
+func scheduleLocation(config *Config) *time.Location {
+	if config.Probe.Schedule.Timezone == "" {
+		return time.Local
+	}
+	location, err := time.LoadLocation(config.Probe.Schedule.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return location
+}
+
+// timeWindow is a daily time window in minutes since midnight, which wraps past midnight if end is before start
+type timeWindow struct {
+	start, end int
+}
+
+// contains checks if a time of day is inside the window
+func (w timeWindow) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+// parseTimeWindow parses a window like "02:00-05:00"
+func parseTimeWindow(s string) (timeWindow, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return timeWindow{}, fmt.Errorf("invalid time window %q (expected HH:MM-HH:MM)", s)
+	}
+	start, err := parseTimeOfDay(strings.TrimSpace(from))
+	if err != nil {
+		return timeWindow{}, fmt.Errorf("invalid time window %q: %s", s, err)
+	}
+	end, err := parseTimeOfDay(strings.TrimSpace(to))
+	if err != nil {
+		return timeWindow{}, fmt.Errorf("invalid time window %q: %s", s, err)
+	}
+	if start == end {
+		return timeWindow{}, fmt.Errorf("time window %q is empty", s)
+	}
+	return timeWindow{start, end}, nil
+}
+
+// parseTimeOfDay parses HH:MM into minutes since midnight, accepting 24:00 as the end of the day
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err == nil {
+		return t.Hour()*60 + t.Minute(), nil
+	}
+	if s == "24:00" {
+		return 0, nil
+	}
+	return 0, fmt.Errorf("invalid time %q", s)
+}
+
+// cronExpr is a standard five field cron expression: minute, hour, day of month, month, and day of week
+type cronExpr struct {
+	minute, hour, dom, month, dow uint64 // Bit sets of the matching values
+
+	// Vixie cron matches either day field if both are restricted, instead of both
+	domStar, dowStar bool
+}
+
+// cronMacros are the shorthands for common expressions
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses a cron expression, which may be one of cronMacros
+func parseCron(s string) (*cronExpr, error) {
+	expr := s
+	if macro, ok := cronMacros[s]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q (expected 5 fields)", s)
+	}
+	c := &cronExpr{domStar: fields[2] == "*", dowStar: fields[4] == "*"}
+	for i, f := range []struct {
+		bits     *uint64
+		min, max int
+		name     string
+	}{
+		{&c.minute, 0, 59, "minute"},
+		{&c.hour, 0, 23, "hour"},
+		{&c.dom, 1, 31, "day of month"},
+		{&c.month, 1, 12, "month"},
+		{&c.dow, 0, 7, "day of week"},
+	} {
+		bits, err := parseCronField(fields[i], f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s in cron expression %q: %s", f.name, s, err)
+		}
+		*f.bits = bits
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1 // 7 is also Sunday
+	}
+	if c.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("cron expression %q never matches", s)
+	}
+	return c, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges, and steps like "*/15" or "1-5/2"
+func parseCronField(s string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		rng, step := part, 1
+		if r, st, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(st)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", st)
+			}
+			rng, step = r, n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("invalid value %q", from)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("invalid value %q", to)
+				}
+			} else if step > 1 {
+				hi = max // "5/10" means every 10 from 5
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	if bits == 0 {
+		return 0, errors.New("no values")
+	}
+	return bits, nil
+}
+
+// next returns the first time after t that matches, or the zero time if none does within five years
+func (c *cronExpr) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatches checks the day of month and day of week fields
+func (c *cronExpr) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// checkSchedule validates probe.schedule
+func checkSchedule(config *Config) error {
+	s := config.Probe.Schedule
+	if s.Cron != "" {
+		if config.Probe.Mode != modeSweep {
+			return fmt.Errorf("probe.schedule.cron needs %s mode", modeSweep)
+		}
+		if _, err := parseCron(s.Cron); err != nil {
+			return fmt.Errorf("probe.schedule.cron: %s", err)
+		}
+	}
+	for _, w := range s.Windows {
+		if _, err := parseTimeWindow(w); err != nil {
+			return fmt.Errorf("probe.schedule.windows: %s", err)
+		}
+	}
+	if s.Timezone != "" {
+		if _, err := time.LoadLocation(s.Timezone); err != nil {
+			return fmt.Errorf("probe.schedule.timezone: %s", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/net/bpf"
+)
+
+// socketPlatform is the part of the socket layer that differs between operating systems. Linux supports
+// everything; elsewhere, features the kernel lacks return errUnsupported so they can be skipped.
+type socketPlatform interface {
+	// bindToDevice binds a socket to a network interface so probes egress it
+	bindToDevice(c syscall.RawConn, iface string) error
+
+	// isVRF checks if a network device is a VRF master device
+	isVRF(name string) bool
+
+	// listenICMPDatagram opens an unprivileged ICMP datagram socket for network "udp4" or "udp6", bound to
+	// this node's ID where the kernel filters replies by it
+	listenICMPDatagram(network, address, iface string, id uint16) (net.PacketConn, error)
+
+	// setBPF attaches a filter to a raw ICMP or ICMPv6 socket
+	setBPF(c *net.IPConn, ipVersion int, prog []bpf.RawInstruction) error
+
+	// setDontFragment sets the don't fragment flag on probes sent from a socket, even if they exceed the
+	// cached path MTU, so routers with a smaller MTU report it
+	setDontFragment(c net.PacketConn, ipVersion int) error
+
+	// rawTransport checks if raw TCP and UDP sockets receive replies, which TCP, UDP, and CHAOS probes need
+	rawTransport() bool
+}
+
+// errUnsupported is returned for socket features that aren't available on this platform
+var errUnsupported = fmt.Errorf("not supported on %s", runtime.GOOS)
+
+// unsupported wraps errUnsupported with the feature that isn't available
+func unsupported(feature string) error {
+	return fmt.Errorf("%s is %w", feature, errUnsupported)
+}
+
+// isUnsupported checks if err is from a socket feature that isn't available on this platform
+func isUnsupported(err error) bool {
+	return errors.Is(err, errUnsupported)
+}
+
+// datagramConn adapts an ICMP datagram socket to the *net.IPAddr addresses used with raw sockets
+type datagramConn struct {
+	*net.UDPConn
+	ipHeader bool // Reads start with the IPv4 header, as on macOS
+}
+
+func (c *datagramConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.UDPConn.ReadFromUDP(b)
+	if c.ipHeader && n > 0 {
+		hl := int(b[0]&0x0f) << 2
+		if hl > n {
+			hl = n
+		}
+		n = copy(b, b[hl:n])
+	}
+	if addr == nil {
+		return n, nil, err
+	}
+	return n, &net.IPAddr{IP: addr.IP, Zone: addr.Zone}, err
+}
+
+func (c *datagramConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ipAddr, ok := addr.(*net.IPAddr)
+	if !ok {
+		return 0, fmt.Errorf("unexpected address type %T", addr)
+	}
+	return c.UDPConn.WriteToUDP(b, &net.UDPAddr{IP: ipAddr.IP, Zone: ipAddr.Zone})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/net/bpf"
+)
+
+// Socket options missing from the syscall package
+const (
+	ipDontFrag   = 0x1c // IP_DONTFRAG
+	ipv6DontFrag = 0x3e // IPV6_DONTFRAG
+)
+
+// darwinSockets binds to interfaces with IP_BOUND_IF and supports unprivileged ICMP, but has no socket
+// filters and doesn't pass TCP or UDP to raw sockets
+type darwinSockets struct{}
+
+var sockets socketPlatform = darwinSockets{}
+
+// bindToDevice binds a socket to a network interface with IP_BOUND_IF or IPV6_BOUND_IF
+func (darwinSockets) bindToDevice(c syscall.RawConn, iface string) error {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+	if cerr := c.Control(func(fd uintptr) {
+		err = boundIf(int(fd), ifi.Index)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// boundIf sets the interface of a socket by index, using the option for its address family
+func boundIf(fd, index int) error {
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return os.NewSyscallError("getsockname", err)
+	}
+	if _, ok := sa.(*syscall.SockaddrInet6); ok {
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_BOUND_IF, index)
+	} else {
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_BOUND_IF, index)
+	}
+	return os.NewSyscallError("setsockopt", err)
+}
+
+// isVRF always returns false, macOS has no VRFs
+func (darwinSockets) isVRF(_ string) bool {
+	return false
+}
+
+// listenICMPDatagram opens a socket that any user may open. Unlike Linux, the kernel neither rewrites the
+// echo ID nor filters replies by it, so the socket sees every echo reply like a raw socket, and IPv4 reads
+// start with the IP header.
+func (darwinSockets) listenICMPDatagram(network, address, iface string, _ uint16) (net.PacketConn, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid source address %s", address)
+	}
+
+	var family, proto int
+	var sa syscall.Sockaddr
+	switch network {
+	case "udp4":
+		family, proto = syscall.AF_INET, syscall.IPPROTO_ICMP
+		addr := &syscall.SockaddrInet4{}
+		copy(addr.Addr[:], ip.To4())
+		sa = addr
+	case "udp6":
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+		addr := &syscall.SockaddrInet6{}
+		copy(addr.Addr[:], ip.To16())
+		sa = addr
+	default:
+		return nil, fmt.Errorf("unsupported network %s", network)
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	syscall.CloseOnExec(fd)
+	if iface != "" {
+		ifi, err := net.InterfaceByName(iface)
+		if err == nil {
+			err = boundIf(fd, ifi.Index)
+		}
+		if err != nil {
+			syscall.Close(fd)
+			return nil, err
+		}
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	f := os.NewFile(uintptr(fd), network)
+	defer f.Close()
+	c, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	return &datagramConn{UDPConn: c.(*net.UDPConn), ipHeader: network == "udp4"}, nil
+}
+
+// setBPF is unsupported, every ICMP message is read and filtered in userspace
+func (darwinSockets) setBPF(_ *net.IPConn, _ int, _ []bpf.RawInstruction) error {
+	return unsupported("filtering ICMP in the kernel")
+}
+
+// setDontFragment uses IP_DONTFRAG or IPV6_DONTFRAG
+func (darwinSockets) setDontFragment(c net.PacketConn, ipVersion int) error {
+	if ipVersion == 4 {
+		return setsockoptInt(c, syscall.IPPROTO_IP, ipDontFrag, 1)
+	}
+	return setsockoptInt(c, syscall.IPPROTO_IPV6, ipv6DontFrag, 1)
+}
+
+// rawTransport is false, TCP and UDP packets are never delivered to raw sockets
+func (darwinSockets) rawTransport() bool {
+	return false
+}
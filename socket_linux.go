@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// linuxSockets supports every socket feature
+type linuxSockets struct{}
+
+var sockets socketPlatform = linuxSockets{}
+
+// bindToDevice binds a socket to a network interface with SO_BINDTODEVICE
+func (linuxSockets) bindToDevice(c syscall.RawConn, iface string) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.BindToDevice(int(fd), iface)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// isVRF checks the device type in sysfs
+func (linuxSockets) isVRF(name string) bool {
+	b, err := os.ReadFile(filepath.Join("/sys/class/net", name, "uevent"))
+	return err == nil && strings.Contains(string(b), "DEVTYPE=vrf")
+}
+
+// listenICMPDatagram opens a socket that needs the process's group to be within net.ipv4.ping_group_range
+// instead of CAP_NET_RAW. The kernel replaces the echo ID of outgoing probes with the socket's port and only
+// delivers replies that carry it, so the socket is bound to this node's ID and never sees replies to other
+// nodes' probes.
+func (linuxSockets) listenICMPDatagram(network, address, iface string, id uint16) (net.PacketConn, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid source address %s", address)
+	}
+
+	var family, proto int
+	var sa syscall.Sockaddr
+	switch network {
+	case "udp4":
+		family, proto = syscall.AF_INET, syscall.IPPROTO_ICMP
+		addr := &syscall.SockaddrInet4{Port: int(id)}
+		copy(addr.Addr[:], ip.To4())
+		sa = addr
+	case "udp6":
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+		addr := &syscall.SockaddrInet6{Port: int(id)}
+		copy(addr.Addr[:], ip.To16())
+		sa = addr
+	default:
+		return nil, fmt.Errorf("unsupported network %s", network)
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if iface != "" {
+		if err := syscall.BindToDevice(fd, iface); err != nil {
+			syscall.Close(fd)
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	f := os.NewFile(uintptr(fd), network)
+	defer f.Close()
+	c, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	return &datagramConn{UDPConn: c.(*net.UDPConn)}, nil
+}
+
+// setBPF attaches a classic BPF program with SO_ATTACH_FILTER
+func (linuxSockets) setBPF(c *net.IPConn, ipVersion int, prog []bpf.RawInstruction) error {
+	if ipVersion == 4 {
+		return ipv4.NewPacketConn(c).SetBPF(prog)
+	}
+	return ipv6.NewPacketConn(c).SetBPF(prog)
+}
+
+// setDontFragment uses IP_PMTUDISC_PROBE, which sets the flag without limiting probes to the path MTU the
+// kernel has learned
+func (linuxSockets) setDontFragment(c net.PacketConn, ipVersion int) error {
+	if ipVersion == 4 {
+		return setsockoptInt(c, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+	}
+	return setsockoptInt(c, syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+}
+
+// rawTransport is true, Linux delivers a copy of every TCP and UDP packet to matching raw sockets
+func (linuxSockets) rawTransport() bool {
+	return true
+}
@@ -0,0 +1,46 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/net/bpf"
+)
+
+// bsdSockets only has raw ICMP sockets, as on the BSDs, which have no unprivileged ICMP or per-socket
+// interface binding and don't pass TCP or UDP to raw sockets
+type bsdSockets struct{}
+
+var sockets socketPlatform = bsdSockets{}
+
+// bindToDevice is unsupported, use routing to pick the egress interface
+func (bsdSockets) bindToDevice(_ syscall.RawConn, _ string) error {
+	return unsupported("binding to an interface")
+}
+
+// isVRF always returns false, VRFs are only supported on Linux
+func (bsdSockets) isVRF(_ string) bool {
+	return false
+}
+
+// listenICMPDatagram is unsupported, raw sockets need root
+func (bsdSockets) listenICMPDatagram(_, _, _ string, _ uint16) (net.PacketConn, error) {
+	return nil, unsupported("unprivileged ICMP")
+}
+
+// setBPF is unsupported, every ICMP message is read and filtered in userspace
+func (bsdSockets) setBPF(_ *net.IPConn, _ int, _ []bpf.RawInstruction) error {
+	return unsupported("filtering ICMP in the kernel")
+}
+
+// setDontFragment is unsupported
+func (bsdSockets) setDontFragment(_ net.PacketConn, _ int) error {
+	return unsupported("setting the don't fragment flag")
+}
+
+// rawTransport is false, TCP and UDP packets are never delivered to raw sockets
+func (bsdSockets) rawTransport() bool {
+	return false
+}
@@ -0,0 +1,28 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// setsockoptInt sets an integer socket option on a raw or datagram socket, whose descriptor is a handle on Windows
+func setsockoptInt(c net.PacketConn, level, opt, value int) error {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("unable to set socket options on %T", c)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if cerr := raw.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(syscall.Handle(fd), level, opt, value)
+	}); cerr != nil {
+		return cerr
+	}
+	return os.NewSyscallError("setsockopt", err)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/natesales/go-verfploeter/pkg/verfploeter"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Ways of spreading probes across multiple source addresses
+const (
+	sourceModeRoundRobin = "round-robin" // Send each probe from the next source of the target's family
+	sourceModeAll        = "all"         // Send each probe from every source of the target's family
+)
+
+// probeSources are the sources of every profile, which replies are read from, opened at startup
+var probeSources verfploeter.Sources
+
+// configSources returns the source addresses of a config by IP version. Without probe.sources, a family whose
+// source is empty is skipped unless some of the targets are addresses of that family, which are then probed
+// from the wildcard address, so hosts without IPv6 don't need an IPv6 socket.
+func configSources(config *Config, list *targetList) map[int][]string {
+	if len(config.Probe.Sources) == 0 {
+		addrs := map[int][]string{}
+		for ipVersion, source := range map[int]string{4: config.Probe.Source4, 6: config.Probe.Source6} {
+			if source != "" || list.hasFamily(ipVersion) {
+				addrs[ipVersion] = []string{source}
+			}
+		}
+		return addrs
+	}
+	addrs := map[int][]string{}
+	for _, addr := range config.Probe.Sources {
+		if net.ParseIP(addr).To4() != nil {
+			addrs[4] = append(addrs[4], addr)
+		} else {
+			addrs[6] = append(addrs[6], addr)
+		}
+	}
+	return addrs
+}
+
+// openSource opens an ICMP socket bound to a source address of an IP version (4 or 6) and adds it
+func openSource(ipVersion int, address, iface string, id uint16, unprivileged bool) (*verfploeter.Source, error) {
+	conn, err := openICMP(strconv.Itoa(ipVersion), address, iface, id, unprivileged)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on IPv%d source %q: %s", ipVersion, address, err)
+	}
+	source := &verfploeter.Source{Addr: net.ParseIP(address), Proto: 58, Conn: conn}
+	if ipVersion == 4 {
+		source.Proto = 1
+	}
+	probeSources.Add(source)
+	return source, nil
+}
+
+// listenRaw opens a raw IP socket, optionally bound to a network interface
+func listenRaw(network, address, iface string) (net.PacketConn, error) {
+	var lc net.ListenConfig
+	if iface != "" {
+		lc.Control = func(_, _ string, c syscall.RawConn) error {
+			return sockets.bindToDevice(c, iface)
+		}
+	}
+	return lc.ListenPacket(context.Background(), network, address)
+}
+
+// openICMP opens an ICMP socket for ipVersion "4" or "6", falling back to an unprivileged datagram socket
+// if raw sockets aren't permitted
+func openICMP(ipVersion, address, iface string, id uint16, unprivileged bool) (net.PacketConn, error) {
+	if !unprivileged {
+		pc, err := listenRaw("ip"+ipVersion+":icmp", address, iface)
+		if !errors.Is(err, os.ErrPermission) {
+			return pc, err
+		}
+		log.Warnf("Not permitted to open a raw IPv%s socket, falling back to an unprivileged ICMP socket: %s", ipVersion, err)
+	}
+	return sockets.listenICMPDatagram("udp"+ipVersion, address, iface, id)
+}
+
+// filterEchoReplies attaches BPF filters to the raw ICMP sockets that drop echo replies to probes from
+// unknown nodes, and any other ICMP that isn't an error, in the kernel. Unprivileged sockets on Linux are
+// already filtered by ID, and platforms without socket filters drop them in userspace instead.
+func filterEchoReplies(id uint16, nodes map[uint16]string) {
+	ids := []uint16{id}
+	for n := range nodes {
+		if n != id {
+			ids = append(ids, n)
+		}
+	}
+	for _, source := range probeSources.List() {
+		c, ok := source.Conn.(*net.IPConn)
+		if !ok {
+			continue
+		}
+		ipVersion := 6
+		if source.Proto == 1 {
+			ipVersion = 4
+		}
+		prog, err := verfploeter.EchoFilter(ipVersion, ids)
+		if err == nil {
+			err = sockets.setBPF(c, ipVersion, prog)
+		}
+		if isUnsupported(err) {
+			log.Debugf("Not filtering IPv%d ICMP in the kernel: %s", ipVersion, err)
+		} else if err != nil {
+			log.Warnf("Unable to filter IPv%d ICMP in the kernel: %s", ipVersion, err)
+		}
+	}
+}
+
+// setProbeOptions sets the TOS or traffic class and the TTL or hop limit of probes sent on an IPv4 or IPv6
+// socket, leaving the system defaults for zero values
+func setProbeOptions(c net.PacketConn, ipVersion, tos, ttl int) error {
+	if ipVersion == 4 && tos != 0 {
+		if err := ipv4.NewPacketConn(c).SetTOS(tos); err != nil {
+			return fmt.Errorf("unable to set IPv4 TOS: %s", err)
+		}
+	} else if tos != 0 {
+		if err := ipv6.NewPacketConn(c).SetTrafficClass(tos); err != nil {
+			return fmt.Errorf("unable to set IPv6 traffic class: %s", err)
+		}
+	}
+	if ipVersion == 4 && ttl != 0 {
+		if err := ipv4.NewPacketConn(c).SetTTL(ttl); err != nil {
+			return fmt.Errorf("unable to set IPv4 TTL: %s", err)
+		}
+	} else if ttl != 0 {
+		if err := ipv6.NewPacketConn(c).SetHopLimit(ttl); err != nil {
+			return fmt.Errorf("unable to set IPv6 hop limit: %s", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConfigSources(t *testing.T) {
+	for _, tc := range []struct {
+		source4, source6 string
+		sources          []string
+		targets          []string
+		want             map[int][]string
+	}{
+		{"0.0.0.0", "::", nil, []string{"192.0.2.1"}, map[int][]string{4: {"0.0.0.0"}, 6: {"::"}}},
+		{"0.0.0.0", "", nil, []string{"192.0.2.1", "example.com"}, map[int][]string{4: {"0.0.0.0"}}},
+		{"0.0.0.0", "", nil, []string{"192.0.2.1", "2001:db8::1"}, map[int][]string{4: {"0.0.0.0"}, 6: {""}}},
+		{"", "2001:db8::2", nil, []string{"2001:db8::1"}, map[int][]string{6: {"2001:db8::2"}}},
+		{"", "", []string{"192.0.2.10", "192.0.2.11"}, []string{"2001:db8::1"}, map[int][]string{4: {"192.0.2.10", "192.0.2.11"}}},
+	} {
+		config := &Config{}
+		config.Probe.Source4, config.Probe.Source6, config.Probe.Sources = tc.source4, tc.source6, tc.sources
+		var list targetList
+		list.set(tc.targets)
+		if got := configSources(config, &list); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("sources %q %q %v with targets %v: got %v, want %v",
+				tc.source4, tc.source6, tc.sources, tc.targets, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"runtime"
+
+	"golang.org/x/net/ipv4"
+)
+
+// spoofConn sends IPv4 probes with a source address that isn't necessarily assigned to this host, such as an
+// anycast address announced from other sites. The IP header is built by hand with IP_HDRINCL.
+type spoofConn struct {
+	raw *ipv4.RawConn
+	src net.IP
+	tos int
+	ttl int
+
+	dontFragment bool // Set the don't fragment flag, for path MTU probes
+}
+
+// newSpoofConn opens a send-only raw socket that writes probes from src, with a TTL of 64 if ttl is zero
+func newSpoofConn(src net.IP, tos, ttl int, iface string) (*spoofConn, error) {
+	if ttl == 0 {
+		ttl = 64
+	}
+	c, err := listenRaw("ip4:icmp", "0.0.0.0", iface)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ipv4.NewRawConn(c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// Replies are read from pc4, so don't queue copies of them here. ICMP filters are Linux only; elsewhere
+	// the copies fill the socket's buffer and are dropped.
+	if runtime.GOOS == "linux" {
+		var filter ipv4.ICMPFilter
+		filter.SetAll(true)
+		if err := raw.SetICMPFilter(&filter); err != nil {
+			raw.Close()
+			return nil, err
+		}
+	}
+	return &spoofConn{raw: raw, src: src, tos: tos, ttl: ttl}, nil
+}
+
+// WriteTo sends a packet of an IP protocol (1 for ICMP, 6 for TCP) to dst
+func (c *spoofConn) WriteTo(b []byte, proto int, dst *net.IPAddr) error {
+	h := &ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TOS:      c.tos,
+		TotalLen: ipv4.HeaderLen + len(b),
+		TTL:      c.ttl,
+		Protocol: proto,
+		Src:      c.src,
+		Dst:      dst.IP,
+	}
+	if c.dontFragment {
+		h.Flags = ipv4.DontFragment
+	}
+	return c.raw.WriteTo(h, b, nil)
+}
+
+// Close closes the underlying socket
+func (c *spoofConn) Close() error {
+	return c.raw.Close()
+}
+
+// spoofWriter sends a prober's packets of an IP protocol through a spoofConn
+type spoofWriter struct {
+	c     *spoofConn
+	proto int
+}
+
+func (w spoofWriter) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if err := w.c.WriteTo(b, w.proto, addr.(*net.IPAddr)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
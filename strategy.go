@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Ways of picking the next target in random mode
+const (
+	strategyRandom     = "random"     // Pick any target uniformly
+	strategyShuffle    = "shuffle"    // Probe every target once in a random order before repeating, numbering each pass
+	strategyWeighted   = "weighted"   // Pick targets in proportion to the weight of their prefix
+	strategyStratified = "stratified" // Pick an ASN or country uniformly, then a target within it
+)
+
+// Strata of targets in stratified selection
+const (
+	stratifyASN     = "asn"
+	stratifyCountry = "country"
+)
+
+// newStrategy returns the function that picks the next target to probe in random mode
+func newStrategy(config *Config, list *targetList) (func() probeTarget, error) {
+	switch config.Probe.Strategy.Type {
+	case strategyShuffle:
+		s := newSweeper(list)
+		s.shuffle = true
+		return s.next, nil
+	case strategyWeighted:
+		weights, err := loadWeights(config.Probe.Strategy.Weights)
+		if err != nil {
+			return nil, err
+		}
+		w := &weightedStrategy{list: list, weights: weights, defaultWeight: config.Probe.Strategy.DefaultWeight}
+		return w.next, nil
+	case strategyStratified:
+		if geo == nil {
+			return nil, fmt.Errorf("probe.strategy %s requires a GeoIP database", strategyStratified)
+		}
+		s := &stratifiedStrategy{list: list, by: config.Probe.Strategy.By}
+		return s.next, nil
+	}
+	return func() probeTarget {
+		return probeTarget{target: list.random()}
+	}, nil
+}
+
+// prefixWeight is the weight of targets in a prefix
+type prefixWeight struct {
+	prefix *net.IPNet
+	weight float64
+}
+
+// loadWeights reads a file of "prefix weight" lines, sorted most specific first so the longest match wins
+func loadWeights(filename string) ([]prefixWeight, error) {
+	lines, _, err := readLines(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read weights file %s: %s", filename, err)
+	}
+	var weights []prefixWeight
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid line in %s: %q (expected prefix and weight)", filename, line)
+		}
+		_, prefix, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix in %s: %s", filename, err)
+		}
+		weight, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight in %s: %q", filename, fields[1])
+		}
+		weights = append(weights, prefixWeight{prefix, weight})
+	}
+	sort.SliceStable(weights, func(i, j int) bool {
+		a, _ := weights[i].prefix.Mask.Size()
+		b, _ := weights[j].prefix.Mask.Size()
+		return a > b
+	})
+	log.Infof("Loaded %d prefix weights", len(weights))
+	return weights, nil
+}
+
+// weightedStrategy picks targets in proportion to their weight, rebuilding the cumulative weights when
+// the targets are reloaded
+type weightedStrategy struct {
+	list          *targetList
+	weights       []prefixWeight
+	defaultWeight float64
+
+	gen        uint64
+	targets    []string
+	cumulative []float64
+}
+
+// weight returns the weight of the most specific prefix containing a target, or the default weight
+func (s *weightedStrategy) weight(target string) float64 {
+	if ip := net.ParseIP(target); ip != nil {
+		for _, w := range s.weights {
+			if w.prefix.Contains(ip) {
+				return w.weight
+			}
+		}
+	}
+	return s.defaultWeight
+}
+
+func (s *weightedStrategy) next() probeTarget {
+	if targets, gen := s.list.snapshot(); s.targets == nil || gen != s.gen {
+		s.gen, s.targets = gen, targets
+		s.cumulative = make([]float64, len(targets))
+		var total float64
+		for i, target := range targets {
+			total += s.weight(target)
+			s.cumulative[i] = total
+		}
+		if total == 0 {
+			log.Warn("Every target has a weight of zero, probing them uniformly")
+		}
+	}
+	total := s.cumulative[len(s.cumulative)-1]
+	if total == 0 {
+		return probeTarget{target: s.targets[rand.Intn(len(s.targets))]}
+	}
+	i := sort.SearchFloat64s(s.cumulative, rand.Float64()*total)
+	for i < len(s.cumulative)-1 && s.cumulative[i] == 0 {
+		i++
+	}
+	return probeTarget{target: s.targets[i]}
+}
+
+// stratifiedStrategy picks an ASN or country uniformly and then a target within it, so networks with many
+// targets aren't probed more often than those with few. Targets that can't be looked up form one stratum.
+type stratifiedStrategy struct {
+	list *targetList
+	by   string
+
+	gen    uint64
+	strata [][]string
+}
+
+func (s *stratifiedStrategy) next() probeTarget {
+	if targets, gen := s.list.snapshot(); s.strata == nil || gen != s.gen {
+		s.gen = gen
+		byKey := map[string][]string{}
+		for _, target := range targets {
+			var key string
+			if ip := net.ParseIP(target); ip != nil {
+				country, asn := geo.lookup(ip)
+				if s.by == stratifyCountry {
+					key = country
+				} else if asn != 0 {
+					key = strconv.FormatUint(uint64(asn), 10)
+				}
+			}
+			byKey[key] = append(byKey[key], target)
+		}
+		s.strata = make([][]string, 0, len(byKey))
+		for _, stratum := range byKey {
+			s.strata = append(s.strata, stratum)
+		}
+		log.Infof("Sampling %d targets from %d strata by %s", len(targets), len(s.strata), s.by)
+	}
+	stratum := s.strata[rand.Intn(len(s.strata))]
+	return probeTarget{target: stratum[rand.Intn(len(stratum))]}
+}
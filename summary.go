@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	summaryTop   = 5               // Countries and ASNs listed in a sweep summary
+	summaryDelay = 5 * time.Second // Extra wait for replies queued in sinks or streamed from agents
+)
+
+// sweepKey identifies a sweep of a probing node
+type sweepKey struct {
+	node  uint16
+	sweep uint32
+}
+
+// sweepTally counts the replies to a sweep until it's summarized
+type sweepTally struct {
+	targets    int                   // Targets in the sweep, only known for this node's sweeps
+	responders map[string]bool       // Targets that answered
+	replies    map[uint16]int        // Replies by collector
+	countries  map[string]int        // Replies by responder country, with GeoIP enabled
+	asns       map[uint32]int        // Replies by responder ASN, with GeoIP enabled
+	mtus       map[string]*targetMTU // Path MTU probe results by target, with probe.pmtu set
+	ending     bool                  // Summary is scheduled
+}
+
+// sweepSummarizer reports the catchment of every finished sweep, so the share of the hitlist landing at each
+// site can be read directly rather than derived from counters. Sweeps are summarized once the next sweep has
+// started and replies to the last probes have had time to arrive.
+type sweepSummarizer struct {
+	id    uint16
+	grace time.Duration
+
+	lock   sync.Mutex
+	open   map[sweepKey]*sweepTally
+	latest map[uint16]uint32 // Latest sweep of each node, so replies to summarized sweeps are ignored
+	shares map[uint16]map[string]bool
+
+	share      *prometheus.GaugeVec
+	targets    *prometheus.GaugeVec
+	responders *prometheus.GaugeVec
+	loss       *prometheus.GaugeVec
+}
+
+// summary is nil until metrics are registered
+var summary *sweepSummarizer
+
+// newSweepSummarizer creates a summarizer for this node, waiting grace after a sweep ends for its replies
+func newSweepSummarizer(id uint16, grace time.Duration, reg prometheus.Registerer, constLabels prometheus.Labels) *sweepSummarizer {
+	factory := promauto.With(reg)
+	return &sweepSummarizer{
+		id:     id,
+		grace:  grace,
+		open:   map[sweepKey]*sweepTally{},
+		latest: map[uint16]uint32{},
+		shares: map[uint16]map[string]bool{},
+		share: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "verfploeter_catchment_share",
+			ConstLabels: constLabels,
+		}, []string{"node", "dst"}),
+		targets: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "verfploeter_sweep_targets",
+			ConstLabels: constLabels,
+		}, []string{"dst"}),
+		responders: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "verfploeter_sweep_responders",
+			ConstLabels: constLabels,
+		}, []string{"dst"}),
+		loss: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "verfploeter_sweep_loss_ratio",
+			ConstLabels: constLabels,
+		}, []string{"dst"}),
+	}
+}
+
+// tally returns the tally of a sweep, scheduling the summaries of the node's earlier sweeps when a new one
+// starts. Sweeps that were already summarized return nil.
+func (s *sweepSummarizer) tally(key sweepKey) *sweepTally {
+	if t, ok := s.open[key]; ok {
+		return t
+	}
+	if latest, ok := s.latest[key.node]; ok && key.sweep <= latest {
+		return nil
+	}
+	s.latest[key.node] = key.sweep
+	for k, t := range s.open {
+		if k.node == key.node && !t.ending {
+			t.ending = true
+			k := k
+			time.AfterFunc(s.grace, func() {
+				s.finish(k)
+			})
+		}
+	}
+	t := &sweepTally{
+		responders: map[string]bool{},
+		replies:    map[uint16]int{},
+		countries:  map[string]int{},
+		asns:       map[uint32]int{},
+		mtus:       map[string]*targetMTU{},
+	}
+	s.open[key] = t
+	return t
+}
+
+// start records the number of targets in a sweep of this node
+func (s *sweepSummarizer) start(sweep uint32, targets int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if t := s.tally(sweepKey{s.id, sweep}); t != nil {
+		t.targets = targets
+	}
+}
+
+// write counts a reply towards its sweep, and errors towards its path MTU results
+func (s *sweepSummarizer) write(record replyRecord) {
+	if record.Sweep == 0 || record.Hop != 0 || (record.Error != "" && pmtu == nil) {
+		return
+	}
+	target := record.Target
+	if target == "" {
+		target = record.Responder
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	t := s.tally(sweepKey{record.Node, record.Sweep})
+	if t == nil {
+		return
+	}
+	if pmtu != nil {
+		pmtu.tally(t.mtus, record)
+	}
+	if record.Error != "" {
+		return
+	}
+	t.responders[target] = true
+	t.replies[record.Collector]++
+	if record.Country != "" {
+		t.countries[record.Country]++
+	}
+	if record.ASN != 0 {
+		t.asns[record.ASN]++
+	}
+}
+
+// close summarizes the sweeps still open, such as the last one before shutdown
+func (s *sweepSummarizer) close() {
+	s.lock.Lock()
+	var keys []sweepKey
+	for key := range s.open {
+		keys = append(keys, key)
+	}
+	s.lock.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].sweep < keys[j].sweep
+	})
+	for _, key := range keys {
+		s.finish(key)
+	}
+}
+
+// finish logs the summary of a sweep and updates the gauges
+func (s *sweepSummarizer) finish(key sweepKey) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	t, ok := s.open[key]
+	if !ok {
+		return
+	}
+	delete(s.open, key)
+
+	nodes := currentNodes()
+	dst := findNode(key.node, nodes)
+	total := 0
+	for _, n := range t.replies {
+		total += n
+	}
+
+	// Collectors that caught replies in an earlier sweep but not this one drop to zero
+	previous := s.shares[key.node]
+	s.shares[key.node] = map[string]bool{}
+	var collectors []uint16
+	for collector := range t.replies {
+		collectors = append(collectors, collector)
+	}
+	sort.Slice(collectors, func(i, j int) bool {
+		return t.replies[collectors[i]] > t.replies[collectors[j]]
+	})
+	var shares []string
+	for _, collector := range collectors {
+		name := findNode(collector, nodes)
+		share := float64(t.replies[collector]) / float64(total)
+		s.share.With(map[string]string{"node": name, "dst": dst}).Set(share)
+		s.shares[key.node][name] = true
+		shares = append(shares, fmt.Sprintf("%s=%.1f%%", name, share*100))
+	}
+	for name := range previous {
+		if !s.shares[key.node][name] {
+			s.share.With(map[string]string{"node": name, "dst": dst}).Set(0)
+		}
+	}
+
+	fields := log.Fields{
+		"node":       dst,
+		"sweep":      key.sweep,
+		"replies":    total,
+		"responders": len(t.responders),
+		"share":      strings.Join(shares, ","),
+	}
+	s.responders.With(map[string]string{"dst": dst}).Set(float64(len(t.responders)))
+	if t.targets > 0 {
+		loss := 1 - float64(len(t.responders))/float64(t.targets)
+		if loss < 0 {
+			loss = 0
+		}
+		fields["targets"] = t.targets
+		fields["loss"] = fmt.Sprintf("%.1f%%", loss*100)
+		s.targets.With(map[string]string{"dst": dst}).Set(float64(t.targets))
+		s.loss.With(map[string]string{"dst": dst}).Set(loss)
+	}
+	if len(t.countries) > 0 {
+		fields["countries"] = topCounts(t.countries)
+	}
+	if len(t.asns) > 0 {
+		asns := map[string]int{}
+		for asn, n := range t.asns {
+			asns["AS"+strconv.FormatUint(uint64(asn), 10)] = n
+		}
+		fields["asns"] = topCounts(asns)
+	}
+	if pmtu != nil {
+		pmtu.finish(dst, t.mtus, fields)
+	}
+	log.WithFields(fields).Info("Sweep summary")
+}
+
+// topCounts formats the largest counts as name=count, largest first
+func topCounts(counts map[string]int) string {
+	var names []string
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > summaryTop {
+		names = names[:summaryTop]
+	}
+	for i, name := range names {
+		names[i] = fmt.Sprintf("%s=%d", name, counts[name])
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// dialSyslog is only supported on Unix
+func dialSyslog(_ string) (io.WriteCloser, error) {
+	return nil, errors.New("syslog is only supported on Unix")
+}
@@ -0,0 +1,23 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+	"net/url"
+)
+
+// dialSyslog connects to the local syslog daemon if addr is "local", or a remote one at a URL such as
+// udp://192.0.2.1:514
+func dialSyslog(addr string) (io.WriteCloser, error) {
+	var network, raddr string
+	if addr != "local" {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+	return syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, "verfploeter")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sdNotify sends a state change such as READY=1 to systemd, doing nothing unless run as a notify service
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:] // Abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Warnf("Unable to notify systemd: %s", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Warnf("Unable to notify systemd: %s", err)
+	}
+}
+
+// notifyReady tells systemd the service is up once the echo listeners are running
+func notifyReady() {
+	for atomic.LoadInt32(&listeners) < minListeners {
+		time.Sleep(10 * time.Millisecond)
+	}
+	sdNotify("READY=1")
+}
+
+// watchdogInterval returns the WatchdogSec of the service, or zero if the watchdog isn't enabled for this process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+var (
+	// watchdogEvery is how often to ping the systemd watchdog, zero if it isn't enabled
+	watchdogEvery time.Duration
+
+	// watchdogLast is the Unix time in nanoseconds of the last watchdog ping
+	watchdogLast int64
+)
+
+// runWatchdog pings the systemd watchdog twice per interval. While probing, the pings come from the probe loop,
+// so systemd restarts the service once the loop stops sending probes. Otherwise, as on collectors or while
+// paused, they're sent from here for as long as the service is healthy.
+func runWatchdog() {
+	log.Infof("Pinging systemd watchdog every %s", watchdogEvery)
+	for range time.Tick(watchdogEvery) {
+		if atomic.LoadInt64(&probeStale) == 0 || atomic.LoadInt32(&draining) != 0 || control.paused() || waitingForSchedule() {
+			pingWatchdog()
+		}
+	}
+}
+
+// pingWatchdog pings the systemd watchdog if it's enabled, the last ping was at least half an interval ago and
+// the service is healthy
+func pingWatchdog() {
+	if watchdogEvery == 0 {
+		return
+	}
+	now, last := time.Now().UnixNano(), atomic.LoadInt64(&watchdogLast)
+	if now-last < int64(watchdogEvery) || !atomic.CompareAndSwapInt64(&watchdogLast, last, now) {
+		return
+	}
+	if reason := healthReason(); reason != "" {
+		log.Warnf("Not pinging systemd watchdog: %s", reason)
+		return
+	}
+	sdNotify("WATCHDOG=1")
+}
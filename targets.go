@@ -0,0 +1,434 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// targetList is the set of probe targets, swapped atomically on reload. Each target's index is
+// carried in its probes so replies can be mapped back to the target that was probed.
+type targetList struct {
+	lock    sync.RWMutex
+	targets []string
+	indexes map[string]int
+	aliases map[string]bool // Canonical forms of addresses that aren't written canonically
+	gen     uint64          // Incremented on every set
+}
+
+// set replaces the targets
+func (l *targetList) set(targets []string) {
+	indexes := make(map[string]int, len(targets))
+	aliases := map[string]bool{}
+	for i, target := range targets {
+		indexes[target] = i
+		if ip := net.ParseIP(target); ip != nil && ip.String() != target {
+			aliases[ip.String()] = true
+		}
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.targets = targets
+	l.indexes = indexes
+	l.aliases = aliases
+	l.gen++
+}
+
+// contains checks if an address is a target, however it was written
+func (l *targetList) contains(ip net.IP) bool {
+	s := ip.String()
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	_, ok := l.indexes[s]
+	return ok || l.aliases[s]
+}
+
+// hasFamily checks if any target is an address of an IP version, 4 or 6
+func (l *targetList) hasFamily(ipVersion int) bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	for _, target := range l.targets {
+		if ip := net.ParseIP(target); ip != nil && (ip.To4() != nil) == (ipVersion == 4) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromTarget checks if a reply came from a target or the address of a hostname target, counting it as
+// unsolicited if it didn't, so background ICMP and scanners aren't taken for catchment data
+func fromTarget(src net.Addr, kind string) bool {
+	if anySource {
+		return true
+	}
+	if addr, ok := src.(*net.IPAddr); ok {
+		for _, p := range profiles {
+			if p.targets.contains(addr.IP) {
+				return true
+			}
+		}
+		if resolver.resolved(addr.IP) {
+			return true
+		}
+	}
+	unsolicitedReplies.Inc()
+	log.Debugf("Ignoring %s from %s, which isn't a target", kind, src)
+	return false
+}
+
+// index returns the index of a target
+func (l *targetList) index(target string) (int, bool) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	i, ok := l.indexes[target]
+	return i, ok
+}
+
+// at returns the target at an index
+func (l *targetList) at(i int) (string, bool) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if i < 0 || i >= len(l.targets) {
+		return "", false
+	}
+	return l.targets[i], true
+}
+
+// all returns the current targets, which must not be modified
+func (l *targetList) all() []string {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.targets
+}
+
+// snapshot returns the current targets, which must not be modified, and how many times they've been set
+func (l *targetList) snapshot() ([]string, uint64) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.targets, l.gen
+}
+
+// random returns a random target
+func (l *targetList) random() string {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.targets[rand.Intn(len(l.targets))]
+}
+
+// probeTarget is a single probe to be sent by a worker
+type probeTarget struct {
+	target   string
+	sweep    uint32
+	attempt  int    // Retransmissions of the probe before this one
+	size     int    // IP packet size of a retransmitted path MTU probe, zero to send every size
+	protocol string // Protocol to probe with, with probe.fallback, or empty for the target's first
+	profile  *probeProfile
+}
+
+// sweeper iterates over every target in order, or in a new random order each time if shuffle is set,
+// starting a new numbered sweep after the last one. Reloaded targets take effect at the start of the next
+// sweep.
+type sweeper struct {
+	list    *targetList
+	shuffle bool
+	targets []string
+	pos     int
+	sweep   uint32
+}
+
+func newSweeper(list *targetList) *sweeper {
+	return &sweeper{list: list}
+}
+
+// sweeps numbers the sweeps of every sweeper, so sweeps of different profiles don't share a number
+var sweeps uint32
+
+// restart ends the current sweep so the next target starts a new one
+func (s *sweeper) restart() {
+	s.pos = len(s.targets)
+}
+
+// next returns the next target in the current sweep
+func (s *sweeper) next() probeTarget {
+	if s.pos >= len(s.targets) {
+		s.targets = s.list.all()
+		if s.shuffle {
+			s.targets = append([]string{}, s.targets...)
+			rand.Shuffle(len(s.targets), func(i, j int) {
+				s.targets[i], s.targets[j] = s.targets[j], s.targets[i]
+			})
+		}
+		s.pos = 0
+		s.sweep = atomic.AddUint32(&sweeps, 1)
+		log.WithField("sweep", s.sweep).Infof("Starting sweep of %d targets", len(s.targets))
+		if summary != nil {
+			summary.start(s.sweep, len(s.targets))
+		}
+	}
+	target := s.targets[s.pos]
+	s.pos++
+	return probeTarget{target: target, sweep: s.sweep}
+}
+
+// maxPrefixBits limits how many addresses a single prefix in the targets file can expand to
+const maxPrefixBits = 24
+
+// exclusions are prefixes that must never be probed
+var exclusions []*net.IPNet
+
+// readLines reads a file ("-" for stdin, or an HTTP(S) URL) and returns its lines without whitespace, blank
+// lines, or comments
+func readLines(filename string) ([]string, int, error) {
+	var b []byte
+	var err error
+	if filename == "-" {
+		b, err = io.ReadAll(os.Stdin)
+	} else if isURL(filename) {
+		b, _, err = fetchURL(filename)
+	} else {
+		b, err = os.ReadFile(filename)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var lines []string
+	skipped := 0
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			skipped++
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, skipped, nil
+}
+
+// loadExclusions reads do-not-probe files of addresses and prefixes
+func loadExclusions(filenames []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, filename := range filenames {
+		lines, _, err := readLines(filename)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read exclusions file %s: %s", filename, err)
+		}
+		for _, line := range lines {
+			if !strings.Contains(line, "/") {
+				if strings.Contains(line, ":") {
+					line += "/128"
+				} else {
+					line += "/32"
+				}
+			}
+			_, prefix, err := net.ParseCIDR(line)
+			if err != nil {
+				return nil, fmt.Errorf("invalid exclusion in %s: %s", filename, err)
+			}
+			nets = append(nets, prefix)
+		}
+	}
+	log.Infof("Loaded %d exclusions", len(nets))
+	return nets, nil
+}
+
+// isExcluded checks if an address falls within an excluded prefix
+func isExcluded(ip net.IP) bool {
+	for _, prefix := range exclusions {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandPrefix returns every address in a prefix
+func expandPrefix(prefix *net.IPNet) ([]string, error) {
+	ones, bits := prefix.Mask.Size()
+	if bits-ones > maxPrefixBits {
+		return nil, fmt.Errorf("prefix %s is larger than the maximum of %d addresses", prefix, 1<<maxPrefixBits)
+	}
+
+	addrs := make([]string, 0, 1<<(bits-ones))
+	ip := make(net.IP, len(prefix.IP))
+	copy(ip, prefix.IP)
+	last := lastIP(prefix)
+	for {
+		addrs = append(addrs, ip.String())
+		if ip.Equal(last) {
+			return addrs, nil
+		}
+		incrementIP(ip)
+	}
+}
+
+// lastIP returns the last address in a prefix
+func lastIP(prefix *net.IPNet) net.IP {
+	ip := make(net.IP, len(prefix.IP))
+	for i := range prefix.IP {
+		ip[i] = prefix.IP[i] | ^prefix.Mask[i]
+	}
+	return ip
+}
+
+// incrementIP adds one to an address in place
+func incrementIP(ip net.IP) {
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i]++
+		if ip[i] != 0 {
+			return
+		}
+	}
+}
+
+// loadTargets reads one or more targets files ("-" for stdin), expanding prefixes and skipping blank lines,
+// comments, duplicates, and excluded addresses
+func loadTargets(filenames []string) ([]string, error) {
+	var targets []string
+	seen := map[string]bool{}
+	skipped, excluded := 0, 0
+	add := func(target string) {
+		if seen[target] {
+			skipped++
+			return
+		}
+		if ip := net.ParseIP(target); ip != nil && isExcluded(ip) {
+			excluded++
+			return
+		}
+		seen[target] = true
+		targets = append(targets, target)
+	}
+
+	for _, filename := range filenames {
+		lines, blank, err := readLines(filename)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read targets file %s: %s", filename, err)
+		}
+		skipped += blank
+
+		for _, line := range lines {
+			if !strings.Contains(line, "/") {
+				add(line)
+				continue
+			}
+			_, prefix, err := net.ParseCIDR(line)
+			if err != nil {
+				return nil, fmt.Errorf("invalid prefix in %s: %s", filename, err)
+			}
+			addrs, err := expandPrefix(prefix)
+			if err != nil {
+				return nil, err
+			}
+			for _, addr := range addrs {
+				add(addr)
+			}
+		}
+	}
+	log.Infof("Loaded %d targets from %s (%d lines skipped, %d excluded)",
+		len(targets), strings.Join(filenames, ", "), skipped, excluded)
+	return targets, nil
+}
+
+// reloadTargets re-reads the targets files into list, keeping the current targets on failure
+func reloadTargets(list *targetList, filenames []string) {
+	for _, filename := range filenames {
+		if filename == "-" {
+			log.Warn("Keeping current targets: targets read from stdin can't be reloaded")
+			return
+		}
+	}
+
+	newTargets, err := loadTargets(filenames)
+	if err != nil {
+		log.Warnf("Keeping current targets: %s", err)
+		return
+	}
+	if len(newTargets) == 0 {
+		log.Warn("Keeping current targets: reloaded targets list is empty")
+		return
+	}
+	if equalTargets(newTargets, list.all()) {
+		log.Debug("Targets unchanged")
+		return
+	}
+	resolver.resolve(newTargets)
+	list.set(newTargets)
+	log.Infof("Reloaded %d targets", len(newTargets))
+}
+
+// equalTargets checks if two target lists are the same in the same order
+func equalTargets(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// watchTargets reloads the targets into list whenever one of the targets files changes
+func watchTargets(list *targetList, filenames []string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// Watch the parent directories so files replaced by a rename are picked up
+	watched := map[string]bool{}
+	for _, filename := range filenames {
+		if filename == "-" || isURL(filename) {
+			continue
+		}
+		abs, err := filepath.Abs(filename)
+		if err != nil {
+			return err
+		}
+		watched[abs] = true
+		if err := watcher.Add(filepath.Dir(abs)); err != nil {
+			return fmt.Errorf("unable to watch %s: %s", filename, err)
+		}
+	}
+
+	go func() {
+		// Writers often produce several events per update, so wait for them to settle
+		var debounce *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !watched[event.Name] || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				if debounce != nil {
+					debounce.Stop()
+				}
+				debounce = time.AfterFunc(250*time.Millisecond, func() {
+					reloadTargets(list, filenames)
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Warnf("Targets watcher: %s", err)
+			}
+		}
+	}()
+	return nil
+}
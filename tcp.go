@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/natesales/go-verfploeter/pkg/verfploeter"
+	log "github.com/sirupsen/logrus"
+)
+
+// Raw TCP sockets and the prober that sends SYNs on them, only opened in TCP probe mode
+var (
+	tcp4      net.PacketConn
+	tcp6      net.PacketConn
+	tcpProber *verfploeter.TCPProber
+)
+
+// tcpProbe sends a TCP SYN to a given target
+func tcpProbe(p probeTarget) error {
+	metrics := p.profile.metrics
+	targetIP, err := resolver.lookup(p.target)
+	if err != nil {
+		metrics.countProbeError(probeErrorResolve, nil)
+		return err
+	}
+	if isExcluded(targetIP.IP) {
+		return errExcluded
+	}
+
+	probe, err := tcpProber.Build(targetIP, p.target, p.sweep)
+	if err != nil {
+		metrics.countProbeError(probeErrorNoSource, targetIP.IP)
+		return err
+	}
+	probe.Attempt = p.attempt
+	probe.Tag = p.profile.name
+
+	if *dryRun {
+		log.WithFields(log.Fields{
+			"target": p.target,
+			"addr":   targetIP.String(),
+			"id":     tcpProber.ID,
+			"seq":    probe.Seq,
+			"port":   tcpProber.Port,
+		}).Info("Dry run, not sending TCP probe")
+		return nil
+	}
+
+	metrics.requests.Inc()
+	atomic.AddUint64(&sentTotal, 1)
+	if err := tcpProber.Send(probe); err != nil {
+		metrics.countProbeError(probeErrorWrite, targetIP.IP)
+		return err
+	}
+	return nil
+}
+
+// tcpSource returns the IPv4 source address that a probe to dst will be sent from
+func tcpSource(dst net.IP) (net.IP, error) {
+	if spoof4 != nil {
+		return spoof4.src, nil
+	}
+	if addr, ok := tcp4.LocalAddr().(*net.IPAddr); ok && !addr.IP.IsUnspecified() {
+		return addr.IP, nil
+	}
+
+	// Connecting a UDP socket picks the source from the routing table without sending anything
+	var d net.Dialer
+	if probeDevice != "" {
+		d.Control = func(_, _ string, c syscall.RawConn) error {
+			return sockets.bindToDevice(c, probeDevice)
+		}
+	}
+	c, err := d.Dial("udp4", (&net.UDPAddr{IP: dst, Port: tcpProber.Port}).String())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// listenTCPReplies reads SYN-ACKs and RSTs from a raw TCP socket until it is closed. Unsolicited replies are
+// counted like unsolicited echo replies.
+func listenTCPReplies(pc net.PacketConn, family string) {
+	atomic.AddInt32(&listeners, 1)
+	defer atomic.AddInt32(&listeners, -1)
+	l := &verfploeter.TCPListener{
+		ID:      listener.ID,
+		Port:    tcpProber.Port,
+		Tracker: tracker,
+		Dedup:   dedup,
+		Nodes:   currentNodes,
+	}
+	_ = l.Serve(pc, verfploeter.Handler{
+		Reply: func(result *verfploeter.Result) {
+			if !fromTarget(result.Src, "TCP "+result.Response) {
+				return
+			}
+			handleReply(portReply(result, family))
+		},
+		Reject: func(err error) {
+			rejectPortReply(err, "TCP", family)
+		},
+	})
+}
+
+// portReply counts a reply to a TCP or UDP probe against the profile that probes the responder and builds
+// its record
+func portReply(result *verfploeter.Result, family string) replyRecord {
+	record := replyRecord{
+		Time:      result.Time,
+		Collector: result.Collector,
+		Node:      result.Node,
+		Responder: result.Src.String(),
+		Seq:       result.Seq,
+		Response:  result.Response,
+	}
+	p := profiles[0]
+	if addr, ok := result.Src.(*net.IPAddr); ok {
+		p = addrProfile(addr.IP)
+	}
+	record.Profile = p.name
+	dst := p.answer(result.Node)
+	atomic.AddUint64(&repliesTotal, 1)
+	if d, ok := result.RTT(); ok {
+		record.RTT = d.Seconds()
+		p.metrics.rtt.With(map[string]string{"dst": dst, "family": family}).Observe(d.Seconds())
+	}
+	if _, ok := p.targets.index(result.Src.String()); ok {
+		record.Target = result.Src.String()
+	}
+	return record
+}
+
+// rejectPortReply counts a rejected reply to a TCP or UDP probe
+func rejectPortReply(err error, kind, family string) {
+	switch {
+	case errors.Is(err, verfploeter.ErrDuplicate):
+		duplicates.Inc()
+		log.Debugf("%s %s", kind, err)
+	case errors.Is(err, verfploeter.ErrUnsolicited):
+		unsolicited.Inc()
+		log.Debugf("%s %s", kind, err)
+	default:
+		log.WithField("family", family).Warn(err)
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/time/rate"
+
+	"github.com/natesales/go-verfploeter/pkg/verfploeter"
+)
+
+// tracePortBase is the destination port of UDP traceroute probes with a TTL of one, increasing by one per hop
+const tracePortBase = 33434
+
+// pathTracer maps the forward path from this node to a sample of targets every interval, with probes of
+// increasing TTL. Routers along the path answer with time exceeded errors, which arrive at the source's
+// listener like any other ICMP and are matched to the traceroute probes before the usual handling. Every
+// TTL is probed at once, so a trace takes a single timeout at the cost of probing past the target.
+type pathTracer struct {
+	id       int
+	protocol string // protocolICMP or protocolUDP
+	sample   int
+	maxHops  int
+	timeout  time.Duration
+	limiter  *rate.Limiter
+	conns    map[int]net.PacketConn      // Send-only raw sockets by IP version
+	sources  map[int]*verfploeter.Source // Sources the sockets are bound to, whose listeners receive the answers
+
+	lock        sync.Mutex
+	outstanding map[traceKey]*traceProbe
+
+	pathLength *prometheus.HistogramVec
+	traces     *prometheus.CounterVec
+}
+
+// traceKey identifies a traceroute probe in the packet quoted by an ICMP error
+type traceKey struct {
+	dst string
+	id  int // Echo sequence number of ICMP probes, destination port of UDP probes
+}
+
+// traceProbe is a traceroute probe waiting for an answer
+type traceProbe struct {
+	path *tracePath
+	ttl  int
+	seq  int
+	sent time.Time
+}
+
+// tracePath is the path to a target being traced
+type tracePath struct {
+	target string
+	addr   *net.IPAddr
+	index  uint32
+	sweep  uint32
+	hops   []replyRecord // By TTL, with an empty Responder where nothing answered
+}
+
+// tracer is nil unless traceroute.interval is set
+var tracer *pathTracer
+
+// newPathTracer opens raw sockets bound to the first source of each family to send traceroute probes from
+func newPathTracer(config *Config, reg prometheus.Registerer, constLabels prometheus.Labels) (*pathTracer, error) {
+	factory := promauto.With(reg)
+	t := &pathTracer{
+		id:          int(config.ID),
+		protocol:    config.Traceroute.Protocol,
+		sample:      config.Traceroute.Sample,
+		maxHops:     config.Traceroute.MaxHops,
+		timeout:     config.Traceroute.Timeout,
+		limiter:     rate.NewLimiter(rate.Limit(config.Traceroute.Rate), 1),
+		conns:       map[int]net.PacketConn{},
+		sources:     map[int]*verfploeter.Source{},
+		outstanding: map[traceKey]*traceProbe{},
+		pathLength: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "verfploeter_traceroute_path_length",
+			Buckets:     prometheus.LinearBuckets(2, 2, 16),
+			ConstLabels: constLabels,
+		}, []string{"family"}),
+		traces: factory.NewCounterVec(prometheus.CounterOpts{
+			Name:        "verfploeter_traceroutes_total",
+			ConstLabels: constLabels,
+		}, []string{"result"}),
+	}
+	if t.timeout == 0 {
+		t.timeout = config.Probe.Timeout
+	}
+
+	// Every packet of the protocol is delivered to raw sockets, so drop them all since answers are read elsewhere
+	dropAll, err := bpf.Assemble([]bpf.Instruction{bpf.RetConstant{Val: 0}})
+	if err != nil {
+		return nil, err
+	}
+	for _, ipVersion := range []int{4, 6} {
+		sources := probeSources.Family(ipVersion)
+		if len(sources) == 0 {
+			continue
+		}
+		source := sources[0]
+		if _, ok := source.Conn.(*datagramConn); ok {
+			return nil, errors.New("traceroute needs raw sockets")
+		}
+		address := "0.0.0.0"
+		if ipVersion == 6 {
+			address = "::"
+		}
+		if source.Addr != nil {
+			address = source.Addr.String()
+		}
+		network := fmt.Sprintf("ip%d:%s", ipVersion, t.protocol)
+		conn, err := listenRaw(network, address, probeDevice)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open raw IPv%d %s socket: %s", ipVersion, strings.ToUpper(t.protocol), err)
+		}
+		if t.protocol == protocolUDP && ipVersion == 6 {
+			if err := ipv6.NewPacketConn(conn).SetChecksum(true, 6); err != nil {
+				return nil, fmt.Errorf("unable to enable IPv6 UDP checksums: %s", err)
+			}
+		}
+		if c, ok := conn.(*net.IPConn); ok {
+			if err := sockets.setBPF(c, ipVersion, dropAll); err != nil && !isUnsupported(err) {
+				log.Warnf("Unable to filter IPv%d traceroute socket: %s", ipVersion, err)
+			}
+		}
+		t.conns[ipVersion] = conn
+		t.sources[ipVersion] = source
+	}
+	return t, nil
+}
+
+// run traces the paths to a new sample of targets every interval, unless probing is paused or held back by
+// the schedule
+func (t *pathTracer) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if control.paused() || waitingForSchedule() {
+			continue
+		}
+		t.trace()
+	}
+}
+
+// trace probes the path to a random sample of targets and records the hops once the last probe times out
+func (t *pathTracer) trace() {
+	all := allTargets()
+	picked := map[int]bool{}
+	if len(all) <= t.sample {
+		for i := range all {
+			picked[i] = true
+		}
+	} else {
+		for len(picked) < t.sample {
+			picked[rand.Intn(len(all))] = true
+		}
+	}
+	sweep := control.currentSweep()
+	var paths []*tracePath
+	for i := range picked {
+		addr, err := resolver.lookup(all[i])
+		if err != nil || isExcluded(addr.IP) {
+			continue
+		}
+		if t.conns[addrVersion(addr.IP)] == nil {
+			continue
+		}
+		paths = append(paths, &tracePath{
+			target: all[i],
+			addr:   addr,
+			index:  uint32(i),
+			sweep:  sweep,
+			hops:   make([]replyRecord, t.maxHops),
+		})
+	}
+	if len(paths) == 0 {
+		return
+	}
+	log.Debugf("Tracing the paths to %d targets", len(paths))
+
+	for ttl := 1; ttl <= t.maxHops; ttl++ {
+		for v, conn := range t.conns {
+			if err := setProbeOptions(conn, v, 0, ttl); err != nil {
+				log.Warnf("Unable to trace paths: %s", err)
+				return
+			}
+		}
+		for _, path := range paths {
+			_ = t.limiter.Wait(context.Background())
+			if err := t.send(path, ttl); err != nil {
+				log.WithField("target", path.target).Debugf("Unable to send traceroute probe: %s", err)
+			}
+		}
+	}
+	time.Sleep(t.timeout)
+
+	// Late answers are handled like any other ICMP
+	t.lock.Lock()
+	t.outstanding = map[traceKey]*traceProbe{}
+	t.lock.Unlock()
+	for _, path := range paths {
+		t.finish(path)
+	}
+}
+
+// send sends a probe with a TTL to the target of a path
+func (t *pathTracer) send(path *tracePath, ttl int) error {
+	v := addrVersion(path.addr.IP)
+	probe := &traceProbe{path: path, ttl: ttl, sent: time.Now()}
+	var b []byte
+	var key traceKey
+	if t.protocol == protocolUDP {
+		port := tracePortBase + ttl - 1
+		b = make([]byte, verfploeter.UDPHeaderLen)
+		binary.BigEndian.PutUint16(b[0:2], uint16(verfploeter.ProbePortBase+t.id))
+		binary.BigEndian.PutUint16(b[2:4], uint16(port))
+		binary.BigEndian.PutUint16(b[4:6], uint16(len(b)))
+		key = traceKey{path.addr.IP.String(), port}
+	} else {
+		p, err := t.sources[v].Prober.Build(path.addr, path.target, path.index, path.sweep)
+		if err != nil {
+			return err
+		}
+		b, probe.seq = p.Packet, p.Seq
+		key = traceKey{path.addr.IP.String(), verfploeter.EchoSeq(p.Seq)}
+	}
+
+	t.lock.Lock()
+	t.outstanding[key] = probe
+	t.lock.Unlock()
+	if _, err := t.conns[v].WriteTo(b, path.addr); err != nil {
+		t.lock.Lock()
+		delete(t.outstanding, key)
+		t.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// answerEcho checks if an unsolicited echo reply answers a traceroute probe, recording it if so
+func (t *pathTracer) answerEcho(err error) bool {
+	var replyErr *verfploeter.ReplyError
+	if t.protocol != protocolICMP || !errors.As(err, &replyErr) || replyErr.ID != t.id {
+		return false
+	}
+	addr, ok := replyErr.Src.(*net.IPAddr)
+	if !ok {
+		return false
+	}
+	return t.answer(traceKey{addr.IP.String(), replyErr.Seq}, replyErr.Src, "", 0)
+}
+
+// answerError checks if an ICMP error quotes a traceroute probe, recording it if so
+func (t *pathTracer) answerError(e *verfploeter.ICMPError) bool {
+	quoted, errType, ok := verfploeter.QuotedPacket(e.Message)
+	if !ok {
+		return false
+	}
+	var key traceKey
+	if t.protocol == protocolUDP {
+		dst, srcPort, dstPort, ok := verfploeter.QuotedUDP(e.Proto, quoted)
+		if !ok || srcPort != verfploeter.ProbePortBase+t.id {
+			return false
+		}
+		key = traceKey{dst.String(), dstPort}
+	} else {
+		q, ok := verfploeter.ParseQuoted(e.Proto, quoted)
+		if !ok || q.ID != t.id {
+			return false
+		}
+		key = traceKey{q.Dst.String(), verfploeter.EchoSeq(q.Seq)}
+	}
+	return t.answer(key, e.Src, errType, e.Message.Code)
+}
+
+// answer records the first answer to an outstanding probe as the hop at its TTL
+func (t *pathTracer) answer(key traceKey, src net.Addr, errType string, code int) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	probe, ok := t.outstanding[key]
+	if !ok {
+		return false
+	}
+	delete(t.outstanding, key)
+	now := time.Now()
+	probe.path.hops[probe.ttl-1] = replyRecord{
+		Time:      now,
+		Collector: uint16(t.id),
+		Node:      uint16(t.id),
+		Responder: src.String(),
+		Target:    probe.path.target,
+		Sweep:     probe.path.sweep,
+		Seq:       probe.seq,
+		RTT:       now.Sub(probe.sent).Seconds(),
+		Error:     errType,
+		Code:      code,
+		Protocol:  t.protocol,
+		Hop:       probe.ttl,
+	}
+	return true
+}
+
+// finish records the hops of a path up to the target, or the last hop that answered if it wasn't reached
+func (t *pathTracer) finish(path *tracePath) {
+	dst := path.addr.String()
+	reached, last := 0, 0
+	for i, hop := range path.hops {
+		if hop.Responder == "" {
+			continue
+		}
+		last = i + 1
+		if hop.Responder == dst && (hop.Error == "" || hop.Error == "destination_unreachable") {
+			reached = i + 1
+			break
+		}
+		if hop.Error == "destination_unreachable" {
+			break // A router can't forward the probe any further
+		}
+	}
+	end := last
+	if reached > 0 {
+		end = reached
+		t.traces.With(map[string]string{"result": "reached"}).Inc()
+		t.pathLength.With(map[string]string{"family": familyName(t.sources[addrVersion(path.addr.IP)].Proto)}).Observe(float64(reached))
+	} else {
+		t.traces.With(map[string]string{"result": "unreached"}).Inc()
+	}
+
+	responders := make([]string, end)
+	for i, hop := range path.hops[:end] {
+		responders[i] = "*"
+		if hop.Responder != "" {
+			responders[i] = hop.Responder
+			recordHop(hop)
+		}
+	}
+	log.WithFields(log.Fields{"target": path.target, "hops": reached, "path": strings.Join(responders, " ")}).Debug("Traced path")
+}
+
+// recordHop writes a traceroute hop to the sinks, which keep it out of catchment counts
+func recordHop(record replyRecord) {
+	if geo != nil {
+		geo.enrich(&record)
+	}
+	for _, sink := range sinks {
+		sink.write(record)
+	}
+}
+
+// addrVersion returns 4 for IPv4 addresses and 6 otherwise
+func addrVersion(ip net.IP) int {
+	if ip.To4() != nil {
+		return 4
+	}
+	return 6
+}
+
+// checkTraceroute validates traceroute, filling in defaults if it's enabled
+func checkTraceroute(config *Config) error {
+	t := &config.Traceroute
+	if t.Interval < 0 {
+		return fmt.Errorf("traceroute.interval %s can't be negative", t.Interval)
+	}
+	if t.Interval == 0 {
+		return nil
+	}
+	if config.Probe.Unprivileged {
+		return errors.New("traceroute needs raw sockets, which probe.unprivileged disables")
+	}
+	switch t.Protocol {
+	case "":
+		t.Protocol = protocolICMP
+	case protocolICMP:
+	case protocolUDP:
+		if config.ID > verfploeter.MaxPortNode {
+			return fmt.Errorf("id %d is too large for %s traceroute, which carries it in the source port (max %d)", config.ID, protocolUDP, verfploeter.MaxPortNode)
+		}
+	default:
+		return fmt.Errorf("unknown traceroute.protocol %q (expected %s or %s)", t.Protocol, protocolICMP, protocolUDP)
+	}
+	if t.Sample < 0 {
+		return fmt.Errorf("traceroute.sample %d can't be negative", t.Sample)
+	} else if t.Sample == 0 {
+		t.Sample = 100
+	}
+	if t.MaxHops < 0 || t.MaxHops > 255 {
+		return fmt.Errorf("traceroute.max_hops %d out of range 1-255", t.MaxHops)
+	} else if t.MaxHops == 0 {
+		t.MaxHops = 30
+	}
+	if t.Rate < 0 {
+		return fmt.Errorf("traceroute.rate_pps %g can't be negative", t.Rate)
+	} else if t.Rate == 0 {
+		t.Rate = 100
+	}
+	if t.Timeout < 0 {
+		return fmt.Errorf("traceroute.timeout %s can't be negative", t.Timeout)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"github.com/natesales/go-verfploeter/pkg/verfploeter"
+	log "github.com/sirupsen/logrus"
+)
+
+// Raw UDP sockets and the prober that sends datagrams on them, only opened in UDP probe mode
+var (
+	udp4        net.PacketConn
+	udp6        net.PacketConn
+	udpProber   *verfploeter.UDPProber
+	udpListener *verfploeter.UDPListener
+)
+
+// udpProbe sends a UDP datagram to a given target
+func udpProbe(p probeTarget) error {
+	metrics := p.profile.metrics
+	targetIP, err := resolver.lookup(p.target)
+	if err != nil {
+		metrics.countProbeError(probeErrorResolve, nil)
+		return err
+	}
+	if isExcluded(targetIP.IP) {
+		return errExcluded
+	}
+
+	probe := udpProber.Build(targetIP, p.target, p.sweep)
+	probe.Attempt = p.attempt
+	probe.Tag = p.profile.name
+
+	if *dryRun {
+		log.WithFields(log.Fields{
+			"target": p.target,
+			"addr":   targetIP.String(),
+			"id":     udpProber.ID,
+			"port":   udpProber.Port,
+			"bytes":  len(probe.Packet),
+		}).Info("Dry run, not sending UDP probe")
+		return nil
+	}
+
+	metrics.requests.Inc()
+	atomic.AddUint64(&sentTotal, 1)
+	if err := udpProber.Send(probe); err != nil {
+		metrics.countProbeError(probeErrorWrite, targetIP.IP)
+		return err
+	}
+	return nil
+}
+
+// listenUDPReplies reads application replies from a raw UDP socket until it is closed
+func listenUDPReplies(pc net.PacketConn, family string) {
+	atomic.AddInt32(&listeners, 1)
+	defer atomic.AddInt32(&listeners, -1)
+	_ = udpListener.Serve(pc, verfploeter.Handler{
+		Reply: func(result *verfploeter.Result) {
+			if !fromTarget(result.Src, "UDP "+result.Response) {
+				return
+			}
+			record := portReply(result, family)
+			if usesProtocol(protocolChaos) {
+				record.Site, _ = parseChaosSite(result.Data)
+			}
+			handleReply(record)
+		},
+		Reject: func(err error) {
+			rejectPortReply(err, "UDP", family)
+		},
+	})
+}
+
+// udpUnreachable checks if an ICMP error is a port unreachable answering one of our UDP probes, handling it
+// as a reply if so
+func udpUnreachable(e *verfploeter.ICMPError) bool {
+	result, err := udpListener.Unreachable(e)
+	if errors.Is(err, verfploeter.ErrNotReply) {
+		return false
+	} else if err != nil {
+		rejectPortReply(err, "UDP", familyName(e.Proto))
+		return true
+	}
+	if fromTarget(result.Src, "UDP "+result.Response) {
+		handleReply(portReply(result, familyName(e.Proto)))
+	}
+	return true
+}
+
+// udpProtocol returns the protocol UDP probes are sent for, udp or chaos
+func udpProtocol() string {
+	if usesProtocol(protocolChaos) {
+		return protocolChaos
+	}
+	return protocolUDP
+}